@@ -0,0 +1,119 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/alecthomas/units"
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/cache"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+const (
+	// envCacheDir overrides the directory of the download cache.
+	envCacheDir = "HELM_S3_CACHE_DIR"
+
+	// envCacheMaxSize sets the maximum size of the download cache, e.g.
+	// 512MiB. Zero disables the cache.
+	envCacheMaxSize = "HELM_S3_CACHE_MAX_SIZE"
+
+	defaultCacheMaxSize = "1GiB"
+)
+
+// openCache returns the download cache of the proxy as configured by the
+// environment.
+func openCache() (*cache.Cache, error) {
+	dir := os.Getenv(envCacheDir)
+	if dir == "" {
+		dir = filepath.Join(helmutil.CacheDir(), "helm-s3")
+	}
+
+	maxSize := os.Getenv(envCacheMaxSize)
+	if maxSize == "" {
+		maxSize = defaultCacheMaxSize
+	}
+	size, err := units.ParseBase2Bytes(maxSize)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid %s %q, expected a size like 512MiB", envCacheMaxSize, maxSize)
+	}
+
+	return cache.New(dir, int64(size)), nil
+}
+
+type cacheCleanAction struct{}
+
+func (act cacheCleanAction) Run(ctx context.Context) error {
+	c, err := openCache()
+	if err != nil {
+		return err
+	}
+
+	stats, err := c.Stats()
+	if err != nil {
+		return err
+	}
+	if err := c.Clean(); err != nil {
+		return errors.WithMessage(err, "clean download cache")
+	}
+
+	fmt.Printf("Removed %d cached objects (%s) from %s.\n", stats.Objects, formatBytes(stats.Size), c.Dir())
+	return nil
+}
+
+type cacheStatsAction struct{}
+
+func (act cacheStatsAction) Run(ctx context.Context) error {
+	c, err := openCache()
+	if err != nil {
+		return err
+	}
+
+	stats, err := c.Stats()
+	if err != nil {
+		return err
+	}
+
+	maxSize := formatBytes(c.MaxSize())
+	if c.MaxSize() == 0 {
+		maxSize = "disabled"
+	}
+
+	fmt.Printf("Directory: %s\n", c.Dir())
+	fmt.Printf("Objects:   %d\n", stats.Objects)
+	fmt.Printf("Size:      %s\n", formatBytes(stats.Size))
+	fmt.Printf("Max size:  %s\n", maxSize)
+	return nil
+}
+
+// formatBytes returns the size in a human readable form, e.g. 1.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,470 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+// repoConfigFilename is the name of the repository config file kept next to
+// the index.
+const repoConfigFilename = ".helm-s3.yaml"
+
+// Server-side encryption modes supported by the repository config.
+const (
+	sseAES256 = "AES256"
+	sseKMS    = "aws:kms"
+)
+
+// repoConfig is the configuration kept in the repository itself, so that it
+// applies to everyone working with the repository. Flags set explicitly on
+// the command line take precedence over it.
+type repoConfig struct {
+	// ACL is the canned ACL of the objects put to the repository.
+	ACL string `json:"acl,omitempty"`
+
+	// ServerSideEncryption is the server-side encryption mode of the objects
+	// put to the repository, and SSEKMSKeyID is the KMS key used in the
+	// aws:kms mode.
+	ServerSideEncryption string `json:"serverSideEncryption,omitempty"`
+	SSEKMSKeyID          string `json:"sseKMSKeyId,omitempty"`
+
+	// Relative makes charts indexed with relative URLs.
+	Relative bool `json:"relative,omitempty"`
+
+	// ContentType is the content type of the pushed charts.
+	ContentType string `json:"contentType,omitempty"`
+
+	// RequireSignature makes push accept only charts with a valid
+	// provenance file.
+	RequireSignature bool `json:"requireSignature,omitempty"`
+
+	// SoftDelete makes delete move the chart files to the trash, from where
+	// they can be restored.
+	SoftDelete bool `json:"softDelete,omitempty"`
+
+	// Retention is the policy of removing old chart versions.
+	Retention *retentionPolicy `json:"retention,omitempty"`
+}
+
+// retentionPolicy is the policy of removing old chart versions from the
+// repository.
+type retentionPolicy struct {
+	// KeepLast is the number of the latest versions kept for every chart.
+	KeepLast int `json:"keepLast,omitempty"`
+
+	// MaxAge is the age of the versions to remove.
+	MaxAge duration `json:"maxAge,omitempty"`
+
+	// PrereleaseMaxAge is the age of the prerelease versions to remove.
+	PrereleaseMaxAge duration `json:"prereleaseMaxAge,omitempty"`
+
+	// Keep is the semver constraint of the versions that are never removed,
+	// e.g. "^1.0.0 || ~2.3".
+	Keep string `json:"keep,omitempty"`
+}
+
+// duration is a time.Duration stored in the form of a string, e.g. 720h.
+type duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// retention returns the retention policy, allocating it if needed.
+func (cfg *repoConfig) retention() *retentionPolicy {
+	if cfg.Retention == nil {
+		cfg.Retention = &retentionPolicy{}
+	}
+	return cfg.Retention
+}
+
+// acl returns the ACL set by the flag, or the configured one if the flag is
+// not set.
+func (cfg repoConfig) acl(flag string) string {
+	if flag != "" {
+		return flag
+	}
+	return cfg.ACL
+}
+
+// relative returns the value of the flag, or the configured one if the flag
+// is not set.
+func (cfg repoConfig) relative(flag *bool) bool {
+	if flag != nil {
+		return *flag
+	}
+	return cfg.Relative
+}
+
+// softDelete returns the value of the flag, or the configured one if the flag
+// is not set.
+func (cfg repoConfig) softDelete(flag *bool) bool {
+	if flag != nil {
+		return *flag
+	}
+	return cfg.SoftDelete
+}
+
+// contentType returns the chart content type set by the flag, or the
+// configured one if the flag is not set.
+func (cfg repoConfig) contentType(flag string) string {
+	switch {
+	case flag != "":
+		return flag
+	case cfg.ContentType != "":
+		return cfg.ContentType
+	default:
+		return defaultChartsContentType
+	}
+}
+
+// repoConfigKey is a key of the repository config that can be managed by the
+// config command.
+type repoConfigKey struct {
+	get func(cfg repoConfig) string
+	set func(cfg *repoConfig, value string) error
+}
+
+// stringKey returns the config key of the string field, optionally validating
+// its values. An empty value unsets the field.
+func stringKey(field func(cfg *repoConfig) *string, validate func(value string) error) repoConfigKey {
+	return repoConfigKey{
+		get: func(cfg repoConfig) string {
+			return *field(&cfg)
+		},
+		set: func(cfg *repoConfig, value string) error {
+			if value != "" && validate != nil {
+				if err := validate(value); err != nil {
+					return err
+				}
+			}
+			*field(cfg) = value
+			return nil
+		},
+	}
+}
+
+// oneOf returns the validation function allowing only the given values.
+func oneOf(allowed ...string) func(value string) error {
+	return func(value string) error {
+		if !contains(allowed, value) {
+			return fmt.Errorf("invalid value %q, must be one of %v", value, allowed)
+		}
+		return nil
+	}
+}
+
+// isConstraint validates the semver constraint.
+func isConstraint(value string) error {
+	_, err := semver.NewConstraint(value)
+	return errors.Wrapf(err, "parse version constraint %q", value)
+}
+
+// boolKey returns the config key of the bool field. An empty value unsets the
+// field.
+func boolKey(field func(cfg *repoConfig) *bool) repoConfigKey {
+	return repoConfigKey{
+		get: func(cfg repoConfig) string {
+			return strconv.FormatBool(*field(&cfg))
+		},
+		set: func(cfg *repoConfig, value string) (err error) {
+			if value == "" {
+				*field(cfg) = false
+				return nil
+			}
+			*field(cfg), err = strconv.ParseBool(value)
+			return errors.Wrapf(err, "parse %q as bool", value)
+		},
+	}
+}
+
+// intKey returns the config key of the non-negative int field. An empty value
+// unsets the field.
+func intKey(field func(cfg *repoConfig) *int) repoConfigKey {
+	return repoConfigKey{
+		get: func(cfg repoConfig) string {
+			return strconv.Itoa(*field(&cfg))
+		},
+		set: func(cfg *repoConfig, value string) error {
+			if value == "" {
+				*field(cfg) = 0
+				return nil
+			}
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return errors.Wrapf(err, "parse %q as integer", value)
+			}
+			if v < 0 {
+				return fmt.Errorf("invalid value %d, must not be negative", v)
+			}
+			*field(cfg) = v
+			return nil
+		},
+	}
+}
+
+// durationKey returns the config key of the non-negative duration field. An
+// empty value unsets the field.
+func durationKey(field func(cfg *repoConfig) *duration) repoConfigKey {
+	return repoConfigKey{
+		get: func(cfg repoConfig) string {
+			return time.Duration(*field(&cfg)).String()
+		},
+		set: func(cfg *repoConfig, value string) error {
+			if value == "" {
+				*field(cfg) = 0
+				return nil
+			}
+			v, err := time.ParseDuration(value)
+			if err != nil {
+				return errors.Wrapf(err, "parse %q as duration", value)
+			}
+			if v < 0 {
+				return fmt.Errorf("invalid value %s, must not be negative", v)
+			}
+			*field(cfg) = duration(v)
+			return nil
+		},
+	}
+}
+
+// repoConfigKeys are the keys of the repository config by name.
+var repoConfigKeys = map[string]repoConfigKey{
+	"acl": stringKey(func(cfg *repoConfig) *string {
+		return &cfg.ACL
+	}, nil),
+	"serverSideEncryption": stringKey(func(cfg *repoConfig) *string {
+		return &cfg.ServerSideEncryption
+	}, oneOf(sseAES256, sseKMS)),
+	"sseKMSKeyId": stringKey(func(cfg *repoConfig) *string {
+		return &cfg.SSEKMSKeyID
+	}, nil),
+	"relative": boolKey(func(cfg *repoConfig) *bool {
+		return &cfg.Relative
+	}),
+	"contentType": stringKey(func(cfg *repoConfig) *string {
+		return &cfg.ContentType
+	}, nil),
+	"requireSignature": boolKey(func(cfg *repoConfig) *bool {
+		return &cfg.RequireSignature
+	}),
+	"softDelete": boolKey(func(cfg *repoConfig) *bool {
+		return &cfg.SoftDelete
+	}),
+	"retention.keepLast": intKey(func(cfg *repoConfig) *int {
+		return &cfg.retention().KeepLast
+	}),
+	"retention.maxAge": durationKey(func(cfg *repoConfig) *duration {
+		return &cfg.retention().MaxAge
+	}),
+	"retention.prereleaseMaxAge": durationKey(func(cfg *repoConfig) *duration {
+		return &cfg.retention().PrereleaseMaxAge
+	}),
+	"retention.keep": stringKey(func(cfg *repoConfig) *string {
+		return &cfg.retention().Keep
+	}, isConstraint),
+}
+
+// loadRepoConfig downloads the repository config and applies its encryption
+// settings to the storage, so that the objects put to the repository are
+// encrypted accordingly.
+func loadRepoConfig(ctx context.Context, storage backend.Storage, repoURL string) (repoConfig, error) {
+	cfg, err := fetchRepoConfig(ctx, storage, repoURL)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.applyEncryption(storage)
+	return cfg, nil
+}
+
+// applyEncryption sets the configured server-side encryption on the storage
+// if it supports encryption.
+func (cfg repoConfig) applyEncryption(storage backend.Storage) {
+	if e, ok := storage.(backend.Encrypter); ok {
+		e.SetEncryption(cfg.ServerSideEncryption, cfg.SSEKMSKeyID)
+	}
+}
+
+// fetchRepoConfig downloads the repository config. Repositories without the
+// config file have the zero config.
+func fetchRepoConfig(ctx context.Context, storage backend.Storage, repoURL string) (repoConfig, error) {
+	var cfg repoConfig
+
+	b, err := storage.FetchRaw(ctx, repoURL+"/"+repoConfigFilename)
+	if err != nil {
+		if err == backend.ErrObjectNotFound {
+			return cfg, nil
+		}
+		return cfg, errors.WithMessage(err, "fetch repository config")
+	}
+
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return cfg, errors.Wrap(err, "unmarshal repository config")
+	}
+
+	return cfg, nil
+}
+
+// putRepoConfig uploads the repository config.
+func putRepoConfig(ctx context.Context, storage backend.Storage, repoURL, acl string, cfg repoConfig) error {
+	// Do not keep an empty retention policy around after its keys are unset.
+	if cfg.Retention != nil && *cfg.Retention == (retentionPolicy{}) {
+		cfg.Retention = nil
+	}
+
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return errors.Wrap(err, "marshal repository config")
+	}
+
+	err = storage.PutRaw(ctx, repoURL+"/"+repoConfigFilename, bytes.NewReader(b), acl, "application/x-yaml")
+	return errors.WithMessage(err, "upload repository config")
+}
+
+// contains returns true if the value is one of the values.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type configGetAction struct {
+	repoName string
+
+	// Optional parameters.
+
+	key string
+}
+
+func (act configGetAction) Run(ctx context.Context) error {
+	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
+	if err != nil {
+		return err
+	}
+
+	storage, err := backend.New(repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	cfg, err := fetchRepoConfig(ctx, storage, repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	if act.key == "" {
+		b, err := yaml.Marshal(cfg)
+		if err != nil {
+			return errors.Wrap(err, "marshal repository config")
+		}
+		fmt.Print(string(b))
+		return nil
+	}
+
+	key, ok := repoConfigKeys[act.key]
+	if !ok {
+		return unknownConfigKeyError(act.key)
+	}
+
+	fmt.Println(key.get(cfg))
+	return nil
+}
+
+type configSetAction struct {
+	repoName string
+	key      string
+	value    string
+	acl      string
+	lockTTL  time.Duration
+}
+
+func (act configSetAction) Run(ctx context.Context) error {
+	key, ok := repoConfigKeys[act.key]
+	if !ok {
+		return unknownConfigKeyError(act.key)
+	}
+
+	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
+	if err != nil {
+		return err
+	}
+
+	storage, err := backend.New(repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockRepo(ctx, storage, repoEntry.URL(), act.lockTTL)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cfg, err := fetchRepoConfig(ctx, storage, repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	if err := key.set(&cfg, act.value); err != nil {
+		return errors.WithMessagef(err, "set %s", act.key)
+	}
+
+	cfg.applyEncryption(storage)
+	return putRepoConfig(ctx, storage, repoEntry.URL(), cfg.acl(act.acl), cfg)
+}
+
+// unknownConfigKeyError returns the error about unknown config key listing the
+// known ones.
+func unknownConfigKeyError(key string) error {
+	keys := make([]string, 0, len(repoConfigKeys))
+	for k := range repoConfigKeys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return fmt.Errorf("unknown config key %q, must be one of %v", key, keys)
+}
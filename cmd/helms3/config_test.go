@@ -0,0 +1,189 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+func TestConfigActions(t *testing.T) {
+	testCases := map[string]struct {
+		key         string
+		value       string
+		expectValue string
+		expectError bool
+	}{
+		"set require signature": {
+			key:         "requireSignature",
+			value:       "true",
+			expectValue: "true",
+		},
+		"unset require signature": {
+			key:         "requireSignature",
+			value:       "false",
+			expectValue: "false",
+		},
+		"set acl": {
+			key:         "acl",
+			value:       "public-read",
+			expectValue: "public-read",
+		},
+		"unset acl": {
+			key:         "acl",
+			value:       "",
+			expectValue: "",
+		},
+		"set server-side encryption": {
+			key:         "serverSideEncryption",
+			value:       "aws:kms",
+			expectValue: "aws:kms",
+		},
+		"unsupported server-side encryption": {
+			key:         "serverSideEncryption",
+			value:       "rot13",
+			expectError: true,
+		},
+		"unset soft delete": {
+			key:         "softDelete",
+			value:       "",
+			expectValue: "false",
+		},
+		"unset retention keep last": {
+			key:         "retention.keepLast",
+			value:       "",
+			expectValue: "0",
+		},
+		"unset retention max age": {
+			key:         "retention.maxAge",
+			value:       "",
+			expectValue: "0s",
+		},
+		"set relative": {
+			key:         "relative",
+			value:       "true",
+			expectValue: "true",
+		},
+		"set retention keep last": {
+			key:         "retention.keepLast",
+			value:       "5",
+			expectValue: "5",
+		},
+		"negative retention keep last": {
+			key:         "retention.keepLast",
+			value:       "-1",
+			expectError: true,
+		},
+		"set retention max age": {
+			key:         "retention.maxAge",
+			value:       "720h",
+			expectValue: "720h0m0s",
+		},
+		"invalid retention max age": {
+			key:         "retention.maxAge",
+			value:       "a month",
+			expectError: true,
+		},
+		"invalid value": {
+			key:         "requireSignature",
+			value:       "maybe",
+			expectError: true,
+		},
+		"unknown key": {
+			key:         "unknown",
+			value:       "true",
+			expectError: true,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				setup(t)
+
+				set := configSetAction{repoName: testRepoName, key: tc.key, value: tc.value, lockTTL: time.Minute}
+				err := set.Run(context.Background())
+				if tc.expectError {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+
+				var output []byte
+				output = captureStdout(t, func() {
+					err = configGetAction{repoName: testRepoName, key: tc.key}.Run(context.Background())
+				})
+				require.NoError(t, err)
+				require.Equal(t, tc.expectValue+"\n", string(output))
+			})
+		}
+	}
+}
+
+func TestConfigGetAction_Default(t *testing.T) {
+	for backendName, setup := range testBackends {
+		setup := setup
+		t.Run(backendName, func(t *testing.T) {
+			setup(t)
+
+			var err error
+			output := captureStdout(t, func() {
+				err = configGetAction{repoName: testRepoName, key: "requireSignature"}.Run(context.Background())
+			})
+			require.NoError(t, err)
+			require.Equal(t, "false\n", string(output))
+		})
+	}
+}
+
+func TestConfigSetAction_Persisted(t *testing.T) {
+	for backendName, setup := range testBackends {
+		setup := setup
+		t.Run(backendName, func(t *testing.T) {
+			repo := setup(t)
+
+			for key, value := range map[string]string{
+				"contentType":                "application/x-tar",
+				"retention.keepLast":         "3",
+				"retention.prereleaseMaxAge": "168h",
+			} {
+				set := configSetAction{repoName: testRepoName, key: key, value: value}
+				require.NoError(t, set.Run(context.Background()))
+			}
+
+			var cfg repoConfig
+			require.NoError(t, yaml.Unmarshal(repo.file(t, repoConfigFilename), &cfg))
+			require.Equal(t, repoConfig{
+				ContentType: "application/x-tar",
+				Retention: &retentionPolicy{
+					KeepLast:         3,
+					PrereleaseMaxAge: duration(168 * time.Hour),
+				},
+			}, cfg)
+
+			// Unsetting all retention keys drops the retention policy.
+			for _, key := range []string{"retention.keepLast", "retention.prereleaseMaxAge"} {
+				set := configSetAction{repoName: testRepoName, key: key, value: "0"}
+				require.NoError(t, set.Run(context.Background()))
+			}
+			require.Equal(t, "contentType: application/x-tar\n", string(repo.file(t, repoConfigFilename)))
+		})
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+type copyAction struct {
+	name, version    string
+	srcRepo, dstRepo string
+	acl              string
+	lockTTL          time.Duration
+
+	// force makes copy replace the chart version if it already exists in
+	// the destination repository.
+	force bool
+
+	// move makes copy delete the chart version from the source repository
+	// once it is in the destination repository.
+	move bool
+
+	// keyring is used to verify the chart if the destination repository
+	// accepts signed charts only.
+	keyring string
+}
+
+// copiedChart is the chart version copied between repositories.
+type copiedChart struct {
+	entry  helmutil.IndexEntry
+	meta   helmutil.ChartMetadata
+	fname  string
+	srcURL string
+	dstURL string
+}
+
+func (act copyAction) Run(ctx context.Context) error {
+	srcEntry, err := helmutil.LookupRepoEntry(act.srcRepo)
+	if err != nil {
+		return err
+	}
+	dstEntry, err := helmutil.LookupRepoEntry(act.dstRepo)
+	if err != nil {
+		return err
+	}
+	if srcEntry.URL() == dstEntry.URL() {
+		return errors.New("the source and the destination repositories are the same")
+	}
+
+	srcStorage, err := backend.New(srcEntry.URL())
+	if err != nil {
+		return err
+	}
+	dstStorage, err := backend.New(dstEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	srcCfg, err := loadRepoConfig(ctx, srcStorage, srcEntry.URL())
+	if err != nil {
+		return err
+	}
+	dstCfg, err := loadRepoConfig(ctx, dstStorage, dstEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	// When moving, both repositories are locked in the order of their URLs,
+	// so that two moves in opposite directions cannot wait for each other.
+	type lockedRepo struct {
+		storage backend.Storage
+		url     string
+	}
+	repos := []lockedRepo{{dstStorage, dstEntry.URL()}}
+	if act.move {
+		repos = append(repos, lockedRepo{srcStorage, srcEntry.URL()})
+		sort.Slice(repos, func(i, j int) bool { return repos[i].url < repos[j].url })
+	}
+	for _, repo := range repos {
+		unlock, err := lockRepo(ctx, repo.storage, repo.url, act.lockTTL)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	srcIdx, _, err := fetchIndex(ctx, srcStorage, srcEntry)
+	if err != nil {
+		return err
+	}
+	ch, err := act.findChart(srcIdx, srcEntry, dstEntry)
+	if err != nil {
+		return err
+	}
+
+	dstIdx, _, err := fetchIndex(ctx, dstStorage, dstEntry)
+	if err != nil {
+		return err
+	}
+	if dstIdx.Has(act.name, act.version) && !act.force {
+		return errors.WithMessagef(
+			ErrChartExists,
+			"chart %s version %s is in repository %s already, use --force to replace it",
+			act.name, act.version, act.dstRepo,
+		)
+	}
+
+	dstACL := dstCfg.acl(act.acl)
+	if err := act.transfer(ctx, srcStorage, dstStorage, dstCfg, dstACL, ch); err != nil {
+		return err
+	}
+
+	baseURL := dstEntry.URL()
+	if dstCfg.relative(nil) {
+		baseURL = ""
+	}
+	idx, err := updateIndex(ctx, dstStorage, dstEntry, dstACL, func(idx helmutil.Index) error {
+		// The digest is kept, as the chart file is the same.
+		if err := idx.AddOrReplace(ch.meta.Value(), ch.fname, baseURL, ch.entry.Digest); err != nil {
+			return errors.WithMessagef(err, "add/replace chart %s in the index", ch.fname)
+		}
+		idx.SortEntries()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := idx.WriteFile(dstEntry.CacheFile(), 0644); err != nil {
+		return errors.WithMessage(err, "update local index")
+	}
+
+	if !act.move {
+		fmt.Printf("Copied chart %s %s from repository %s to %s.\n", act.name, act.version, act.srcRepo, act.dstRepo)
+		return nil
+	}
+
+	idx, err = updateIndex(ctx, srcStorage, srcEntry, srcCfg.acl(act.acl), func(idx helmutil.Index) error {
+		if !idx.Has(act.name, act.version) {
+			return nil
+		}
+		_, err := idx.Delete(act.name, act.version)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := srcStorage.DeleteBatch(ctx, []string{ch.srcURL, ch.srcURL + provenanceSuffix}); err != nil {
+		return errors.WithMessage(err, "delete chart files from the source repository")
+	}
+	if err := idx.WriteFile(srcEntry.CacheFile(), 0644); err != nil {
+		return errors.WithMessage(err, "update local index")
+	}
+
+	fmt.Printf("Moved chart %s %s from repository %s to %s.\n", act.name, act.version, act.srcRepo, act.dstRepo)
+	return nil
+}
+
+// findChart looks up the chart version in the source index.
+func (act copyAction) findChart(srcIdx helmutil.Index, srcEntry, dstEntry helmutil.RepoEntry) (copiedChart, error) {
+	var ch copiedChart
+	found := false
+	for _, entry := range srcIdx.Entries() {
+		if entry.Name == act.name && entry.Version == act.version && len(entry.URLs) > 0 {
+			ch.entry, found = entry, true
+			break
+		}
+	}
+	if !found {
+		return ch, fmt.Errorf("chart %s version %s not found in repository %s", act.name, act.version, act.srcRepo)
+	}
+
+	// Index entries embed the chart metadata, so it is recovered from the
+	// source index rather than from the chart archive.
+	b, err := srcIdx.MarshalEntry(act.name, act.version)
+	if err != nil {
+		return ch, err
+	}
+	ch.meta = helmutil.NewChartMetadata()
+	if err := ch.meta.UnmarshalJSON(b); err != nil {
+		return ch, errors.Wrap(err, "unmarshal chart metadata")
+	}
+
+	ch.srcURL = resolveChartURL(srcEntry, ch.entry.URLs[0])
+	ch.fname = path.Base(ch.srcURL)
+	ch.dstURL = dstEntry.URL() + "/" + ch.fname
+
+	return ch, nil
+}
+
+// transfer copies the chart file along with its provenance file. Files are
+// copied on the server side within the same storage, which keeps the object
+// metadata as is. If that fails, for example because the buckets belong to
+// different accounts, or if the chart has to be verified, the files are
+// downloaded and uploaded.
+func (act copyAction) transfer(
+	ctx context.Context,
+	srcStorage, dstStorage backend.Storage,
+	dstCfg repoConfig,
+	acl string,
+	ch copiedChart,
+) error {
+	if !dstCfg.RequireSignature && scheme(ch.srcURL) == scheme(ch.dstURL) {
+		err := dstStorage.Copy(ctx, ch.srcURL, ch.dstURL, acl)
+		if err == nil {
+			return act.transferProvenance(ctx, dstStorage, acl, ch)
+		}
+		if err == backend.ErrObjectNotFound {
+			return errors.WithMessagef(err, "chart file %s of repository %s", ch.fname, act.srcRepo)
+		}
+		log.Printf("[WARN] server-side copy of chart %s failed, downloading and uploading it instead: %s", ch.fname, err)
+	}
+
+	archive, err := srcStorage.FetchRaw(ctx, ch.srcURL)
+	if err != nil {
+		return errors.WithMessagef(err, "fetch chart %s", ch.fname)
+	}
+	digest, err := helmutil.Digest(bytes.NewReader(archive))
+	if err != nil {
+		return errors.WithMessage(err, "get chart hash")
+	}
+	if digest != ch.entry.Digest {
+		return fmt.Errorf("digest of chart file %s does not match the index of repository %s", ch.fname, act.srcRepo)
+	}
+
+	prov, err := srcStorage.FetchRaw(ctx, ch.srcURL+provenanceSuffix)
+	if err != nil && err != backend.ErrObjectNotFound {
+		return errors.WithMessagef(err, "fetch provenance file of chart %s", ch.fname)
+	}
+
+	if dstCfg.RequireSignature {
+		if prov == nil {
+			return errors.WithMessagef(ErrChartNotSigned, "repository %s accepts signed charts only, but %s", act.dstRepo, ch.fname)
+		}
+		if err := helmutil.VerifyChart(ch.fname, archive, prov, act.keyring); err != nil {
+			return errors.WithMessagef(err, "verify chart %s", ch.fname)
+		}
+	}
+
+	chartMetaJSON, err := ch.meta.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	_, err = dstStorage.PutChart(ctx, ch.dstURL, bytes.NewReader(archive), string(chartMetaJSON), acl, digest, dstCfg.contentType(""))
+	if err != nil {
+		return errors.WithMessagef(err, "upload chart %s", ch.fname)
+	}
+
+	if prov == nil {
+		return deleteStaleProvenance(ctx, dstStorage, ch.dstURL)
+	}
+	err = dstStorage.PutRaw(ctx, ch.dstURL+provenanceSuffix, bytes.NewReader(prov), acl, provenanceContentType)
+	return errors.WithMessagef(err, "upload provenance file of chart %s", ch.fname)
+}
+
+// transferProvenance copies the provenance file of the chart on the server
+// side, if the chart has any.
+func (act copyAction) transferProvenance(ctx context.Context, dstStorage backend.Storage, acl string, ch copiedChart) error {
+	err := dstStorage.Copy(ctx, ch.srcURL+provenanceSuffix, ch.dstURL+provenanceSuffix, acl)
+	if err == backend.ErrObjectNotFound {
+		return deleteStaleProvenance(ctx, dstStorage, ch.dstURL)
+	}
+	return errors.WithMessagef(err, "copy provenance file of chart %s", ch.fname)
+}
+
+// scheme returns the scheme of the URI.
+func scheme(uri string) string {
+	if i := strings.Index(uri, "://"); i >= 0 {
+		return uri[:i]
+	}
+	return ""
+}
@@ -0,0 +1,215 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+	"github.com/banzaicloud/helm-s3/internal/s3test"
+)
+
+func TestCopyAction(t *testing.T) {
+	const dstRepoName = "prod-charts"
+
+	testCases := map[string]struct {
+		push        pushAction
+		pushToDst   bool
+		dstConfig   map[string]string
+		act         copyAction
+		failure     *s3test.Failure
+		expectProv  bool
+		expectMoved bool
+		expectCause error
+		expectError bool
+	}{
+		"copy": {
+			push: pushAction{},
+		},
+		"copy signed chart": {
+			push:       pushAction{prov: testProvPath(t)},
+			expectProv: true,
+		},
+		"move": {
+			push:        pushAction{prov: testProvPath(t)},
+			act:         copyAction{move: true},
+			expectProv:  true,
+			expectMoved: true,
+		},
+		"chart indexed with relative url": {
+			push: pushAction{relative: boolPtr(true)},
+		},
+		"server-side copy denied": {
+			push:       pushAction{prov: testProvPath(t)},
+			failure:    &s3test.Failure{Op: "CopyObject", StatusCode: http.StatusForbidden, Code: "AccessDenied"},
+			expectProv: true,
+		},
+		"chart exists": {
+			push:        pushAction{},
+			pushToDst:   true,
+			expectCause: ErrChartExists,
+		},
+		"replace existing chart": {
+			push:      pushAction{},
+			pushToDst: true,
+			act:       copyAction{force: true},
+		},
+		"missing version": {
+			push:        pushAction{},
+			act:         copyAction{version: "9.9.9"},
+			expectError: true,
+		},
+		"destination requires signature": {
+			push:        pushAction{},
+			dstConfig:   map[string]string{"requireSignature": "true"},
+			expectCause: ErrChartNotSigned,
+		},
+		"destination verifies signature": {
+			push:       pushAction{sign: true, key: testKeyName, keyring: testKeyring},
+			dstConfig:  map[string]string{"requireSignature": "true"},
+			act:        copyAction{keyring: testPublicKeyring},
+			expectProv: true,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				src := setup(t)
+				dst := src.addRepo(t, dstRepoName)
+
+				tc.push.chartPaths = []string{testChartPath}
+				tc.push.repoName = testRepoName
+				require.NoError(t, tc.push.Run(context.Background()))
+
+				if tc.pushToDst {
+					push := pushAction{chartPaths: []string{testChartPath}, repoName: dstRepoName}
+					require.NoError(t, push.Run(context.Background()))
+				}
+				for key, value := range tc.dstConfig {
+					set := configSetAction{repoName: dstRepoName, key: key, value: value}
+					require.NoError(t, set.Run(context.Background()))
+				}
+				if tc.failure != nil {
+					if src.server == nil {
+						t.Skip("server-side copy is not denied on the file system")
+					}
+					src.server.InjectFailure(*tc.failure)
+				}
+
+				tc.act.name = testChartName
+				if tc.act.version == "" {
+					tc.act.version = testChartVersion
+				}
+				tc.act.srcRepo = testRepoName
+				tc.act.dstRepo = dstRepoName
+				tc.act.lockTTL = time.Minute
+				err := tc.act.Run(context.Background())
+				switch {
+				case tc.expectCause != nil:
+					require.Equal(t, tc.expectCause, errors.Cause(err))
+					return
+				case tc.expectError:
+					require.Error(t, err)
+					return
+				default:
+					require.NoError(t, err)
+				}
+
+				require.True(t, dst.hasFile(t, "foo-1.2.3.tgz"))
+				require.Equal(t, tc.expectProv, dst.hasFile(t, "foo-1.2.3.tgz.prov"))
+				chart, err := os.ReadFile(testChartPath)
+				require.NoError(t, err)
+				require.Equal(t, chart, dst.file(t, "foo-1.2.3.tgz"))
+
+				digest, err := helmutil.DigestFile(testChartPath)
+				require.NoError(t, err)
+				dstEntry := indexEntry(t, dst.index(t), testChartName, testChartVersion)
+				require.Equal(t, digest, dstEntry.Digest)
+				require.Equal(t, dst.uri+"/foo-1.2.3.tgz", dstEntry.URLs[0])
+
+				if dst.server != nil {
+					obj, ok := dst.server.Object(dstRepoName, "charts/foo-1.2.3.tgz")
+					require.True(t, ok)
+					require.Equal(t, digest, obj.Metadata["Chart-Digest"])
+					require.NotEmpty(t, obj.Metadata["Chart-Metadata"])
+				}
+
+				// Only moving removes the chart from the source repository.
+				require.Equal(t, !tc.expectMoved, src.index(t).Has(testChartName, testChartVersion))
+				require.Equal(t, !tc.expectMoved, src.hasFile(t, "foo-1.2.3.tgz"))
+				require.Equal(t, tc.expectProv && !tc.expectMoved, src.hasFile(t, "foo-1.2.3.tgz.prov"))
+			})
+		}
+	}
+}
+
+func TestCopyAction_OppositeMoves(t *testing.T) {
+	const otherRepoName = "prod-charts"
+
+	for backendName, setup := range testBackends {
+		setup := setup
+		t.Run(backendName, func(t *testing.T) {
+			repo := setup(t)
+			other := repo.addRepo(t, otherRepoName)
+
+			push := pushAction{chartPaths: []string{testChartPath}, repoName: testRepoName}
+			require.NoError(t, push.Run(context.Background()))
+			push = pushAction{chartPaths: []string{writeTestChart(t, t.TempDir(), "bar", "1.0.0")}, repoName: otherRepoName}
+			require.NoError(t, push.Run(context.Background()))
+
+			// Both moves lock both repositories, in the same order, so they
+			// cannot wait for each other until they time out.
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			moves := []copyAction{
+				{name: testChartName, version: testChartVersion, srcRepo: testRepoName, dstRepo: otherRepoName, move: true, lockTTL: time.Minute},
+				{name: "bar", version: "1.0.0", srcRepo: otherRepoName, dstRepo: testRepoName, move: true, lockTTL: time.Minute},
+			}
+			errs := make(chan error, len(moves))
+			for _, act := range moves {
+				act := act
+				go func() { errs <- act.Run(ctx) }()
+			}
+			for range moves {
+				require.NoError(t, <-errs)
+			}
+
+			require.True(t, other.index(t).Has(testChartName, testChartVersion))
+			require.True(t, repo.index(t).Has("bar", "1.0.0"))
+		})
+	}
+}
+
+// indexEntry returns the index entry of the chart version.
+func indexEntry(t *testing.T, idx helmutil.Index, name, version string) helmutil.IndexEntry {
+	t.Helper()
+
+	for _, entry := range idx.Entries() {
+		if entry.Name == name && entry.Version == version {
+			return entry
+		}
+	}
+	require.Failf(t, "chart not found in index", "%s %s", name, version)
+	return helmutil.IndexEntry{}
+}
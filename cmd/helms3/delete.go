@@ -15,64 +15,150 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/pkg/errors"
 
-	"github.com/banzaicloud/helm-s3/internal/awss3"
-	"github.com/banzaicloud/helm-s3/internal/awsutil"
+	"github.com/banzaicloud/helm-s3/internal/backend"
 	"github.com/banzaicloud/helm-s3/internal/helmutil"
 )
 
+// ErrDeleteAborted signals that the deletion was not confirmed.
+var ErrDeleteAborted = errors.New("delete aborted")
+
 type deleteAction struct {
 	name, version, repoName, acl string
+	lockTTL                      time.Duration
+
+	// allVersions makes delete remove every version of the chart.
+	allVersions bool
+
+	// yes skips the confirmation of deleting multiple versions.
+	yes bool
+
+	// soft makes delete move the chart files to the trash instead of
+	// deleting them for good. It defaults to the repository config if not
+	// set.
+	soft *bool
+
+	// in is where the confirmation is read from, os.Stdin if nil.
+	in io.Reader
 }
 
 func (act deleteAction) Run(ctx context.Context) error {
+	if act.allVersions == (act.version != "") {
+		return errors.New("exactly one of --version and --all-versions is required")
+	}
+
 	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
 	if err != nil {
 		return err
 	}
 
-	sess, err := awsutil.Session(awsutil.DynamicBucketRegion(repoEntry.URL()))
+	storage, err := backend.New(repoEntry.URL())
 	if err != nil {
 		return err
 	}
-	storage := awss3.New(sess)
 
-	// Fetch current index.
-	b, err := storage.FetchRaw(ctx, repoEntry.IndexURL())
+	cfg, err := loadRepoConfig(ctx, storage, repoEntry.URL())
 	if err != nil {
-		return errors.WithMessage(err, "fetch current repo index")
+		return err
 	}
+	act.acl = cfg.acl(act.acl)
 
-	idx := helmutil.NewIndex()
-	if err := idx.UnmarshalBinary(b); err != nil {
-		return errors.WithMessage(err, "load index from downloaded file")
-	}
+	// A single exact version is deleted right away, like it always was.
+	// Versions matching a range are looked up and confirmed before the
+	// repository is locked, so that the lock is not held while prompting.
+	exact := !act.allVersions && isExactVersion(act.version)
+	versions := []string{act.version}
+	if !exact {
+		idx, _, err := fetchIndex(ctx, storage, repoEntry)
+		if err != nil {
+			return err
+		}
 
-	// Update index.
+		versions, err = act.matchVersions(idx.Entries())
+		if err != nil {
+			return err
+		}
 
-	url, err := idx.Delete(act.name, act.version)
+		if !act.yes {
+			if err := act.confirm(versions); err != nil {
+				return err
+			}
+		}
+	}
+
+	unlock, err := lockRepo(ctx, storage, repoEntry.URL(), act.lockTTL)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	idxReader, err := idx.Reader()
+	idx, _, err := fetchIndex(ctx, storage, repoEntry)
+	if err != nil {
+		return err
+	}
+	tombstones, err := act.tombstones(idx, repoEntry, versions, exact)
 	if err != nil {
-		return errors.Wrap(err, "get index reader")
+		return err
+	}
+
+	// Soft deleted files are copied to the trash before the versions are
+	// removed from the index, so that a failure never leaves a version
+	// neither in the index nor restorable from the trash. The tombstones are
+	// only recorded once the versions are out of the index.
+
+	soft := cfg.softDelete(act.soft)
+	var copies []string
+	if soft {
+		copies, err = copyToTrash(ctx, storage, repoEntry.URL(), act.acl, tombstones)
+		if err != nil {
+			discardTrashCopies(ctx, storage, copies)
+			return err
+		}
 	}
 
-	// Delete the file from S3 and replace index file.
+	// Update index.
+
+	idx, err = updateIndex(ctx, storage, repoEntry, act.acl, func(idx helmutil.Index) error {
+		for _, ts := range tombstones {
+			if !idx.Has(ts.Name, ts.Version) {
+				continue
+			}
+			if _, err := idx.Delete(ts.Name, ts.Version); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		discardTrashCopies(ctx, storage, copies)
+		return err
+	}
 
-	if url != "" {
-		if err := storage.Delete(ctx, url); err != nil {
-			return errors.WithMessage(err, "delete chart file from s3")
+	if soft {
+		if err := recordTombstones(ctx, storage, repoEntry.URL(), act.acl, tombstones); err != nil {
+			return err
 		}
 	}
 
-	if err := storage.PutIndex(ctx, repoEntry.URL(), act.acl, idxReader); err != nil {
-		return errors.WithMessage(err, "upload new index to s3")
+	// Delete the files from S3 once they are no longer referenced by the
+	// index, along with their provenance files if there are any.
+
+	var uris []string
+	for _, ts := range tombstones {
+		uris = append(uris, ts.Files...)
+	}
+	if err := storage.DeleteBatch(ctx, uris); err != nil {
+		return errors.WithMessage(err, "delete chart files from s3")
 	}
 
 	if err := idx.WriteFile(repoEntry.CacheFile(), 0644); err != nil {
@@ -81,3 +167,106 @@ func (act deleteAction) Run(ctx context.Context) error {
 
 	return nil
 }
+
+// tombstones returns the tombstones of the chart versions to delete from the
+// index. Versions matched beforehand which have been deleted since are
+// skipped, while an exact version must be in the index.
+func (act deleteAction) tombstones(idx helmutil.Index, repoEntry helmutil.RepoEntry, versions []string, exact bool) ([]tombstone, error) {
+	var tombstones []tombstone
+	for _, version := range versions {
+		if !idx.Has(act.name, version) {
+			if exact {
+				return nil, fmt.Errorf("chart %s version %s not found in index", act.name, version)
+			}
+			continue
+		}
+
+		// The entry is kept in the tombstone so that the version can be
+		// restored from the trash as it was.
+		entry, err := idx.MarshalEntry(act.name, version)
+		if err != nil {
+			return nil, err
+		}
+		ts := tombstone{Name: act.name, Version: version, Deleted: time.Now().UTC(), Entry: entry}
+
+		url, err := idx.Delete(act.name, version)
+		if err != nil {
+			return nil, err
+		}
+		if url != "" {
+			url = resolveChartURL(repoEntry, url)
+			ts.Files = []string{url, url + provenanceSuffix}
+		}
+		tombstones = append(tombstones, ts)
+	}
+	return tombstones, nil
+}
+
+// matchVersions returns the versions of the chart matching the version range,
+// or all of them.
+func (act deleteAction) matchVersions(entries []helmutil.IndexEntry) ([]string, error) {
+	var constraint *semver.Constraints
+	if !act.allVersions {
+		var err error
+		constraint, err = semver.NewConstraint(act.version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse version constraint %q", act.version)
+		}
+	}
+
+	var versions []string
+	for _, entry := range entries {
+		if entry.Name != act.name {
+			continue
+		}
+		if constraint != nil {
+			v, err := semver.NewVersion(entry.Version)
+			if err != nil || !constraint.Check(v) {
+				continue
+			}
+		}
+		versions = append(versions, entry.Version)
+	}
+
+	if len(versions) == 0 {
+		if act.allVersions {
+			return nil, fmt.Errorf("chart %s not found in index", act.name)
+		}
+		return nil, fmt.Errorf("no version of chart %s matching %q found in index", act.name, act.version)
+	}
+
+	return versions, nil
+}
+
+// confirm asks for the confirmation of deleting the versions of the chart.
+func (act deleteAction) confirm(versions []string) error {
+	in := act.in
+	if in == nil {
+		in = os.Stdin
+	}
+
+	fmt.Printf("The following versions of chart %s will be deleted from repository %s:\n", act.name, act.repoName)
+	for _, version := range versions {
+		fmt.Printf("  %s\n", version)
+	}
+	fmt.Printf("Delete %d versions? [y/N]: ", len(versions))
+
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "read confirmation")
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	default:
+		return errors.WithMessage(ErrDeleteAborted, "use --yes to delete without confirmation")
+	}
+}
+
+// isExactVersion returns true if the version is a single version, like 1.2.3,
+// 1.2 or v1.2.3, rather than a version range.
+func isExactVersion(version string) bool {
+	_, err := semver.NewVersion(version)
+	return err == nil
+}
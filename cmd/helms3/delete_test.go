@@ -0,0 +1,174 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteAction(t *testing.T) {
+	testCases := map[string]struct {
+		push pushAction
+	}{
+		"chart": {
+			push: pushAction{},
+		},
+		"signed chart": {
+			push: pushAction{prov: testProvPath(t)},
+		},
+		"chart indexed with relative url": {
+			push: pushAction{relative: boolPtr(true)},
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+
+				tc.push.chartPaths = []string{testChartPath}
+				tc.push.repoName = testRepoName
+				require.NoError(t, tc.push.Run(context.Background()))
+
+				act := deleteAction{
+					name:     testChartName,
+					version:  testChartVersion,
+					repoName: testRepoName,
+					lockTTL:  time.Minute,
+				}
+				require.NoError(t, act.Run(context.Background()))
+
+				require.False(t, repo.hasFile(t, "foo-1.2.3.tgz"))
+				require.False(t, repo.hasFile(t, "foo-1.2.3.tgz.prov"))
+				require.False(t, repo.hasFile(t, ".helm-s3.lock"))
+				require.False(t, repo.index(t).Has(testChartName, testChartVersion))
+
+				// The chart is gone, so deleting it again fails.
+				require.Error(t, act.Run(context.Background()))
+			})
+		}
+	}
+}
+
+func TestDeleteAction_Versions(t *testing.T) {
+	versions := []string{"1.2.0-rc.1", "1.2.0", "1.2.1", "1.3.0", "1.4"}
+
+	testCases := map[string]struct {
+		act           deleteAction
+		answer        string
+		expectDeleted []string
+		expectCause   error
+		expectError   bool
+	}{
+		"range": {
+			act:           deleteAction{version: ">=1.2.0-0 <1.3.0-0", yes: true},
+			expectDeleted: []string{"1.2.0-rc.1", "1.2.0", "1.2.1"},
+		},
+		"range excluding prereleases": {
+			// Like in Helm, every bound must allow prereleases to match them.
+			act:           deleteAction{version: ">=1.2.0-0 <1.3.0", yes: true},
+			expectDeleted: []string{"1.2.0", "1.2.1"},
+		},
+		"range confirmed": {
+			act:           deleteAction{version: "~1.2.0"},
+			answer:        "y\n",
+			expectDeleted: []string{"1.2.0", "1.2.1"},
+		},
+		"range declined": {
+			act:         deleteAction{version: "~1.2.0"},
+			answer:      "n\n",
+			expectCause: ErrDeleteAborted,
+		},
+		"range without answer": {
+			act:         deleteAction{version: "~1.2.0"},
+			expectCause: ErrDeleteAborted,
+		},
+		"all versions": {
+			act:           deleteAction{allVersions: true, yes: true},
+			expectDeleted: versions,
+		},
+		"exact version without confirmation": {
+			act:           deleteAction{version: "1.2.1"},
+			expectDeleted: []string{"1.2.1"},
+		},
+		"short exact version without confirmation": {
+			act:           deleteAction{version: "1.4"},
+			expectDeleted: []string{"1.4"},
+		},
+		"no matching version": {
+			act:         deleteAction{version: ">=2.0.0", yes: true},
+			expectError: true,
+		},
+		"version and all versions": {
+			act:         deleteAction{version: "1.2.1", allVersions: true, yes: true},
+			expectError: true,
+		},
+		"invalid range": {
+			act:         deleteAction{version: "not a range", yes: true},
+			expectError: true,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+
+				dir := t.TempDir()
+				push := pushAction{repoName: testRepoName, lockTTL: time.Minute}
+				for _, version := range versions {
+					push.chartPaths = append(push.chartPaths, writeTestChart(t, dir, "bar", version))
+				}
+				require.NoError(t, push.Run(context.Background()))
+
+				tc.act.name = "bar"
+				tc.act.repoName = testRepoName
+				tc.act.lockTTL = time.Minute
+				tc.act.in = strings.NewReader(tc.answer)
+				err := tc.act.Run(context.Background())
+				switch {
+				case tc.expectCause != nil:
+					require.Equal(t, tc.expectCause, errors.Cause(err))
+				case tc.expectError:
+					require.Error(t, err)
+				default:
+					require.NoError(t, err)
+				}
+
+				deleted := make(map[string]bool)
+				for _, version := range tc.expectDeleted {
+					deleted[version] = true
+				}
+				idx := repo.index(t)
+				for _, version := range versions {
+					require.Equal(t, !deleted[version], idx.Has("bar", version), version)
+					require.Equal(t, !deleted[version], repo.hasFile(t, "bar-"+version+".tgz"), version)
+				}
+
+				if repo.server != nil && len(tc.expectDeleted) > 0 {
+					require.Equal(t, 1, repo.server.Calls("DeleteObjects"))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+// ErrVersioningUnsupported signals that the storage of the repository does not
+// keep the previous versions of the index.
+var ErrVersioningUnsupported = errors.New("storage does not keep previous versions of the index")
+
+// nullVersionID is the version ID S3 reports for objects in buckets without
+// versioning.
+const nullVersionID = "null"
+
+type historyAction struct {
+	repoName string
+
+	// limit is the maximum number of index versions to show. Zero shows
+	// all of them.
+	limit int
+}
+
+func (act historyAction) Run(ctx context.Context) error {
+	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
+	if err != nil {
+		return err
+	}
+
+	storage, err := backend.New(repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	versioner, err := indexVersioner(storage)
+	if err != nil {
+		return err
+	}
+
+	versions, err := versioner.Versions(ctx, repoEntry.IndexURL())
+	if err != nil {
+		return errors.WithMessage(err, "list index versions")
+	}
+	if len(versions) == 1 && versions[0].ID == nullVersionID {
+		log.Printf("[WARN] versioning is not enabled on the bucket of repository %s, so previous versions of the index are not kept", act.repoName)
+	}
+
+	shown := versions
+	if act.limit > 0 && len(shown) > act.limit {
+		shown = shown[:act.limit]
+	}
+
+	// Every version is compared to the one before it, so one more version
+	// than shown is needed.
+	indexes := make([]helmutil.Index, 0, len(shown)+1)
+	for i := 0; i < len(versions) && i <= len(shown); i++ {
+		idx, _, err := fetchIndexVersion(ctx, versioner, repoEntry, versions[i].ID)
+		if err != nil {
+			return err
+		}
+		indexes = append(indexes, idx)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tMODIFIED\tCHARTS\tCHANGES")
+	for i, v := range shown {
+		id := v.ID
+		if v.Latest {
+			id += " (current)"
+		}
+
+		changes := "initial version"
+		if i+1 < len(indexes) {
+			changes = strings.Join(indexChanges(indexes[i+1], indexes[i]), ", ")
+			if changes == "" {
+				changes = "no changes"
+			}
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", id, v.Modified.Format(time.RFC3339), len(indexes[i].Entries()), changes)
+	}
+	return tw.Flush()
+}
+
+type rollbackAction struct {
+	repoName string
+	acl      string
+	lockTTL  time.Duration
+
+	// to is the version ID of the index to roll back to, or a timestamp in
+	// the RFC 3339 format to roll back to the version current at that time.
+	to string
+}
+
+func (act rollbackAction) Run(ctx context.Context) error {
+	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
+	if err != nil {
+		return err
+	}
+
+	storage, err := backend.New(repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	versioner, err := indexVersioner(storage)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadRepoConfig(ctx, storage, repoEntry.URL())
+	if err != nil {
+		return err
+	}
+	act.acl = cfg.acl(act.acl)
+
+	unlock, err := lockRepo(ctx, storage, repoEntry.URL(), act.lockTTL)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	versions, err := versioner.Versions(ctx, repoEntry.IndexURL())
+	if err != nil {
+		return errors.WithMessage(err, "list index versions")
+	}
+
+	version, err := selectIndexVersion(versions, act.to)
+	if err != nil {
+		return err
+	}
+	if version.Latest {
+		fmt.Printf("Version %s is the current index of repository %s already.\n", version.ID, act.repoName)
+		return nil
+	}
+
+	idx, b, err := fetchIndexVersion(ctx, versioner, repoEntry, version.ID)
+	if err != nil {
+		return err
+	}
+
+	current, etag, err := fetchIndex(ctx, storage, repoEntry)
+	if err != nil {
+		return err
+	}
+
+	// The previous version is put as is, becoming the newest version, so
+	// the rollback itself can be rolled back too.
+	err = storage.PutIndexIfMatch(ctx, repoEntry.URL(), act.acl, etag, bytes.NewReader(b))
+	if err != nil {
+		return errors.WithMessage(err, "upload index")
+	}
+
+	if err := idx.WriteFile(repoEntry.CacheFile(), 0644); err != nil {
+		return errors.WithMessage(err, "update local index")
+	}
+
+	// Rolling back the index does not bring back deleted chart files.
+	for _, entry := range idx.Entries() {
+		if current.Has(entry.Name, entry.Version) || len(entry.URLs) == 0 {
+			continue
+		}
+		exists, err := storage.Exists(ctx, resolveChartURL(repoEntry, entry.URLs[0]))
+		if err != nil {
+			return errors.WithMessagef(err, "check chart %s %s", entry.Name, entry.Version)
+		}
+		if !exists {
+			log.Printf("[WARN] chart %s %s is in the index again, but its chart file has been deleted", entry.Name, entry.Version)
+		}
+	}
+
+	fmt.Printf("Rolled back the index of repository %s to version %s from %s.\n", act.repoName, version.ID, version.Modified.Format(time.RFC3339))
+	return nil
+}
+
+// indexVersioner returns the storage as backend.Versioner or
+// ErrVersioningUnsupported if it does not keep object versions.
+func indexVersioner(storage backend.Storage) (backend.Versioner, error) {
+	versioner, ok := storage.(backend.Versioner)
+	if !ok {
+		return nil, ErrVersioningUnsupported
+	}
+	return versioner, nil
+}
+
+// fetchIndexVersion downloads and loads the version of the repository index.
+// It returns the index along with its raw form.
+func fetchIndexVersion(
+	ctx context.Context,
+	versioner backend.Versioner,
+	repoEntry helmutil.RepoEntry,
+	versionID string,
+) (helmutil.Index, []byte, error) {
+	b, err := versioner.FetchVersion(ctx, repoEntry.IndexURL(), versionID)
+	if err != nil {
+		return nil, nil, errors.WithMessagef(err, "fetch index version %s", versionID)
+	}
+
+	idx := helmutil.NewIndex()
+	if err := idx.UnmarshalBinary(b); err != nil {
+		return nil, nil, errors.WithMessagef(err, "load index version %s", versionID)
+	}
+
+	return idx, b, nil
+}
+
+// selectIndexVersion returns the version with the ID or, if to is a timestamp,
+// the newest version not modified after it. Versions are the newest first.
+func selectIndexVersion(versions []backend.ObjectVersion, to string) (backend.ObjectVersion, error) {
+	for _, v := range versions {
+		if v.ID == to {
+			return v, nil
+		}
+	}
+
+	t, err := time.Parse(time.RFC3339, to)
+	if err != nil {
+		return backend.ObjectVersion{}, errors.Errorf("index version %q not found", to)
+	}
+	for _, v := range versions {
+		if !v.Modified.After(t) {
+			return v, nil
+		}
+	}
+	return backend.ObjectVersion{}, errors.Errorf("no index version as of %s", t.Format(time.RFC3339))
+}
+
+// indexChanges returns the chart versions added to, removed from or changed in
+// the index since its previous version, in the form of "+name version",
+// "-name version" and "~name version" respectively.
+func indexChanges(prev, cur helmutil.Index) []string {
+	digests := make(map[string]string)
+	for _, entry := range prev.Entries() {
+		digests[entry.Name+" "+entry.Version] = entry.Digest
+	}
+
+	var changes []string
+	for _, entry := range cur.Entries() {
+		key := entry.Name + " " + entry.Version
+		digest, ok := digests[key]
+		switch {
+		case !ok:
+			changes = append(changes, "+"+key)
+		case digest != entry.Digest:
+			changes = append(changes, "~"+key)
+		}
+		delete(digests, key)
+	}
+	for _, entry := range prev.Entries() {
+		key := entry.Name + " " + entry.Version
+		if _, ok := digests[key]; ok {
+			changes = append(changes, "-"+key)
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,140 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+)
+
+func TestSelectIndexVersion(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	versions := []backend.ObjectVersion{
+		{ID: "c", Modified: now, Latest: true},
+		{ID: "b", Modified: now.Add(-time.Hour)},
+		{ID: "a", Modified: now.Add(-2 * time.Hour)},
+	}
+
+	testCases := map[string]struct {
+		to          string
+		expectID    string
+		expectError bool
+	}{
+		"version id": {
+			to:       "b",
+			expectID: "b",
+		},
+		"exact timestamp": {
+			to:       "2021-06-01T11:00:00Z",
+			expectID: "b",
+		},
+		"timestamp between versions": {
+			to:       "2021-06-01T11:30:00Z",
+			expectID: "b",
+		},
+		"timestamp in another zone": {
+			to:       "2021-06-01T12:30:00+02:00",
+			expectID: "a",
+		},
+		"timestamp after the latest version": {
+			to:       "2022-01-01T00:00:00Z",
+			expectID: "c",
+		},
+		"timestamp before the first version": {
+			to:          "2021-01-01T00:00:00Z",
+			expectError: true,
+		},
+		"unknown version id": {
+			to:          "d",
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			v, err := selectIndexVersion(versions, tc.to)
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectID, v.ID)
+		})
+	}
+}
+
+func TestRollbackAction(t *testing.T) {
+	for backendName, setup := range testBackends {
+		setup := setup
+		t.Run(backendName, func(t *testing.T) {
+			repo := setup(t)
+			if repo.server == nil {
+				err := rollbackAction{repoName: testRepoName, to: "v1"}.Run(context.Background())
+				require.Equal(t, ErrVersioningUnsupported, errors.Cause(err))
+				err = historyAction{repoName: testRepoName}.Run(context.Background())
+				require.Equal(t, ErrVersioningUnsupported, errors.Cause(err))
+				return
+			}
+			repo.server.EnableVersioning("test-bucket")
+
+			dir := t.TempDir()
+			for _, version := range []string{"1.0.0", "1.1.0"} {
+				push := pushAction{chartPaths: []string{writeTestChart(t, dir, "bar", version)}, repoName: testRepoName}
+				require.NoError(t, push.Run(context.Background()))
+			}
+
+			versions := repo.server.Versions("test-bucket", "charts/index.yaml")
+			require.Len(t, versions, 2)
+
+			act := rollbackAction{repoName: testRepoName, to: versions[0].VersionID, lockTTL: time.Minute}
+			require.NoError(t, act.Run(context.Background()))
+
+			idx := repo.index(t)
+			require.True(t, idx.Has("bar", "1.0.0"))
+			require.False(t, idx.Has("bar", "1.1.0"))
+
+			output := captureStdout(t, func() {
+				require.NoError(t, historyAction{repoName: testRepoName}.Run(context.Background()))
+			})
+			lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+			require.Len(t, lines, 4)
+			require.Contains(t, lines[1], " (current)")
+			require.Contains(t, lines[1], "-bar 1.1.0")
+			require.Contains(t, lines[2], "+bar 1.1.0")
+			require.Contains(t, lines[3], "initial version")
+
+			output = captureStdout(t, func() {
+				require.NoError(t, historyAction{repoName: testRepoName, limit: 1}.Run(context.Background()))
+			})
+			lines = strings.Split(strings.TrimSpace(string(output)), "\n")
+			require.Len(t, lines, 2)
+			require.Contains(t, lines[1], "-bar 1.1.0")
+
+			// Rolling back to the current version changes nothing.
+			current := repo.server.Versions("test-bucket", "charts/index.yaml")[2]
+			act.to = current.VersionID
+			require.NoError(t, act.Run(context.Background()))
+			require.Len(t, repo.server.Versions("test-bucket", "charts/index.yaml"), 3)
+		})
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+// indexUpdateAttempts is the maximum number of attempts to update the
+// repository index when it is being modified concurrently.
+const indexUpdateAttempts = 5
+
+// indexUpdateBackoff is the initial delay between index update attempts. It is
+// doubled after every failed attempt. Tests shorten it.
+var indexUpdateBackoff = 200 * time.Millisecond
+
+// fetchIndex downloads the repository index and returns it along with its
+// ETag.
+func fetchIndex(ctx context.Context, storage backend.Storage, repoEntry helmutil.RepoEntry) (helmutil.Index, string, error) {
+	b, etag, err := storage.FetchIndex(ctx, repoEntry.IndexURL())
+	if err != nil {
+		return nil, "", errors.WithMessage(err, "fetch current repo index")
+	}
+
+	idx := helmutil.NewIndex()
+	if err := idx.UnmarshalBinary(b); err != nil {
+		return nil, "", errors.WithMessage(err, "load index from downloaded file")
+	}
+
+	return idx, etag, nil
+}
+
+// updateIndex fetches the repository index, applies the mutation to it and
+// uploads it back, provided that nobody has modified the index in the
+// meantime. On conflict the whole fetch-mutate-upload cycle is retried with
+// exponential backoff, so the mutation must be safe to apply multiple times
+// to freshly fetched indexes.
+//
+// See https://github.com/hypnoglow/helm-s3/issues/18 for more info.
+func updateIndex(
+	ctx context.Context,
+	storage backend.Storage,
+	repoEntry helmutil.RepoEntry,
+	acl string,
+	mutate func(idx helmutil.Index) error,
+) (helmutil.Index, error) {
+	backoff := indexUpdateBackoff
+	for attempt := 1; ; attempt++ {
+		idx, etag, err := fetchIndex(ctx, storage, repoEntry)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := mutate(idx); err != nil {
+			return nil, err
+		}
+
+		idxReader, err := idx.Reader()
+		if err != nil {
+			return nil, errors.WithMessage(err, "get index reader")
+		}
+
+		err = storage.PutIndexIfMatch(ctx, repoEntry.URL(), acl, etag, idxReader)
+		if err == nil {
+			return idx, nil
+		}
+		if err != backend.ErrIndexModified {
+			return nil, errors.WithMessage(err, "upload index to s3")
+		}
+		if attempt == indexUpdateAttempts {
+			return nil, errors.Wrapf(err, "update index: gave up after %d attempts", attempt)
+		}
+
+		// Add jitter so that concurrent writers do not retry in lockstep.
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+		log.Printf("[WARN] the index was modified concurrently, retrying in %s", delay)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		backoff *= 2
+	}
+}
+
+// resolveChartURL returns the absolute URL of the chart given the URL from its
+// index entry, which is relative to the repository if the chart was indexed
+// with --relative.
+func resolveChartURL(repoEntry helmutil.RepoEntry, u string) string {
+	if strings.Contains(u, "://") {
+		return u
+	}
+	return repoEntry.URL() + "/" + u
+}
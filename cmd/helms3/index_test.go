@@ -0,0 +1,85 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+func TestUpdateIndex(t *testing.T) {
+	backoff := indexUpdateBackoff
+	indexUpdateBackoff = time.Millisecond
+	t.Cleanup(func() { indexUpdateBackoff = backoff })
+
+	testCases := map[string]struct {
+		// modifications is the number of attempts during which someone
+		// else modifies the index between the fetch and the upload.
+		modifications  int
+		expectAttempts int
+		expectCause    error
+	}{
+		"no conflict": {
+			modifications:  0,
+			expectAttempts: 1,
+		},
+		"conflict": {
+			modifications:  1,
+			expectAttempts: 2,
+		},
+		"gave up": {
+			modifications:  indexUpdateAttempts,
+			expectAttempts: indexUpdateAttempts,
+			expectCause:    backend.ErrIndexModified,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+				repoEntry, err := helmutil.LookupRepoEntry(testRepoName)
+				require.NoError(t, err)
+				storage, err := backend.New(repoEntry.URL())
+				require.NoError(t, err)
+
+				attempts := 0
+				_, err = updateIndex(context.Background(), storage, repoEntry, "", func(idx helmutil.Index) error {
+					attempts++
+					if attempts <= tc.modifications {
+						b := repo.file(t, "index.yaml")
+						repo.putFile(t, "index.yaml", append(b, fmt.Sprintf("# modified %d\n", attempts)...))
+					}
+					return nil
+				})
+				require.Equal(t, tc.expectAttempts, attempts)
+				if tc.expectCause != nil {
+					require.Equal(t, tc.expectCause, errors.Cause(err))
+					return
+				}
+				require.NoError(t, err)
+			})
+		}
+	}
+}
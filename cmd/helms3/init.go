@@ -16,17 +16,20 @@ package main
 
 import (
 	"context"
+	"log"
 
 	"github.com/pkg/errors"
 
-	"github.com/banzaicloud/helm-s3/internal/awss3"
-	"github.com/banzaicloud/helm-s3/internal/awsutil"
+	"github.com/banzaicloud/helm-s3/internal/backend"
 	"github.com/banzaicloud/helm-s3/internal/helmutil"
 )
 
 type initAction struct {
 	uri string
 	acl string
+
+	// cfg is the repository config written next to the index.
+	cfg repoConfig
 }
 
 func (act initAction) Run(ctx context.Context) error {
@@ -35,16 +38,40 @@ func (act initAction) Run(ctx context.Context) error {
 		return errors.WithMessage(err, "get index reader")
 	}
 
-	sess, err := awsutil.Session(awsutil.DynamicBucketRegion(act.uri))
+	storage, err := backend.New(act.uri)
 	if err != nil {
 		return err
 	}
-	storage := awss3.New(sess)
+
+	// Initializing the repository again must not reset the config everyone
+	// working with the repository shares.
+	cfgExists, err := storage.Exists(ctx, act.uri+"/"+repoConfigFilename)
+	if err != nil {
+		return errors.WithMessage(err, "check repository config")
+	}
+	if cfgExists {
+		cfg, err := fetchRepoConfig(ctx, storage, act.uri)
+		if err != nil {
+			return err
+		}
+		if act.cfg != (repoConfig{}) {
+			log.Printf("[WARN] the repository has a config already, use `helm s3 config set` to change it")
+		}
+		act.cfg = cfg
+	}
+
+	act.cfg.applyEncryption(storage)
 
 	if err := storage.PutIndex(ctx, act.uri, act.acl, r); err != nil {
 		return errors.WithMessage(err, "upload index to s3")
 	}
 
+	if !cfgExists {
+		if err := putRepoConfig(ctx, storage, act.uri, act.acl, act.cfg); err != nil {
+			return err
+		}
+	}
+
 	// TODO:
 	// do we need to automatically do `helm repo add <name> <uri>`,
 	// like we are doing `helm repo update` when we push a chart
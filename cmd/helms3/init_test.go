@@ -0,0 +1,118 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+
+	"github.com/banzaicloud/helm-s3/internal/s3test"
+)
+
+func TestInitAction(t *testing.T) {
+	testCases := map[string]struct {
+		uri         string
+		expectError bool
+	}{
+		"existing bucket": {
+			uri:         "s3://test-bucket/charts",
+			expectError: false,
+		},
+		"bucket root": {
+			uri:         "s3://test-bucket",
+			expectError: false,
+		},
+		"missing bucket": {
+			uri:         "s3://missing-bucket/charts",
+			expectError: true,
+		},
+		"unsupported scheme": {
+			uri:         "gs://test-bucket/charts",
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			server := s3test.NewServer()
+			t.Cleanup(server.Close)
+			server.Setenv(t)
+			server.CreateBucket("test-bucket")
+
+			err := initAction{uri: tc.uri}.Run(context.Background())
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			repo := testRepo{uri: tc.uri, server: server}
+			require.False(t, repo.index(t).Has(testChartName, testChartVersion))
+		})
+	}
+}
+
+func TestInitAction_Config(t *testing.T) {
+	server := s3test.NewServer()
+	t.Cleanup(server.Close)
+	server.Setenv(t)
+	server.CreateBucket("test-bucket")
+
+	cfg := repoConfig{
+		ACL:                  "private",
+		ServerSideEncryption: sseAES256,
+		Relative:             true,
+		RequireSignature:     true,
+	}
+	err := initAction{uri: "s3://test-bucket/charts", acl: "private", cfg: cfg}.Run(context.Background())
+	require.NoError(t, err)
+
+	obj, ok := server.Object("test-bucket", "charts/"+repoConfigFilename)
+	require.True(t, ok)
+	require.Equal(t, sseAES256, obj.ServerSideEncryption)
+
+	var written repoConfig
+	require.NoError(t, yaml.Unmarshal(obj.Body, &written))
+	require.Equal(t, cfg, written)
+
+	// The index is encrypted as configured too.
+	obj, ok = server.Object("test-bucket", "charts/index.yaml")
+	require.True(t, ok)
+	require.Equal(t, sseAES256, obj.ServerSideEncryption)
+}
+
+func TestInitAction_ExistingConfig(t *testing.T) {
+	for backendName, setup := range testBackends {
+		setup := setup
+		t.Run(backendName, func(t *testing.T) {
+			repo := setup(t)
+
+			set := configSetAction{repoName: testRepoName, key: "requireSignature", value: "true"}
+			require.NoError(t, set.Run(context.Background()))
+
+			// Initializing the repository again keeps its config.
+			err := initAction{uri: repo.uri, cfg: repoConfig{Relative: true}}.Run(context.Background())
+			require.NoError(t, err)
+
+			var cfg repoConfig
+			require.NoError(t, yaml.Unmarshal(repo.file(t, repoConfigFilename), &cfg))
+			require.Equal(t, repoConfig{RequireSignature: true}, cfg)
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+// Output formats of the list action.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+type listAction struct {
+	repoName string
+
+	// Optional parameters and flags.
+
+	chartName string
+	version   string
+	output    string
+}
+
+// listItem is a chart version printed by the list action.
+type listItem struct {
+	Name       string    `json:"name"`
+	Version    string    `json:"version"`
+	AppVersion string    `json:"appVersion"`
+	Created    time.Time `json:"created"`
+	Digest     string    `json:"digest"`
+	URL        string    `json:"url"`
+}
+
+func (act listAction) Run(ctx context.Context) error {
+	var constraint *semver.Constraints
+	if act.version != "" {
+		var err error
+		constraint, err = semver.NewConstraint(act.version)
+		if err != nil {
+			return errors.Wrapf(err, "parse version constraint %q", act.version)
+		}
+	}
+
+	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
+	if err != nil {
+		return err
+	}
+
+	storage, err := backend.New(repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	// Read the live index, because the local cache might be stale.
+	idx, _, err := fetchIndex(ctx, storage, repoEntry)
+	if err != nil {
+		return err
+	}
+
+	items := []listItem{}
+	for _, entry := range idx.Entries() {
+		if act.chartName != "" && entry.Name != act.chartName {
+			continue
+		}
+		if constraint != nil {
+			v, err := semver.NewVersion(entry.Version)
+			if err != nil || !constraint.Check(v) {
+				continue
+			}
+		}
+
+		item := listItem{
+			Name:       entry.Name,
+			Version:    entry.Version,
+			AppVersion: entry.AppVersion,
+			Created:    entry.Created,
+			Digest:     entry.Digest,
+		}
+		if len(entry.URLs) > 0 {
+			item.URL = entry.URLs[0]
+		}
+		items = append(items, item)
+	}
+
+	return printListItems(os.Stdout, items, act.output)
+}
+
+// printListItems prints the items to w in the output format.
+func printListItems(w io.Writer, items []listItem, output string) error {
+	switch output {
+	case outputJSON:
+		b, err := json.MarshalIndent(items, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "marshal charts to json")
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+
+	case outputYAML:
+		b, err := yaml.Marshal(items)
+		if err != nil {
+			return errors.Wrap(err, "marshal charts to yaml")
+		}
+		_, err = w.Write(b)
+		return err
+
+	case outputTable, "":
+		tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tVERSION\tAPP VERSION\tCREATED\tDIGEST\tURL")
+		for _, item := range items {
+			fmt.Fprintf(
+				tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				item.Name,
+				item.Version,
+				item.AppVersion,
+				item.Created.Format(time.RFC3339),
+				item.Digest,
+				item.URL,
+			)
+		}
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("unsupported output format %s", output)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+const listTestIndex = `apiVersion: v1
+entries:
+  bar:
+  - name: bar
+    version: 0.1.0
+    appVersion: "1.0"
+    created: "2021-06-01T10:00:00Z"
+    digest: bar010
+    urls:
+    - bar-0.1.0.tgz
+  foo:
+  - name: foo
+    version: 2.0.0
+    appVersion: "2.0"
+    created: "2021-06-03T10:00:00Z"
+    digest: foo200
+    urls:
+    - foo-2.0.0.tgz
+  - name: foo
+    version: 1.2.3
+    appVersion: "1.2"
+    created: "2021-06-02T10:00:00Z"
+    digest: foo123
+    urls:
+    - foo-1.2.3.tgz
+generated: "2021-06-03T10:00:00Z"
+`
+
+func TestListAction(t *testing.T) {
+	testCases := map[string]struct {
+		chartName      string
+		version        string
+		expectVersions []string
+		expectError    bool
+	}{
+		"all charts": {
+			expectVersions: []string{"bar-0.1.0", "foo-2.0.0", "foo-1.2.3"},
+		},
+		"chart name": {
+			chartName:      "foo",
+			expectVersions: []string{"foo-2.0.0", "foo-1.2.3"},
+		},
+		"version constraint": {
+			version:        "< 2.0.0",
+			expectVersions: []string{"bar-0.1.0", "foo-1.2.3"},
+		},
+		"chart name and version constraint": {
+			chartName:      "foo",
+			version:        "~2",
+			expectVersions: []string{"foo-2.0.0"},
+		},
+		"missing chart": {
+			chartName:      "baz",
+			expectVersions: []string{},
+		},
+		"invalid version constraint": {
+			version:     "not a version",
+			expectError: true,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+				repo.putFile(t, "index.yaml", []byte(listTestIndex))
+
+				act := listAction{
+					repoName:  testRepoName,
+					chartName: tc.chartName,
+					version:   tc.version,
+					output:    outputJSON,
+				}
+
+				var err error
+				output := captureStdout(t, func() {
+					err = act.Run(context.Background())
+				})
+				if tc.expectError {
+					require.Error(t, err)
+					require.Empty(t, output)
+					return
+				}
+				require.NoError(t, err)
+
+				var items []listItem
+				require.NoError(t, json.Unmarshal(output, &items))
+
+				versions := []string{}
+				for _, item := range items {
+					versions = append(versions, item.Name+"-"+item.Version)
+				}
+				require.Equal(t, tc.expectVersions, versions)
+			})
+		}
+	}
+}
+
+func TestListAction_Output(t *testing.T) {
+	testCases := map[string]struct {
+		output string
+		check  func(t *testing.T, output []byte)
+	}{
+		"table": {
+			output: outputTable,
+			check: func(t *testing.T, output []byte) {
+				lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+				require.Len(t, lines, 2)
+				require.Equal(t, []string{"NAME", "VERSION", "APP", "VERSION", "CREATED", "DIGEST", "URL"}, strings.Fields(lines[0]))
+				require.Equal(t, []string{"bar", "0.1.0", "1.0", "2021-06-01T10:00:00Z", "bar010", "bar-0.1.0.tgz"}, strings.Fields(lines[1]))
+			},
+		},
+		"json": {
+			output: outputJSON,
+			check: func(t *testing.T, output []byte) {
+				require.JSONEq(t, `[{
+					"name": "bar",
+					"version": "0.1.0",
+					"appVersion": "1.0",
+					"created": "2021-06-01T10:00:00Z",
+					"digest": "bar010",
+					"url": "bar-0.1.0.tgz"
+				}]`, string(output))
+			},
+		},
+		"yaml": {
+			output: outputYAML,
+			check: func(t *testing.T, output []byte) {
+				var items []listItem
+				require.NoError(t, yaml.Unmarshal(output, &items))
+				require.Len(t, items, 1)
+				require.Equal(t, "bar", items[0].Name)
+				require.Equal(t, "0.1.0", items[0].Version)
+				require.Equal(t, "bar-0.1.0.tgz", items[0].URL)
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			repo := setupLocalRepo(t)
+			repo.putFile(t, "index.yaml", []byte(listTestIndex))
+
+			act := listAction{
+				repoName:  testRepoName,
+				chartName: "bar",
+				output:    tc.output,
+			}
+
+			var err error
+			output := captureStdout(t, func() {
+				err = act.Run(context.Background())
+			})
+			require.NoError(t, err)
+			tc.check(t, output)
+		})
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+const (
+	// lockRetryInterval is the delay between attempts to acquire a lock held
+	// by someone else.
+	lockRetryInterval = 2 * time.Second
+
+	// lockReleaseTimeout is the timeout for releasing or renewing the lock.
+	// The release does not use the operation context, because the lock
+	// should be released even if the operation timed out.
+	lockReleaseTimeout = 10 * time.Second
+
+	// lockRenewals is the number of times the lock is renewed within its
+	// TTL, so that a failed renewal can be retried before the lock expires.
+	lockRenewals = 3
+)
+
+// lockRepo acquires the advisory lock on the repository, waiting for the
+// current holder to release it until ctx is done. The lock is renewed until
+// the returned function releasing it is called, so that it does not expire
+// during long operations. A zero ttl disables locking.
+func lockRepo(ctx context.Context, storage backend.Storage, repoURI string, ttl time.Duration) (unlock func(), err error) {
+	if ttl == 0 {
+		return func() {}, nil
+	}
+
+	for {
+		lock, err := storage.AcquireLock(ctx, repoURI, ttl)
+		if err == nil {
+			stop := renewLock(lock, ttl)
+			return func() {
+				stop()
+
+				ctx, cancel := context.WithTimeout(context.Background(), lockReleaseTimeout)
+				defer cancel()
+
+				if err := lock.Release(ctx); err != nil {
+					log.Printf("[ERROR] failed to release the repository lock: %s", err)
+				}
+			}, nil
+		}
+		if errors.Cause(err) != backend.ErrLocked {
+			return nil, errors.WithMessage(err, "acquire repository lock")
+		}
+
+		log.Printf("[INFO] waiting for the repository lock: %s", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.WithMessage(err, "acquire repository lock")
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// renewLock renews the lock in the background until the returned function is
+// called.
+func renewLock(lock backend.Lock, ttl time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(ttl / lockRenewals)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), lockReleaseTimeout)
+			err := lock.Renew(ctx, ttl)
+			cancel()
+			if errors.Cause(err) == backend.ErrLocked {
+				log.Printf("[ERROR] lost the repository lock: %s", err)
+				return
+			}
+			if err != nil {
+				log.Printf("[WARN] failed to renew the repository lock: %s", err)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+type lockStatusAction struct {
+	repoName string
+}
+
+func (act lockStatusAction) Run(ctx context.Context) error {
+	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
+	if err != nil {
+		return err
+	}
+
+	storage, err := backend.New(repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	info, err := storage.FetchLock(ctx, repoEntry.URL())
+	if err != nil {
+		return errors.WithMessage(err, "fetch repository lock")
+	}
+
+	if info == nil {
+		fmt.Printf("Repository %s is not locked.\n", act.repoName)
+		return nil
+	}
+
+	state := "held"
+	if info.Expired() {
+		state = "expired"
+	}
+	fmt.Printf(
+		"Repository %s is locked (%s).\nOwner: %s\nHostname: %s\nAcquired: %s\nExpires: %s\n",
+		act.repoName,
+		state,
+		info.Owner,
+		info.Hostname,
+		info.Acquired.Format(time.RFC3339),
+		info.Expires.Format(time.RFC3339),
+	)
+	return nil
+}
+
+type lockBreakAction struct {
+	repoName string
+}
+
+func (act lockBreakAction) Run(ctx context.Context) error {
+	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
+	if err != nil {
+		return err
+	}
+
+	storage, err := backend.New(repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	if err := storage.BreakLock(ctx, repoEntry.URL()); err != nil {
+		return errors.WithMessage(err, "break repository lock")
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+)
+
+func TestLockRepo_Renew(t *testing.T) {
+	for backendName, setup := range testBackends {
+		setup := setup
+		t.Run(backendName, func(t *testing.T) {
+			repo := setup(t)
+			storage, err := backend.New(repo.uri)
+			require.NoError(t, err)
+
+			const ttl = 300 * time.Millisecond
+			unlock, err := lockRepo(context.Background(), storage, repo.uri, ttl)
+			require.NoError(t, err)
+
+			// The lock outlives its TTL while the operation is running.
+			time.Sleep(3 * ttl)
+			info, err := storage.FetchLock(context.Background(), repo.uri)
+			require.NoError(t, err)
+			require.NotNil(t, info)
+			require.False(t, info.Expired())
+
+			_, err = storage.AcquireLock(context.Background(), repo.uri, ttl)
+			require.Error(t, err)
+
+			unlock()
+			info, err = storage.FetchLock(context.Background(), repo.uri)
+			require.NoError(t, err)
+			require.Nil(t, info)
+		})
+	}
+}
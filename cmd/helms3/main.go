@@ -19,21 +19,46 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/alecthomas/kingpin.v2"
 
 	"github.com/banzaicloud/helm-s3/internal/helmutil"
+
+	// Register the storage backends.
+	_ "github.com/banzaicloud/helm-s3/internal/awss3"
+	_ "github.com/banzaicloud/helm-s3/internal/localfs"
 )
 
 var version = "local"
 
 const (
-	actionVersion = "version"
-	actionInit    = "init"
-	actionPush    = "push"
-	actionReindex = "reindex"
-	actionDelete  = "delete"
+	actionVersion  = "version"
+	actionInit     = "init"
+	actionPush     = "push"
+	actionReindex  = "reindex"
+	actionDelete   = "delete"
+	actionLock     = "lock"
+	actionList     = "list"
+	actionVerify   = "verify"
+	actionConfig   = "config"
+	actionPrune    = "prune"
+	actionUndelete = "undelete"
+	actionTrash    = "trash"
+	actionHistory  = "history"
+	actionRollback = "rollback"
+	actionCopy     = "copy"
+	actionMirror   = "mirror"
+	actionSync     = "sync"
+	actionCache    = "cache"
+
+	// Aliases of the actions, recognized by isAction as well.
+	aliasDelete = "del"
+	aliasCopy   = "promote"
+	aliasList   = "ls"
 
 	defaultTimeout       = time.Minute * 5
 	defaultTimeoutString = "5m"
@@ -56,6 +81,13 @@ For more information on S3 ACLs please see https://docs.aws.amazon.com/AmazonS3/
 `
 	relativeFlag     = "relative"
 	helpRelativeFlag = "Index using relative URLs (useful when S3 buckets are replicated)"
+
+	helpFlagLock = `Hold an advisory lock on the repository while modifying it.
+
+The lock is stored as the .helm-s3.lock object in the repository and expires
+after the operation timeout, so that the lock left by a crashed process is
+eventually taken over. Use --no-lock to disable locking.
+`
 )
 
 // Action describes plugin action that can be run.
@@ -70,6 +102,11 @@ func main() {
 
 	if len(os.Args) == 5 && !isAction(os.Args[1]) {
 		cmd := proxyCmd{uri: os.Args[4]}
+		if c, err := openCache(); err != nil {
+			log.Printf("[WARN] download cache disabled: %s", err)
+		} else if c.MaxSize() > 0 {
+			cmd.cache = c
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
 		defer cancel()
 		if err := cmd.Run(ctx); err != nil {
@@ -92,53 +129,268 @@ func main() {
 		OverrideDefaultFromEnvar("S3_ACL").
 		String()
 
+	lock := cli.Flag("lock", helpFlagLock).
+		Default("true").
+		Bool()
+
 	initCmd := cli.Command(actionInit, "Initialize empty repository on AWS S3.")
-	initURI := initCmd.Arg("uri", "URI of repository, e.g. s3://awesome-bucket/charts").
+	initURI := initCmd.Arg("uri", "URI of repository, e.g. s3://awesome-bucket/charts or file:///srv/charts").
 		Required().
 		String()
+	initRelative := initCmd.Flag(relativeFlag, "Index the charts of the repository using relative URLs by default").
+		Bool()
+	initContentType := initCmd.Flag("content-type", "Default content-type of the charts pushed to the repository").
+		String()
+	initSSE := initCmd.Flag("sse", "Server-side encryption of the repository objects, either AES256 or aws:kms").
+		Enum(sseAES256, sseKMS)
+	initSSEKMSKeyID := initCmd.Flag("sse-kms-key-id", "KMS key to encrypt the repository objects with in the aws:kms mode").
+		String()
+	initRequireSignature := initCmd.Flag("require-signature", "Accept only signed charts to the repository").
+		Bool()
 
 	pushCmd := cli.Command(actionPush, "Push chart to the repository.")
-	pushChartPath := pushCmd.Arg("chartPath", "Path to a chart, e.g. ./epicservice-0.5.1.tgz").
+	// The target repository is the last argument, because kingpin does not
+	// allow arguments after the variadic one.
+	pushArgs := pushCmd.Arg("chartPath", "Paths to charts, chart directories, directories of charts or glob patterns followed by the target repository to push to, e.g. ./epicservice-0.5.1.tgz './dist/*.tgz' myrepo").
 		Required().
-		String()
-	pushTargetRepository := pushCmd.Arg("repo", "Target repository to push to").
-		Required().
-		String()
+		Strings()
 	pushForce := pushCmd.Flag("force", "Replace the chart if it already exists. This can cause the repository to lose existing chart; use it with care.").
 		Bool()
 	pushDryRun := pushCmd.Flag("dry-run", "Simulate a push, but don't actually touch anything.").
 		Bool()
 	pushIgnoreIfExists := pushCmd.Flag("ignore-if-exists", "If the chart already exists, exit normally and do not trigger an error.").
 		Bool()
-	pushContentType := pushCmd.Flag("content-type", "Set the Charts content-type").
-		Default(defaultChartsContentType).
+	pushContentType := pushCmd.Flag("content-type", "Set the Charts content-type. Defaults to the repository config or "+defaultChartsContentType).
 		OverrideDefaultFromEnvar("S3_CHART_CONTENT_TYPE").
 		String()
-	pushRelative := pushCmd.Flag(relativeFlag, helpRelativeFlag).Bool()
+	pushRelative := optionalBoolFlag(pushCmd.Flag(relativeFlag, helpRelativeFlag))
+	pushConcurrency := pushCmd.Flag("concurrency", "Number of charts to upload in parallel").
+		Default("10").
+		Int()
+	pushProv := pushCmd.Flag("prov", "Path to the provenance file of the chart. Defaults to the .prov file next to the chart archive if there is any.").
+		String()
+	pushSign := pushCmd.Flag("sign", "Sign the charts with the key from the keyring and push their provenance files").
+		Bool()
+	pushKey := pushCmd.Flag("key", "Name of the key to sign the charts with").
+		String()
+	pushRequireSignature := pushCmd.Flag("require-signature", "Verify the provenance files of the charts with the keyring and refuse unsigned charts").
+		Bool()
+	pushKeyring := pushCmd.Flag("keyring", "Path to the keyring containing the signing key or the keys trusted to verify the charts").
+		Default(defaultKeyring()).
+		String()
+	pushVersion := pushCmd.Flag("version", "Override the version of the charts packaged from chart directories").
+		String()
+	pushAppVersion := pushCmd.Flag("app-version", "Override the app version of the charts packaged from chart directories").
+		String()
 
 	reindexCmd := cli.Command(actionReindex, "Reindex the repository.")
 	reindexTargetRepository := reindexCmd.Arg("repo", "Target repository to reindex").
 		Required().
 		String()
-	reindexRelative := reindexCmd.Flag(relativeFlag, helpRelativeFlag).Bool()
+	reindexRelative := optionalBoolFlag(reindexCmd.Flag(relativeFlag, helpRelativeFlag))
+	reindexConcurrency := reindexCmd.Flag("concurrency", "Number of charts to fetch metadata for in parallel").
+		Default("10").
+		Int()
+	reindexIncremental := reindexCmd.Flag("incremental", "Update the current index processing only the charts added, changed or removed since they were indexed").
+		Bool()
 
-	deleteCmd := cli.Command(actionDelete, "Delete chart from the repository.").Alias("del")
+	deleteCmd := cli.Command(actionDelete, "Delete chart from the repository.").Alias(aliasDelete)
 	deleteChartName := deleteCmd.Arg("chartName", "Name of chart to delete").
 		Required().
 		String()
-	deleteChartVersion := deleteCmd.Flag("version", "Version of chart to delete").
-		Required().
+	deleteChartVersion := deleteCmd.Flag("version", "Version of chart to delete, or semver range of versions to delete, e.g. \">=1.2.0-0 <1.3.0\"").
 		String()
+	deleteAllVersions := deleteCmd.Flag("all-versions", "Delete all versions of the chart").
+		Bool()
+	deleteYes := deleteCmd.Flag("yes", "Delete multiple versions without confirmation").
+		Short('y').
+		Bool()
+	deleteSoft := optionalBoolFlag(deleteCmd.Flag("soft", "Move the chart files to the trash, from where they can be restored with undelete"))
 	deleteTargetRepository := deleteCmd.Arg("repo", "Target repository to delete from").
 		Required().
 		String()
 
+	undeleteCmd := cli.Command(actionUndelete, "Restore a soft deleted chart from the trash.")
+	undeleteChartName := undeleteCmd.Arg("chartName", "Name of chart to restore").
+		Required().
+		String()
+	undeleteChartVersion := undeleteCmd.Flag("version", "Version of chart to restore").
+		Required().
+		String()
+	undeleteTargetRepository := undeleteCmd.Arg("repo", "Target repository to restore to").
+		Required().
+		String()
+
+	trashCmd := cli.Command(actionTrash, "Inspect or empty the trash of soft deleted charts.")
+	trashListCmd := trashCmd.Command("list", "List the soft deleted charts.")
+	trashListRepository := trashListCmd.Arg("repo", "Target repository").
+		Required().
+		String()
+	trashPurgeCmd := trashCmd.Command("purge", "Delete the soft deleted charts for good.")
+	trashPurgeRepository := trashPurgeCmd.Arg("repo", "Target repository").
+		Required().
+		String()
+	trashPurgeOlderThan := trashPurgeCmd.Flag("older-than", "Purge only the charts deleted longer ago than the duration, e.g. 720h").
+		Duration()
+
+	copyCmd := cli.Command(actionCopy, "Copy chart from one repository to another.").Alias(aliasCopy)
+	copyChartName := copyCmd.Arg("chartName", "Name of chart to copy").
+		Required().
+		String()
+	copyChartVersion := copyCmd.Flag("version", "Version of chart to copy").
+		Required().
+		String()
+	copySourceRepository := copyCmd.Arg("srcRepo", "Repository to copy the chart from").
+		Required().
+		String()
+	copyTargetRepository := copyCmd.Arg("dstRepo", "Repository to copy the chart to").
+		Required().
+		String()
+	copyMove := copyCmd.Flag("move", "Delete the chart from the source repository once it is copied").
+		Bool()
+	copyForce := copyCmd.Flag("force", "Replace the chart if it already exists in the destination repository").
+		Bool()
+	copyKeyring := copyCmd.Flag("keyring", "Path to the keyring containing the keys trusted to verify the chart, if the destination repository accepts signed charts only").
+		Default(defaultKeyring()).
+		String()
+
+	mirrorCmd := cli.Command(actionMirror, "Mirror the charts of an HTTP(S) chart repository into the repository.")
+	mirrorUpstream := mirrorCmd.Arg("upstream", "URL of the repository to mirror, e.g. https://charts.example.com").
+		Required().
+		String()
+	mirrorTargetRepository := mirrorCmd.Arg("repo", "Target repository to mirror to").
+		Required().
+		String()
+	mirrorCharts := mirrorCmd.Flag("chart", "Name of chart to mirror. Can be repeated, all charts are mirrored by default").
+		Strings()
+	mirrorVersion := mirrorCmd.Flag("version", "Semver constraint of chart versions to mirror, e.g. \">=1.0.0\"").
+		String()
+	mirrorSince := mirrorCmd.Flag("since", "Mirror only chart versions created since the date or the duration ago, e.g. 2021-06-01 or 720h").
+		String()
+	mirrorConcurrency := mirrorCmd.Flag("concurrency", "Number of charts to mirror in parallel").
+		Default("10").
+		Int()
+	mirrorKeyring := mirrorCmd.Flag("keyring", "Path to the keyring containing the keys trusted to verify the charts, if the repository accepts signed charts only").
+		Default(defaultKeyring()).
+		String()
+
+	syncCmd := cli.Command(actionSync, "Make the chart versions of a repository match another repository.")
+	syncSourceRepository := syncCmd.Arg("srcRepo", "Repository to sync the charts from").
+		Required().
+		String()
+	syncTargetRepository := syncCmd.Arg("dstRepo", "Repository to sync the charts to").
+		Required().
+		String()
+	syncDelete := syncCmd.Flag("delete", "Delete the chart versions missing from the source repository from the destination repository").
+		Bool()
+	syncDryRun := syncCmd.Flag("dry-run", "Only print the changes to the destination repository").
+		Bool()
+	syncKeyring := syncCmd.Flag("keyring", "Path to the keyring containing the keys trusted to verify the charts, if the destination repository accepts signed charts only").
+		Default(defaultKeyring()).
+		String()
+
+	listCmd := cli.Command(actionList, "List charts in the repository.").Alias(aliasList)
+	listTargetRepository := listCmd.Arg("repo", "Target repository to list").
+		Required().
+		String()
+	listChartName := listCmd.Arg("chartName", "Name of chart to list the versions of").
+		String()
+	listVersion := listCmd.Flag("version", "Semver constraint of chart versions to list, e.g. \">=1.0.0, <2.0.0\"").
+		String()
+	listOutput := listCmd.Flag("output", "Output format, one of: table, json, yaml").
+		Short('o').
+		Default(outputTable).
+		Enum(outputTable, outputJSON, outputYAML)
+
+	verifyCmd := cli.Command(actionVerify, "Verify that the repository index matches the charts in the repository.")
+	verifyTargetRepository := verifyCmd.Arg("repo", "Target repository to verify").
+		Required().
+		String()
+	verifyFix := verifyCmd.Flag("fix", "Repair the index instead of only reporting the problems").
+		Bool()
+	verifyDeep := verifyCmd.Flag("deep", "Download every chart to verify its actual digest, not only its chart-digest metadata").
+		Bool()
+	verifyRelative := optionalBoolFlag(verifyCmd.Flag(relativeFlag, helpRelativeFlag))
+	verifyConcurrency := verifyCmd.Flag("concurrency", "Number of charts to fetch metadata for in parallel").
+		Default("10").
+		Int()
+
+	pruneCmd := cli.Command(actionPrune, "Delete old chart versions according to the retention policy. Only prints the chart versions to delete unless --no-dry-run is set.")
+	pruneTargetRepository := pruneCmd.Arg("repo", "Target repository to prune").
+		Required().
+		String()
+	pruneKeepLast := pruneCmd.Flag("keep-last", "Number of the latest versions to keep for every chart").
+		Int()
+	pruneOlderThan := pruneCmd.Flag("older-than", "Delete chart versions created longer ago than the duration, e.g. 720h").
+		Duration()
+	prunePrereleaseOlderThan := pruneCmd.Flag("prerelease-older-than", "Delete prerelease chart versions created longer ago than the duration, e.g. 168h").
+		Duration()
+	pruneKeep := pruneCmd.Flag("keep", "Semver constraint of chart versions to never delete, e.g. \"^1.0.0\". Can be repeated").
+		Strings()
+	pruneDryRun := pruneCmd.Flag("dry-run", "Only print the chart versions to delete").
+		Default("true").
+		Bool()
+
+	historyCmd := cli.Command(actionHistory, "List the previous versions of the repository index kept by S3 bucket versioning.")
+	historyTargetRepository := historyCmd.Arg("repo", "Target repository").
+		Required().
+		String()
+	historyMax := historyCmd.Flag("max", "Maximum number of index versions to show, 0 shows all of them").
+		Default("10").
+		Int()
+
+	rollbackCmd := cli.Command(actionRollback, "Restore a previous version of the repository index.")
+	rollbackTargetRepository := rollbackCmd.Arg("repo", "Target repository").
+		Required().
+		String()
+	rollbackTo := rollbackCmd.Flag("to", "Version ID of the index to restore, or an RFC 3339 timestamp to restore the index current at that time").
+		Required().
+		String()
+
+	cacheCmd := cli.Command(actionCache, "Manage the local cache of the charts downloaded by Helm.")
+	cacheCleanCmd := cacheCmd.Command("clean", "Remove every cached chart.")
+	cacheStatsCmd := cacheCmd.Command("stats", "Show the size of the cache.")
+
+	configCmd := cli.Command(actionConfig, "Manage the repository config shared by everyone working with the repository.")
+	configGetCmd := configCmd.Command("get", "Show the repository config or the value of a single key.")
+	configGetRepository := configGetCmd.Arg("repo", "Target repository").
+		Required().
+		String()
+	configGetKey := configGetCmd.Arg("key", "Config key, e.g. acl, relative or retention.keepLast").
+		String()
+	configSetCmd := configCmd.Command("set", "Set the value of a repository config key.")
+	configSetRepository := configSetCmd.Arg("repo", "Target repository").
+		Required().
+		String()
+	configSetKey := configSetCmd.Arg("key", "Config key, e.g. acl, relative or retention.keepLast").
+		Required().
+		String()
+	configSetValue := configSetCmd.Arg("value", "Config value, an empty value unsets the key").
+		Required().
+		String()
+
+	lockCmd := cli.Command(actionLock, "Inspect or break the repository lock.")
+	lockStatusCmd := lockCmd.Command("status", "Show the current holder of the repository lock.")
+	lockStatusRepository := lockStatusCmd.Arg("repo", "Target repository").
+		Required().
+		String()
+	lockBreakCmd := lockCmd.Command("break", "Forcefully remove the repository lock.")
+	lockBreakRepository := lockBreakCmd.Arg("repo", "Target repository").
+		Required().
+		String()
+
 	action := kingpin.MustParse(cli.Parse(os.Args[1:]))
 	if action == "" {
 		cli.Usage(os.Args[1:])
 		os.Exit(0)
 	}
 
+	// The lock expires together with the operation timeout.
+	lockTTL := *timeout
+	if !*lock {
+		lockTTL = 0
+	}
+
 	var act Action
 	switch action {
 	case actionVersion:
@@ -158,36 +410,200 @@ func main() {
 		act = initAction{
 			uri: *initURI,
 			acl: *acl,
+			cfg: repoConfig{
+				ACL:                  *acl,
+				ServerSideEncryption: *initSSE,
+				SSEKMSKeyID:          *initSSEKMSKeyID,
+				Relative:             *initRelative,
+				ContentType:          *initContentType,
+				RequireSignature:     *initRequireSignature,
+			},
 		}
 		defer fmt.Printf("Initialized empty repository at %s\n", *initURI)
 
 	case actionPush:
+		if len(*pushArgs) < 2 {
+			cli.Fatalf("required argument 'repo' not provided, try --help")
+		}
 		act = pushAction{
-			chartPath:      *pushChartPath,
-			repoName:       *pushTargetRepository,
-			force:          *pushForce,
-			dryRun:         *pushDryRun,
-			ignoreIfExists: *pushIgnoreIfExists,
-			acl:            *acl,
-			contentType:    *pushContentType,
-			relative:       *pushRelative,
+			chartPaths:       pushChartPaths(*pushArgs),
+			repoName:         pushTargetRepository(*pushArgs),
+			force:            *pushForce,
+			dryRun:           *pushDryRun,
+			ignoreIfExists:   *pushIgnoreIfExists,
+			acl:              *acl,
+			contentType:      *pushContentType,
+			relative:         pushRelative.value,
+			lockTTL:          lockTTL,
+			concurrency:      *pushConcurrency,
+			version:          *pushVersion,
+			appVersion:       *pushAppVersion,
+			prov:             *pushProv,
+			sign:             *pushSign,
+			key:              *pushKey,
+			keyring:          *pushKeyring,
+			requireSignature: *pushRequireSignature,
 		}
 
 	case actionReindex:
 		act = reindexAction{
-			repoName: *reindexTargetRepository,
-			acl:      *acl,
-			relative: *reindexRelative,
+			repoName:    *reindexTargetRepository,
+			acl:         *acl,
+			relative:    reindexRelative.value,
+			lockTTL:     lockTTL,
+			concurrency: *reindexConcurrency,
+			incremental: *reindexIncremental,
 		}
 		defer fmt.Printf("Repository %s was successfully reindexed.\n", *reindexTargetRepository)
 
 	case actionDelete:
 		act = deleteAction{
-			name:     *deleteChartName,
-			version:  *deleteChartVersion,
-			repoName: *deleteTargetRepository,
+			name:        *deleteChartName,
+			version:     *deleteChartVersion,
+			repoName:    *deleteTargetRepository,
+			acl:         *acl,
+			lockTTL:     lockTTL,
+			allVersions: *deleteAllVersions,
+			yes:         *deleteYes,
+			soft:        deleteSoft.value,
+		}
+
+	case actionUndelete:
+		act = undeleteAction{
+			name:     *undeleteChartName,
+			version:  *undeleteChartVersion,
+			repoName: *undeleteTargetRepository,
+			acl:      *acl,
+			lockTTL:  lockTTL,
+		}
+
+	case cacheCleanCmd.FullCommand():
+		act = cacheCleanAction{}
+
+	case cacheStatsCmd.FullCommand():
+		act = cacheStatsAction{}
+
+	case trashListCmd.FullCommand():
+		act = trashListAction{
+			repoName: *trashListRepository,
+		}
+
+	case trashPurgeCmd.FullCommand():
+		act = trashPurgeAction{
+			repoName:  *trashPurgeRepository,
+			acl:       *acl,
+			lockTTL:   lockTTL,
+			olderThan: *trashPurgeOlderThan,
+		}
+
+	case actionCopy:
+		act = copyAction{
+			name:    *copyChartName,
+			version: *copyChartVersion,
+			srcRepo: *copySourceRepository,
+			dstRepo: *copyTargetRepository,
+			acl:     *acl,
+			lockTTL: lockTTL,
+			force:   *copyForce,
+			move:    *copyMove,
+			keyring: *copyKeyring,
+		}
+
+	case actionMirror:
+		act = mirrorAction{
+			upstream:    *mirrorUpstream,
+			repoName:    *mirrorTargetRepository,
+			acl:         *acl,
+			lockTTL:     lockTTL,
+			charts:      *mirrorCharts,
+			version:     *mirrorVersion,
+			since:       *mirrorSince,
+			concurrency: *mirrorConcurrency,
+			keyring:     *mirrorKeyring,
+		}
+
+	case actionSync:
+		act = syncAction{
+			srcRepo: *syncSourceRepository,
+			dstRepo: *syncTargetRepository,
+			acl:     *acl,
+			lockTTL: lockTTL,
+			delete:  *syncDelete,
+			dryRun:  *syncDryRun,
+			keyring: *syncKeyring,
+		}
+
+	case actionList:
+		act = listAction{
+			repoName:  *listTargetRepository,
+			chartName: *listChartName,
+			version:   *listVersion,
+			output:    *listOutput,
+		}
+
+	case actionVerify:
+		act = verifyAction{
+			repoName:    *verifyTargetRepository,
+			acl:         *acl,
+			relative:    verifyRelative.value,
+			lockTTL:     lockTTL,
+			concurrency: *verifyConcurrency,
+			deep:        *verifyDeep,
+			fix:         *verifyFix,
+		}
+
+	case actionPrune:
+		act = pruneAction{
+			repoName:            *pruneTargetRepository,
+			acl:                 *acl,
+			lockTTL:             lockTTL,
+			keepLast:            *pruneKeepLast,
+			olderThan:           *pruneOlderThan,
+			prereleaseOlderThan: *prunePrereleaseOlderThan,
+			keep:                *pruneKeep,
+			dryRun:              *pruneDryRun,
+		}
+
+	case actionHistory:
+		act = historyAction{
+			repoName: *historyTargetRepository,
+			limit:    *historyMax,
+		}
+
+	case actionRollback:
+		act = rollbackAction{
+			repoName: *rollbackTargetRepository,
 			acl:      *acl,
+			lockTTL:  lockTTL,
+			to:       *rollbackTo,
 		}
+
+	case configGetCmd.FullCommand():
+		act = configGetAction{
+			repoName: *configGetRepository,
+			key:      *configGetKey,
+		}
+
+	case configSetCmd.FullCommand():
+		act = configSetAction{
+			repoName: *configSetRepository,
+			key:      *configSetKey,
+			value:    *configSetValue,
+			acl:      *acl,
+			lockTTL:  lockTTL,
+		}
+
+	case lockStatusCmd.FullCommand():
+		act = lockStatusAction{
+			repoName: *lockStatusRepository,
+		}
+
+	case lockBreakCmd.FullCommand():
+		act = lockBreakAction{
+			repoName: *lockBreakRepository,
+		}
+		defer fmt.Printf("Lock of repository %s was successfully broken.\n", *lockBreakRepository)
+
 	default:
 		return
 	}
@@ -199,16 +615,94 @@ func main() {
 	switch err {
 	case nil:
 	case ErrChartExists:
-		log.Fatalf("The chart already exists in the repository and cannot be overwritten without an explicit intent. If you want to replace existing chart, use --force flag:\n\n\thelm s3 push --force %s %s\n\n", *pushChartPath, *pushTargetRepository)
+		log.Fatalf("The chart already exists in the repository and cannot be overwritten without an explicit intent. If you want to replace existing chart, use --force flag:\n\n\thelm s3 push --force %s %s\n\n", strings.Join(pushChartPaths(*pushArgs), " "), pushTargetRepository(*pushArgs))
+	case ErrIndexDrift:
+		log.Fatalf("The index of repository %s does not match its contents. To repair it, run:\n\n\thelm s3 verify --fix %s\n\n", *verifyTargetRepository, *verifyTargetRepository)
 	default:
 		log.Fatal(err)
 	}
 }
 
+// defaultKeyring returns the default GnuPG keyring, like Helm does.
+func defaultKeyring() string {
+	if v, ok := os.LookupEnv("GNUPGHOME"); ok {
+		return filepath.Join(v, "pubring.gpg")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".gnupg", "pubring.gpg")
+}
+
+// pushChartPaths returns the chart paths of the push command arguments.
+func pushChartPaths(args []string) []string {
+	return args[:len(args)-1]
+}
+
+// pushTargetRepository returns the target repository of the push command
+// arguments.
+func pushTargetRepository(args []string) string {
+	return args[len(args)-1]
+}
+
 func isAction(name string) bool {
-	return name == actionDelete ||
+	return name == actionCache ||
+		name == actionConfig ||
+		name == actionCopy ||
+		name == actionDelete ||
+		name == actionHistory ||
 		name == actionInit ||
+		name == actionList ||
+		name == actionLock ||
+		name == actionMirror ||
+		name == actionPrune ||
 		name == actionPush ||
 		name == actionReindex ||
-		name == actionVersion
+		name == actionRollback ||
+		name == actionSync ||
+		name == actionTrash ||
+		name == actionUndelete ||
+		name == actionVerify ||
+		name == actionVersion ||
+		name == aliasDelete ||
+		name == aliasCopy ||
+		name == aliasList
+}
+
+// optionalBool is the value of a bool flag that is nil unless the flag is set
+// on the command line, so that the repository config applies otherwise.
+type optionalBool struct {
+	value *bool
+}
+
+// optionalBoolFlag registers the flag as an optional bool flag.
+func optionalBoolFlag(flag *kingpin.FlagClause) *optionalBool {
+	b := &optionalBool{}
+	flag.SetValue(b)
+	return b
+}
+
+// Set implements kingpin.Value.
+func (b *optionalBool) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	b.value = &v
+	return nil
+}
+
+// String implements kingpin.Value.
+func (b *optionalBool) String() string {
+	if b.value == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b.value)
+}
+
+// IsBoolFlag makes kingpin treat the flag as a bool flag, which takes no
+// value and can be negated with the --no- prefix.
+func (b *optionalBool) IsBoolFlag() bool {
+	return true
 }
@@ -0,0 +1,381 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+// mirrorBatchSize is the number of charts mirrored between updates of the
+// index, so that an interrupted mirror keeps most of its progress.
+const mirrorBatchSize = 20
+
+type mirrorAction struct {
+	// upstream is the URL of the HTTP(S) repository to mirror.
+	upstream string
+	repoName string
+	acl      string
+	lockTTL  time.Duration
+
+	// charts limits mirroring to the charts with the names, version to the
+	// chart versions matching the semver constraint and since to the chart
+	// versions created after the time, given either as a duration ago or
+	// as a date.
+	charts  []string
+	version string
+	since   string
+
+	// concurrency is the number of charts mirrored in parallel.
+	concurrency int
+
+	// keyring is used to verify the charts if the repository accepts signed
+	// charts only.
+	keyring string
+
+	// client is the HTTP client used to download from the upstream
+	// repository, http.DefaultClient if nil.
+	client *http.Client
+}
+
+// mirroredChart is a chart version of the upstream repository to mirror.
+type mirroredChart struct {
+	entry helmutil.IndexEntry
+	url   string
+	fname string
+
+	// chart and hash are set once the chart is downloaded and verified.
+	chart helmutil.Chart
+	hash  string
+}
+
+func (act mirrorAction) Run(ctx context.Context) error {
+	if act.client == nil {
+		act.client = http.DefaultClient
+	}
+	act.upstream = strings.TrimSuffix(act.upstream, "/")
+
+	filter, err := act.filter(time.Now())
+	if err != nil {
+		return err
+	}
+
+	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
+	if err != nil {
+		return err
+	}
+
+	storage, err := backend.New(repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadRepoConfig(ctx, storage, repoEntry.URL())
+	if err != nil {
+		return err
+	}
+	act.acl = cfg.acl(act.acl)
+
+	b, err := act.download(ctx, act.upstream+"/index.yaml")
+	if err != nil {
+		return errors.WithMessage(err, "fetch upstream index")
+	}
+	upstreamIdx := helmutil.NewIndex()
+	if err := upstreamIdx.UnmarshalBinary(b); err != nil {
+		return errors.WithMessage(err, "load upstream index")
+	}
+
+	unlock, err := lockRepo(ctx, storage, repoEntry.URL(), act.lockTTL)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	idx, _, err := fetchIndex(ctx, storage, repoEntry)
+	if err != nil {
+		return err
+	}
+
+	// Chart versions already in the repository are skipped, so mirroring
+	// again only picks up the new ones.
+	var missing []mirroredChart
+	for _, entry := range upstreamIdx.Entries() {
+		if !filter(entry) || idx.Has(entry.Name, entry.Version) {
+			continue
+		}
+		if len(entry.URLs) == 0 {
+			log.Printf("[WARN] chart %s %s has no URL in the upstream index, skipping", entry.Name, entry.Version)
+			continue
+		}
+		u, err := act.resolveURL(entry.URLs[0])
+		if err != nil {
+			return err
+		}
+		// The upstream file name is not used, as it may carry a query string
+		// or be shared by charts in different upstream folders.
+		fname := fmt.Sprintf("%s-%s.tgz", entry.Name, entry.Version)
+		missing = append(missing, mirroredChart{entry: entry, url: u, fname: fname})
+	}
+
+	baseURL := repoEntry.URL()
+	if cfg.relative(nil) {
+		baseURL = ""
+	}
+
+	var mirrored, failed int
+	for len(missing) > 0 {
+		n := len(missing)
+		if n > mirrorBatchSize {
+			n = mirrorBatchSize
+		}
+		batch := missing[:n]
+		missing = missing[n:]
+
+		charts := act.mirrorCharts(ctx, storage, repoEntry, cfg, batch)
+		failed += len(batch) - len(charts)
+		if len(charts) == 0 {
+			continue
+		}
+
+		idx, err = updateIndex(ctx, storage, repoEntry, act.acl, func(idx helmutil.Index) error {
+			for _, ch := range charts {
+				if err := idx.AddOrReplace(ch.chart.Metadata().Value(), ch.fname, baseURL, ch.hash); err != nil {
+					return errors.WithMessagef(err, "add/replace chart %s in the index", ch.fname)
+				}
+			}
+			idx.SortEntries()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		mirrored += len(charts)
+	}
+
+	if err := idx.WriteFile(repoEntry.CacheFile(), 0644); err != nil {
+		return errors.WithMessage(err, "update local index")
+	}
+
+	fmt.Printf("Mirrored %d chart versions from %s to repository %s.\n", mirrored, act.upstream, act.repoName)
+	if failed > 0 {
+		return fmt.Errorf("failed to mirror %d chart versions, run mirror again to retry", failed)
+	}
+	return nil
+}
+
+// filter returns the function reporting whether the chart version should be
+// mirrored.
+func (act mirrorAction) filter(now time.Time) (func(entry helmutil.IndexEntry) bool, error) {
+	var constraint *semver.Constraints
+	if act.version != "" {
+		c, err := semver.NewConstraint(act.version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse version constraint %q", act.version)
+		}
+		constraint = c
+	}
+
+	var since time.Time
+	if act.since != "" {
+		t, err := parseSince(act.since, now)
+		if err != nil {
+			return nil, err
+		}
+		since = t
+	}
+
+	return func(entry helmutil.IndexEntry) bool {
+		if len(act.charts) > 0 && !contains(act.charts, entry.Name) {
+			return false
+		}
+		if constraint != nil {
+			v, err := semver.NewVersion(entry.Version)
+			if err != nil || !constraint.Check(v) {
+				return false
+			}
+		}
+		return since.IsZero() || !entry.Created.Before(since)
+	}, nil
+}
+
+// mirrorCharts downloads, verifies and uploads the charts in parallel. It
+// returns the charts mirrored successfully, failures are logged.
+func (act mirrorAction) mirrorCharts(
+	ctx context.Context,
+	storage backend.Storage,
+	repoEntry helmutil.RepoEntry,
+	cfg repoConfig,
+	charts []mirroredChart,
+) []mirroredChart {
+	concurrency := act.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	errs := make([]error, len(charts))
+	for i := range charts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = act.mirrorChart(ctx, storage, repoEntry, cfg, &charts[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var mirrored []mirroredChart
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("[ERROR] failed to mirror chart %s %s: %s", charts[i].entry.Name, charts[i].entry.Version, err)
+			continue
+		}
+		mirrored = append(mirrored, charts[i])
+	}
+	return mirrored
+}
+
+// mirrorChart downloads the chart from the upstream repository, verifies its
+// digest against the upstream index and uploads it to the repository.
+func (act mirrorAction) mirrorChart(
+	ctx context.Context,
+	storage backend.Storage,
+	repoEntry helmutil.RepoEntry,
+	cfg repoConfig,
+	ch *mirroredChart,
+) error {
+	archive, err := act.download(ctx, ch.url)
+	if err != nil {
+		return err
+	}
+
+	ch.hash, err = helmutil.Digest(bytes.NewReader(archive))
+	if err != nil {
+		return errors.WithMessage(err, "get chart hash")
+	}
+	if ch.entry.Digest == "" {
+		return errors.New("the upstream index has no digest to verify the chart with")
+	}
+	if ch.hash != ch.entry.Digest {
+		return fmt.Errorf("digest %s does not match digest %s of the upstream index", ch.hash, ch.entry.Digest)
+	}
+
+	ch.chart, err = helmutil.LoadArchive(bytes.NewReader(archive))
+	if err != nil {
+		return errors.WithMessage(err, "load chart")
+	}
+	if ch.chart.Name() != ch.entry.Name || ch.chart.Version() != ch.entry.Version {
+		return fmt.Errorf("the archive is chart %s %s", ch.chart.Name(), ch.chart.Version())
+	}
+
+	var prov []byte
+	if cfg.RequireSignature {
+		prov, err = act.download(ctx, ch.url+provenanceSuffix)
+		if err != nil {
+			return errors.WithMessagef(ErrChartNotSigned, "the repository accepts signed charts only, but the provenance file could not be downloaded: %s", err)
+		}
+		if err := helmutil.VerifyChart(ch.fname, archive, prov, act.keyring); err != nil {
+			return errors.WithMessage(err, "verify chart")
+		}
+	}
+
+	chartMetaJSON, err := ch.chart.Metadata().MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	chartURL := repoEntry.URL() + "/" + ch.fname
+	_, err = storage.PutChart(ctx, chartURL, bytes.NewReader(archive), string(chartMetaJSON), act.acl, ch.hash, cfg.contentType(""))
+	if err != nil {
+		return errors.WithMessage(err, "upload chart")
+	}
+
+	if prov != nil {
+		err := storage.PutRaw(ctx, chartURL+provenanceSuffix, bytes.NewReader(prov), act.acl, provenanceContentType)
+		if err != nil {
+			return errors.WithMessage(err, "upload provenance file")
+		}
+	}
+	return nil
+}
+
+// resolveURL returns the absolute URL of the chart given the URL from the
+// upstream index, which can be relative to the upstream repository.
+func (act mirrorAction) resolveURL(u string) (string, error) {
+	base, err := url.Parse(act.upstream + "/")
+	if err != nil {
+		return "", errors.Wrapf(err, "parse upstream url %s", act.upstream)
+	}
+	ref, err := url.Parse(u)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse chart url %s", u)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// download downloads the file from the upstream repository.
+func (act mirrorAction) download(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create request")
+	}
+
+	resp, err := act.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "download %s", u)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("download %s: %s", u, resp.Status)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "download %s", u)
+	}
+	return b, nil
+}
+
+// parseSince parses the --since value, either a duration before now, e.g.
+// 720h, or a date in the form of 2006-01-02 or RFC 3339.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q, expected a duration like 720h or a date like 2021-06-01", s)
+}
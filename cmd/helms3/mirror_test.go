@@ -0,0 +1,277 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+// testUpstream is an HTTP chart repository serving the charts from a
+// directory.
+type testUpstream struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	downloads map[string]int
+	corrupted map[string]bool
+}
+
+// setupUpstream starts an HTTP chart repository serving the charts with the
+// names and versions.
+func setupUpstream(t *testing.T, charts map[string][]string) *testUpstream {
+	t.Helper()
+
+	dir := t.TempDir()
+	idx := helmutil.NewIndex()
+	for name, versions := range charts {
+		for _, version := range versions {
+			fpath := writeTestChart(t, dir, name, version)
+			ch, err := helmutil.LoadChart(fpath)
+			require.NoError(t, err)
+			digest, err := helmutil.DigestFile(fpath)
+			require.NoError(t, err)
+			require.NoError(t, idx.Add(ch.Metadata().Value(), filepath.Base(fpath), "", digest))
+		}
+	}
+	idx.SortEntries()
+	require.NoError(t, idx.WriteFile(filepath.Join(dir, "index.yaml"), 0644))
+
+	u := &testUpstream{
+		downloads: map[string]int{},
+		corrupted: map[string]bool{},
+	}
+	files := http.FileServer(http.Dir(dir))
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		u.downloads[r.URL.Path]++
+		corrupted := u.corrupted[r.URL.Path]
+		u.mu.Unlock()
+
+		if corrupted {
+			_, _ = w.Write([]byte("corrupted"))
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(u.Close)
+
+	return u
+}
+
+// corrupt makes the upstream serve corrupted contents of the file, or the
+// actual contents again.
+func (u *testUpstream) corrupt(name string, corrupted bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.corrupted["/"+name] = corrupted
+}
+
+// chartDownloads returns the number of chart files downloaded.
+func (u *testUpstream) chartDownloads() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	n := 0
+	for p, count := range u.downloads {
+		if filepath.Ext(p) == ".tgz" {
+			n += count
+		}
+	}
+	return n
+}
+
+func TestMirrorAction(t *testing.T) {
+	all := []string{"bar 1.0.0", "bar 1.1.0-rc.1", "baz 2.0.0"}
+
+	testCases := map[string]struct {
+		act          mirrorAction
+		corrupted    string
+		expectCharts []string
+		expectError  bool
+	}{
+		"all charts": {
+			expectCharts: all,
+		},
+		"chart names": {
+			act:          mirrorAction{charts: []string{"baz"}},
+			expectCharts: []string{"baz 2.0.0"},
+		},
+		"version constraint": {
+			act:          mirrorAction{version: ">=1.0.0"},
+			expectCharts: []string{"bar 1.0.0", "baz 2.0.0"},
+		},
+		"since duration": {
+			act:          mirrorAction{since: "1h"},
+			expectCharts: all,
+		},
+		"since date": {
+			act: mirrorAction{since: "2999-01-01"},
+		},
+		"digest mismatch": {
+			corrupted:    "baz-2.0.0.tgz",
+			expectCharts: []string{"bar 1.0.0", "bar 1.1.0-rc.1"},
+			expectError:  true,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+				upstream := setupUpstream(t, map[string][]string{
+					"bar": {"1.0.0", "1.1.0-rc.1"},
+					"baz": {"2.0.0"},
+				})
+				if tc.corrupted != "" {
+					upstream.corrupt(tc.corrupted, true)
+				}
+
+				tc.act.upstream = upstream.URL + "/"
+				tc.act.repoName = testRepoName
+				tc.act.lockTTL = time.Minute
+				tc.act.concurrency = 2
+				err := tc.act.Run(context.Background())
+				if tc.expectError {
+					require.Error(t, err)
+				} else {
+					require.NoError(t, err)
+				}
+
+				var mirrored []string
+				for _, entry := range repo.index(t).Entries() {
+					mirrored = append(mirrored, entry.Name+" "+entry.Version)
+					require.True(t, repo.hasFile(t, entry.Name+"-"+entry.Version+".tgz"))
+					require.Equal(t, repo.uri+"/"+entry.Name+"-"+entry.Version+".tgz", entry.URLs[0])
+				}
+				require.ElementsMatch(t, tc.expectCharts, mirrored)
+
+				if repo.server != nil {
+					for _, entry := range repo.index(t).Entries() {
+						obj, ok := repo.server.Object("test-bucket", "charts/"+entry.Name+"-"+entry.Version+".tgz")
+						require.True(t, ok)
+						require.NotEmpty(t, obj.Metadata["Chart-Metadata"])
+						require.Equal(t, entry.Digest, obj.Metadata["Chart-Digest"])
+					}
+				}
+
+				// Mirroring again downloads only the charts that failed.
+				downloads := upstream.chartDownloads()
+				upstream.corrupt(tc.corrupted, false)
+				require.NoError(t, tc.act.Run(context.Background()))
+				failed := 0
+				if tc.corrupted != "" {
+					failed = 1
+					require.True(t, repo.index(t).Has("baz", "2.0.0"))
+				}
+				require.Equal(t, downloads+failed, upstream.chartDownloads())
+			})
+		}
+	}
+}
+
+func TestMirrorAction_ChartURLs(t *testing.T) {
+	repo := setupS3Repo(t)
+
+	// The upstream charts share the file name in different folders and are
+	// referenced by signed URLs.
+	dir := t.TempDir()
+	idx := helmutil.NewIndex()
+	for folder, name := range map[string]string{"a": "bar", "b": "baz"} {
+		fpath := writeTestChart(t, t.TempDir(), name, "1.0.0")
+		b, err := os.ReadFile(fpath)
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, folder), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, folder, "chart.tgz"), b, 0644))
+
+		ch, err := helmutil.LoadChart(fpath)
+		require.NoError(t, err)
+		digest, err := helmutil.DigestFile(fpath)
+		require.NoError(t, err)
+		require.NoError(t, idx.Add(ch.Metadata().Value(), folder+"/chart.tgz?signature="+folder, "", digest))
+	}
+	require.NoError(t, idx.WriteFile(filepath.Join(dir, "index.yaml"), 0644))
+	upstream := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	t.Cleanup(upstream.Close)
+
+	act := mirrorAction{
+		upstream: upstream.URL,
+		repoName: testRepoName,
+		lockTTL:  time.Minute,
+	}
+	require.NoError(t, act.Run(context.Background()))
+
+	idx = repo.index(t)
+	for _, name := range []string{"bar", "baz"} {
+		entry := indexEntry(t, idx, name, "1.0.0")
+		require.Equal(t, repo.uri+"/"+name+"-1.0.0.tgz", entry.URLs[0])
+		digest, err := helmutil.Digest(bytes.NewReader(repo.file(t, name+"-1.0.0.tgz")))
+		require.NoError(t, err)
+		require.Equal(t, entry.Digest, digest)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := map[string]struct {
+		since       string
+		expect      time.Time
+		expectError bool
+	}{
+		"duration": {
+			since:  "24h",
+			expect: time.Date(2021, 5, 31, 12, 0, 0, 0, time.UTC),
+		},
+		"date": {
+			since:  "2021-05-01",
+			expect: time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC),
+		},
+		"timestamp": {
+			since:  "2021-05-01T10:00:00Z",
+			expect: time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC),
+		},
+		"invalid": {
+			since:       "yesterday",
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			since, err := parseSince(tc.since, now)
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, tc.expect.Equal(since), since)
+		})
+	}
+}
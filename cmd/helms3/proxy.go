@@ -17,33 +17,35 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"log"
+	"os"
 	"strings"
 
 	"github.com/pkg/errors"
 
-	"github.com/banzaicloud/helm-s3/internal/awss3"
-	"github.com/banzaicloud/helm-s3/internal/awsutil"
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/cache"
 )
 
 type proxyCmd struct {
 	uri string
+
+	// cache keeps the downloaded objects, so that unchanged ones are served
+	// locally. Nil disables caching.
+	cache *cache.Cache
 }
 
 const indexYaml = "index.yaml"
 
 func (act proxyCmd) Run(ctx context.Context) error {
-	sess, err := awsutil.Session(
-		awsutil.AssumeRoleTokenProvider(awsutil.StderrTokenProvider),
-		awsutil.DynamicBucketRegion(act.uri),
-	)
+	storage, err := backend.New(act.uri)
 	if err != nil {
 		return err
 	}
-	storage := awss3.New(sess)
 
-	b, err := storage.FetchRaw(ctx, act.uri)
-	if err != nil {
-		if strings.HasSuffix(act.uri, indexYaml) && err == awss3.ErrObjectNotFound {
+	if err := act.download(ctx, storage); err != nil {
+		if strings.HasSuffix(act.uri, indexYaml) && err == backend.ErrObjectNotFound {
 			return fmt.Errorf(
 				"The index file does not exist by the path %s. "+
 					"If you haven't initialized the repository yet, try running \"helm s3 init %s\"",
@@ -51,9 +53,62 @@ func (act proxyCmd) Run(ctx context.Context) error {
 				strings.TrimSuffix(strings.TrimSuffix(act.uri, indexYaml), "/"),
 			)
 		}
+		if strings.HasSuffix(act.uri, provenanceSuffix) && err == backend.ErrObjectNotFound {
+			return fmt.Errorf(
+				"The provenance file does not exist by the path %s. "+
+					"The chart was pushed without signing it, so it cannot be verified",
+				act.uri,
+			)
+		}
 		return errors.WithMessage(err, fmt.Sprintf("fetch from s3 uri=%s", act.uri))
 	}
 
-	fmt.Print(string(b))
+	return nil
+}
+
+// download writes the object to stdout. The object is streamed to Helm as is,
+// so that large charts are never held in memory as a whole. If the object is
+// cached and has not changed since, the cached copy is served instead.
+// Failures of the cache are only logged, as the object can be downloaded
+// anyway.
+func (act proxyCmd) download(ctx context.Context, storage backend.Storage) error {
+	downloader, ok := storage.(backend.ConditionalDownloader)
+	if act.cache == nil || !ok {
+		return storage.Download(ctx, act.uri, os.Stdout)
+	}
+
+	cached, etag, err := act.cache.Open(act.uri)
+	switch {
+	case err == nil:
+		defer cached.Close()
+	case err != cache.ErrNotCached:
+		log.Printf("[WARN] failed to read the cached copy of %s: %s", act.uri, err)
+	}
+
+	var w io.Writer = os.Stdout
+	cw, err := act.cache.Create(act.uri)
+	if err != nil {
+		log.Printf("[WARN] failed to cache %s: %s", act.uri, err)
+	} else {
+		w = io.MultiWriter(os.Stdout, cw)
+	}
+
+	etag, err = downloader.DownloadIfNoneMatch(ctx, act.uri, etag, w)
+	if err != nil {
+		if cw != nil {
+			_ = cw.Abort()
+		}
+		if err != backend.ErrNotModified {
+			return err
+		}
+		_, err := io.Copy(os.Stdout, cached)
+		return errors.Wrap(err, "read cached copy")
+	}
+
+	if cw != nil {
+		if err := cw.Commit(etag); err != nil {
+			log.Printf("[WARN] failed to cache %s: %s", act.uri, err)
+		}
+	}
 	return nil
 }
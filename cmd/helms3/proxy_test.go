@@ -0,0 +1,148 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/cache"
+	"github.com/banzaicloud/helm-s3/internal/s3test"
+)
+
+func TestProxyCmd(t *testing.T) {
+	chart, err := os.ReadFile(testChartPath)
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		uri            string
+		failure        *s3test.Failure
+		expectedOutput []byte
+		expectError    bool
+	}{
+		"chart": {
+			uri:            "s3://test-bucket/charts/foo-1.2.3.tgz",
+			expectedOutput: chart,
+		},
+		"provenance file": {
+			uri:            "s3://test-bucket/charts/foo-1.2.3.tgz.prov",
+			expectedOutput: []byte("signature"),
+		},
+		"missing provenance file": {
+			uri:         "s3://test-bucket/charts/bar-1.0.0.tgz.prov",
+			expectError: true,
+		},
+		"missing chart": {
+			uri:         "s3://test-bucket/charts/bar-1.0.0.tgz",
+			expectError: true,
+		},
+		"missing index": {
+			uri:         "s3://test-bucket/uninitialized/index.yaml",
+			expectError: true,
+		},
+		"missing bucket": {
+			uri:         "s3://missing-bucket/charts/index.yaml",
+			expectError: true,
+		},
+		"access denied": {
+			uri:         "s3://test-bucket/charts/foo-1.2.3.tgz",
+			failure:     &s3test.Failure{Op: "GetObject", StatusCode: http.StatusForbidden, Code: "AccessDenied"},
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			server := s3test.NewServer()
+			t.Cleanup(server.Close)
+			server.Setenv(t)
+			server.PutObject("test-bucket", "charts/foo-1.2.3.tgz", chart, nil)
+			server.PutObject("test-bucket", "charts/foo-1.2.3.tgz.prov", []byte("signature"), nil)
+			if tc.failure != nil {
+				server.InjectFailure(*tc.failure)
+			}
+
+			var err error
+			output := captureStdout(t, func() {
+				err = proxyCmd{uri: tc.uri}.Run(context.Background())
+			})
+			if tc.expectError {
+				require.Error(t, err)
+				require.Empty(t, output)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedOutput, output)
+		})
+	}
+}
+
+func TestProxyCmd_Cache(t *testing.T) {
+	server := s3test.NewServer()
+	t.Cleanup(server.Close)
+	server.Setenv(t)
+	server.PutObject("test-bucket", "charts/foo-1.2.3.tgz", []byte("first"), nil)
+
+	c := cache.New(t.TempDir(), 1024)
+	cmd := proxyCmd{uri: "s3://test-bucket/charts/foo-1.2.3.tgz", cache: c}
+	download := func() string {
+		t.Helper()
+
+		var err error
+		output := captureStdout(t, func() {
+			err = cmd.Run(context.Background())
+		})
+		require.NoError(t, err)
+		return string(output)
+	}
+
+	require.Equal(t, "first", download())
+	stats, err := c.Stats()
+	require.NoError(t, err)
+	require.Equal(t, cache.Stats{Objects: 1, Size: 5}, stats)
+
+	// The unchanged object is served from the cache, which is proven by
+	// tampering with the cached copy.
+	var cached string
+	require.NoError(t, filepath.Walk(c.Dir(), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			cached = path
+		}
+		return err
+	}))
+	require.NoError(t, os.WriteFile(cached, []byte("cached"), 0644))
+	require.Equal(t, "cached", download())
+
+	// The changed object is downloaded again.
+	server.PutObject("test-bucket", "charts/foo-1.2.3.tgz", []byte("second"), nil)
+	require.Equal(t, "second", download())
+	require.Equal(t, "second", download())
+
+	// A deleted object is not served from the cache.
+	storage, err := backend.New(cmd.uri)
+	require.NoError(t, err)
+	require.NoError(t, storage.Delete(context.Background(), cmd.uri))
+	output := captureStdout(t, func() {
+		require.Error(t, cmd.Run(context.Background()))
+	})
+	require.Empty(t, output)
+}
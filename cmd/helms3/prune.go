@@ -0,0 +1,279 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+// ErrNoRetentionPolicy signals that prune was run without any retention
+// policy, neither set by flags nor by the repository config.
+var ErrNoRetentionPolicy = errors.New("no retention policy")
+
+type pruneAction struct {
+	repoName string
+	acl      string
+	lockTTL  time.Duration
+
+	// keepLast, olderThan, prereleaseOlderThan and keep override the
+	// retention policy of the repository config if set.
+	keepLast            int
+	olderThan           time.Duration
+	prereleaseOlderThan time.Duration
+	keep                []string
+
+	// dryRun makes prune only print the chart versions it would delete.
+	dryRun bool
+}
+
+// prunePolicy is the retention policy applied by prune.
+type prunePolicy struct {
+	// keepLast is the number of the latest versions kept for every chart.
+	keepLast int
+
+	// olderThan and prereleaseOlderThan are the ages of the versions and the
+	// prerelease versions to delete.
+	olderThan           time.Duration
+	prereleaseOlderThan time.Duration
+
+	// keep matches the versions that are never deleted.
+	keep *semver.Constraints
+}
+
+// prunedVersion is a chart version to be deleted by prune.
+type prunedVersion struct {
+	entry  helmutil.IndexEntry
+	reason string
+}
+
+func (act pruneAction) Run(ctx context.Context) error {
+	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
+	if err != nil {
+		return err
+	}
+
+	storage, err := backend.New(repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadRepoConfig(ctx, storage, repoEntry.URL())
+	if err != nil {
+		return err
+	}
+	act.acl = cfg.acl(act.acl)
+
+	policy, err := act.policy(cfg)
+	if err != nil {
+		return err
+	}
+
+	if !act.dryRun {
+		unlock, err := lockRepo(ctx, storage, repoEntry.URL(), act.lockTTL)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	idx, _, err := fetchIndex(ctx, storage, repoEntry)
+	if err != nil {
+		return err
+	}
+
+	plan := planPrune(idx.Entries(), policy, time.Now())
+	if len(plan) == 0 {
+		fmt.Printf("Nothing to prune in repository %s.\n", act.repoName)
+		return nil
+	}
+
+	if err := printPrunePlan(os.Stdout, plan); err != nil {
+		return err
+	}
+
+	if act.dryRun {
+		fmt.Printf("Dry run: %d chart versions would be deleted, use --no-dry-run to delete them.\n", len(plan))
+		return nil
+	}
+
+	// The index is updated first, so that it never references deleted
+	// charts, then all the chart files are deleted at once.
+
+	var uris []string
+	idx, err = updateIndex(ctx, storage, repoEntry, act.acl, func(idx helmutil.Index) error {
+		uris = uris[:0]
+		for _, p := range plan {
+			if !idx.Has(p.entry.Name, p.entry.Version) {
+				continue
+			}
+			url, err := idx.Delete(p.entry.Name, p.entry.Version)
+			if err != nil {
+				return errors.Wrapf(err, "remove chart %s %s from the index", p.entry.Name, p.entry.Version)
+			}
+			if url != "" {
+				url = resolveChartURL(repoEntry, url)
+				uris = append(uris, url, url+provenanceSuffix)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := storage.DeleteBatch(ctx, uris); err != nil {
+		return errors.WithMessage(err, "delete chart files")
+	}
+
+	if err := idx.WriteFile(repoEntry.CacheFile(), 0644); err != nil {
+		return errors.WithMessage(err, "update local index")
+	}
+
+	fmt.Printf("Pruned %d chart versions from repository %s.\n", len(plan), act.repoName)
+	return nil
+}
+
+// policy returns the retention policy of the flags on top of the retention
+// policy of the repository config.
+func (act pruneAction) policy(cfg repoConfig) (prunePolicy, error) {
+	var retention retentionPolicy
+	if cfg.Retention != nil {
+		retention = *cfg.Retention
+	}
+
+	policy := prunePolicy{
+		keepLast:            retention.KeepLast,
+		olderThan:           time.Duration(retention.MaxAge),
+		prereleaseOlderThan: time.Duration(retention.PrereleaseMaxAge),
+	}
+	if act.keepLast > 0 {
+		policy.keepLast = act.keepLast
+	}
+	if act.olderThan > 0 {
+		policy.olderThan = act.olderThan
+	}
+	if act.prereleaseOlderThan > 0 {
+		policy.prereleaseOlderThan = act.prereleaseOlderThan
+	}
+
+	if policy.keepLast == 0 && policy.olderThan == 0 && policy.prereleaseOlderThan == 0 {
+		return prunePolicy{}, errors.WithMessage(
+			ErrNoRetentionPolicy,
+			"set --keep-last, --older-than or --prerelease-older-than, or the retention of the repository config",
+		)
+	}
+
+	keep := retention.Keep
+	if len(act.keep) > 0 {
+		keep = strings.Join(act.keep, " || ")
+	}
+	if keep != "" {
+		c, err := semver.NewConstraint(keep)
+		if err != nil {
+			return prunePolicy{}, errors.Wrapf(err, "parse version constraint %q", keep)
+		}
+		policy.keep = c
+	}
+
+	return policy, nil
+}
+
+// planPrune returns the chart versions to delete according to the policy.
+//
+// The latest policy.keepLast versions of every chart and the versions matching
+// policy.keep are always kept. The other versions are deleted if they are
+// older than the policy allows or, if the policy has no age limits, simply
+// because they are not among the latest ones.
+func planPrune(entries []helmutil.IndexEntry, policy prunePolicy, now time.Time) []prunedVersion {
+	type version struct {
+		entry   helmutil.IndexEntry
+		version *semver.Version
+	}
+
+	var names []string
+	versions := make(map[string][]version)
+	for _, entry := range entries {
+		v, err := semver.NewVersion(entry.Version)
+		if err != nil {
+			log.Printf("[WARN] chart %s has invalid version %q, skipping", entry.Name, entry.Version)
+			continue
+		}
+		if _, ok := versions[entry.Name]; !ok {
+			names = append(names, entry.Name)
+		}
+		versions[entry.Name] = append(versions[entry.Name], version{entry: entry, version: v})
+	}
+
+	ageLimited := policy.olderThan > 0 || policy.prereleaseOlderThan > 0
+
+	var plan []prunedVersion
+	for _, name := range names {
+		vs := versions[name]
+		sort.SliceStable(vs, func(i, j int) bool {
+			return vs[i].version.GreaterThan(vs[j].version)
+		})
+
+		for i, v := range vs {
+			if i < policy.keepLast {
+				continue
+			}
+			if policy.keep != nil && policy.keep.Check(v.version) {
+				continue
+			}
+
+			age := now.Sub(v.entry.Created)
+			var reason string
+			switch {
+			case policy.olderThan > 0 && age > policy.olderThan:
+				reason = fmt.Sprintf("older than %s", policy.olderThan)
+			case policy.prereleaseOlderThan > 0 && v.version.Prerelease() != "" && age > policy.prereleaseOlderThan:
+				reason = fmt.Sprintf("prerelease older than %s", policy.prereleaseOlderThan)
+			case !ageLimited:
+				reason = fmt.Sprintf("not among the last %d versions", policy.keepLast)
+			default:
+				continue
+			}
+
+			plan = append(plan, prunedVersion{entry: v.entry, reason: reason})
+		}
+	}
+
+	return plan
+}
+
+// printPrunePlan prints the chart versions to delete to w in the form of a
+// table.
+func printPrunePlan(w io.Writer, plan []prunedVersion) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "CHART\tVERSION\tCREATED\tREASON")
+	for _, p := range plan {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.entry.Name, p.entry.Version, p.entry.Created.Format(time.RFC3339), p.reason)
+	}
+	return tw.Flush()
+}
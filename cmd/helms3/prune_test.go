@@ -0,0 +1,183 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+func TestPlanPrune(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	entry := func(name, version string, age time.Duration) helmutil.IndexEntry {
+		return helmutil.IndexEntry{Name: name, Version: version, Created: now.Add(-age)}
+	}
+	entries := []helmutil.IndexEntry{
+		entry("bar", "0.1.0", 100*day),
+		entry("foo", "1.0.0", 90*day),
+		entry("foo", "1.1.0", 60*day),
+		entry("foo", "2.0.0-rc.1", 40*day),
+		entry("foo", "2.0.0", 30*day),
+		entry("foo", "2.1.0-snapshot", 5*day),
+		entry("foo", "invalid", 100*day),
+	}
+
+	testCases := map[string]struct {
+		policy prunePolicy
+		keep   string
+		expect []string
+	}{
+		"keep last": {
+			policy: prunePolicy{keepLast: 2},
+			expect: []string{"foo 2.0.0-rc.1", "foo 1.1.0", "foo 1.0.0"},
+		},
+		"older than": {
+			policy: prunePolicy{olderThan: 50 * day},
+			expect: []string{"bar 0.1.0", "foo 1.1.0", "foo 1.0.0"},
+		},
+		"older than keeping last": {
+			policy: prunePolicy{olderThan: 50 * day, keepLast: 1},
+			expect: []string{"foo 1.1.0", "foo 1.0.0"},
+		},
+		"prerelease older than": {
+			policy: prunePolicy{prereleaseOlderThan: 10 * day},
+			expect: []string{"foo 2.0.0-rc.1"},
+		},
+		"keep list": {
+			policy: prunePolicy{keepLast: 1},
+			keep:   "~1.0.0 || 2.0.0-rc.1",
+			expect: []string{"foo 2.0.0", "foo 1.1.0"},
+		},
+		"nothing to prune": {
+			policy: prunePolicy{olderThan: 365 * day},
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			if tc.keep != "" {
+				c, err := semver.NewConstraint(tc.keep)
+				require.NoError(t, err)
+				tc.policy.keep = c
+			}
+
+			var pruned []string
+			for _, p := range planPrune(entries, tc.policy, now) {
+				require.NotEmpty(t, p.reason)
+				pruned = append(pruned, p.entry.Name+" "+p.entry.Version)
+			}
+			require.Equal(t, tc.expect, pruned)
+		})
+	}
+}
+
+func TestPruneAction(t *testing.T) {
+	testCases := map[string]struct {
+		config       map[string]string
+		act          pruneAction
+		expectKept   []string
+		expectPruned []string
+		expectCause  error
+	}{
+		"dry run": {
+			act:        pruneAction{keepLast: 1, dryRun: true},
+			expectKept: []string{"1.0.0", "1.1.0", "2.0.0"},
+		},
+		"keep last": {
+			act:          pruneAction{keepLast: 1},
+			expectKept:   []string{"2.0.0"},
+			expectPruned: []string{"1.0.0", "1.1.0"},
+		},
+		"keep list": {
+			act:          pruneAction{keepLast: 1, keep: []string{"1.0.0"}},
+			expectKept:   []string{"1.0.0", "2.0.0"},
+			expectPruned: []string{"1.1.0"},
+		},
+		"policy from config": {
+			config:       map[string]string{"retention.keepLast": "2"},
+			expectKept:   []string{"1.1.0", "2.0.0"},
+			expectPruned: []string{"1.0.0"},
+		},
+		"flags override config": {
+			config:       map[string]string{"retention.keepLast": "2", "retention.keep": "1.0.0"},
+			act:          pruneAction{keepLast: 1, keep: []string{"1.1.0"}},
+			expectKept:   []string{"1.1.0", "2.0.0"},
+			expectPruned: []string{"1.0.0"},
+		},
+		"no policy": {
+			expectKept:  []string{"1.0.0", "1.1.0", "2.0.0"},
+			expectCause: ErrNoRetentionPolicy,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+
+				dir := t.TempDir()
+				push := pushAction{
+					chartPaths: []string{
+						writeTestChart(t, dir, "bar", "1.0.0"),
+						writeTestChart(t, dir, "bar", "1.1.0"),
+						writeTestChart(t, dir, "bar", "2.0.0"),
+					},
+					repoName: testRepoName,
+					lockTTL:  time.Minute,
+				}
+				require.NoError(t, push.Run(context.Background()))
+
+				for key, value := range tc.config {
+					set := configSetAction{repoName: testRepoName, key: key, value: value}
+					require.NoError(t, set.Run(context.Background()))
+				}
+
+				tc.act.repoName = testRepoName
+				tc.act.lockTTL = time.Minute
+				err := tc.act.Run(context.Background())
+				if tc.expectCause != nil {
+					require.Equal(t, tc.expectCause, errors.Cause(err))
+				} else {
+					require.NoError(t, err)
+				}
+
+				idx := repo.index(t)
+				for _, version := range tc.expectKept {
+					require.True(t, idx.Has("bar", version), version)
+					require.True(t, repo.hasFile(t, "bar-"+version+".tgz"), version)
+				}
+				for _, version := range tc.expectPruned {
+					require.False(t, idx.Has("bar", version), version)
+					require.False(t, repo.hasFile(t, "bar-"+version+".tgz"), version)
+				}
+
+				if repo.server != nil && len(tc.expectPruned) > 0 {
+					require.Equal(t, 1, repo.server.Calls("DeleteObjects"))
+				}
+			})
+		}
+	}
+}
@@ -15,14 +15,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
-	"github.com/banzaicloud/helm-s3/internal/awss3"
-	"github.com/banzaicloud/helm-s3/internal/awsutil"
+	"github.com/banzaicloud/helm-s3/internal/backend"
 	"github.com/banzaicloud/helm-s3/internal/helmutil"
 )
 
@@ -34,22 +43,91 @@ var (
 	// ErrForceAndIgnoreIfExists signals that the --force and --ignore-if-exists
 	// flags cannot be used together.
 	ErrForceAndIgnoreIfExists = errors.New("The --force and --ignore-if-exists flags are mutually exclusive and cannot be specified together.")
+
+	// ErrChartNotSigned signals that the chart has no provenance file but the
+	// repository accepts signed charts only.
+	ErrChartNotSigned = errors.New("chart is not signed")
+
+	// ErrSignAndProv signals that the --sign and --prov flags cannot be used
+	// together.
+	ErrSignAndProv = errors.New("The --sign and --prov flags are mutually exclusive and cannot be specified together.")
+)
+
+const (
+	// provenanceSuffix is the suffix of the provenance file of a chart.
+	provenanceSuffix = ".prov"
+
+	// provenanceContentType is the content type of provenance files, which
+	// are clear-signed PGP messages.
+	provenanceContentType = "application/pgp-signature"
 )
 
+// rollbackTimeout is the timeout for deleting the uploaded charts when the
+// push fails.
+const rollbackTimeout = 30 * time.Second
+
 type pushAction struct {
 	// Required parameters.
 
-	chartPath string
-	repoName  string
+	// chartPaths are paths to chart archives, unpackaged chart directories,
+	// directories of chart archives or glob patterns matching them.
+	chartPaths []string
+	repoName   string
 
 	// Optional parameters and flags.
 
 	force          bool
 	dryRun         bool
 	ignoreIfExists bool
-	acl            string
-	contentType    string
-	relative       bool
+	lockTTL        time.Duration
+
+	// acl, contentType and relative default to the repository config if
+	// they are not set.
+	acl         string
+	contentType string
+	relative    *bool
+
+	// concurrency is the number of charts uploaded in parallel.
+	concurrency int
+
+	// version and appVersion override the versions of the charts packaged
+	// from chart directories.
+	version    string
+	appVersion string
+
+	// prov is the path to the provenance file of the pushed chart. By
+	// default, the provenance file next to the chart archive is pushed if
+	// there is any.
+	prov string
+
+	// sign makes push sign the charts with the key from the keyring.
+	sign    bool
+	key     string
+	keyring string
+
+	// requireSignature makes push verify the provenance files of the charts
+	// with the keyring and refuse unsigned charts. It is enforced for
+	// repositories requiring signatures by config regardless of the flag.
+	requireSignature bool
+}
+
+// pushedChart is a chart archive to be pushed to the repository.
+type pushedChart struct {
+	fpath string
+	fname string
+	chart helmutil.Chart
+	hash  string
+
+	// archive is the contents of the chart archive packaged from a chart
+	// directory, nil if the chart was pushed as an archive.
+	archive []byte
+
+	// provenance is the contents of the provenance file of the chart, nil if
+	// the chart is not signed.
+	provenance []byte
+
+	// exists is true if the chart file already exists in the repository.
+	exists bool
 }
 
 func (act pushAction) Run(ctx context.Context) error {
@@ -57,126 +135,436 @@ func (act pushAction) Run(ctx context.Context) error {
 	if act.force && act.ignoreIfExists {
 		return ErrForceAndIgnoreIfExists
 	}
+	if act.sign && act.prov != "" {
+		return ErrSignAndProv
+	}
+	if act.sign && act.key == "" {
+		return errors.New("--key is required to sign charts")
+	}
+
+	fpaths, err := expandChartPaths(act.chartPaths)
+	if err != nil {
+		return err
+	}
+	if act.prov != "" && len(fpaths) > 1 {
+		return errors.New("--prov can only be used when pushing a single chart")
+	}
 
 	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
 	if err != nil {
 		return errors.Wrapf(err, "looking up repository entry %s failed", act.repoName)
 	}
 
-	sess, err := awsutil.Session(awsutil.DynamicBucketRegion(repoEntry.URL()))
+	storage, err := backend.New(repoEntry.URL())
 	if err != nil {
 		return err
 	}
-	storage := awss3.New(sess)
 
-	fpath, err := filepath.Abs(act.chartPath)
+	cfg, err := loadRepoConfig(ctx, storage, repoEntry.URL())
 	if err != nil {
-		return errors.WithMessage(err, "get chart abs path")
+		return err
+	}
+	act.acl = cfg.acl(act.acl)
+	act.contentType = cfg.contentType(act.contentType)
+	if cfg.RequireSignature {
+		act.requireSignature = true
 	}
 
-	dir := filepath.Dir(fpath)
-	fname := filepath.Base(fpath)
-
-	if err := os.Chdir(dir); err != nil {
-		return errors.Wrapf(err, "change dir to %s", dir)
+	if !act.dryRun {
+		unlock, err := lockRepo(ctx, storage, repoEntry.URL(), act.lockTTL)
+		if err != nil {
+			return err
+		}
+		defer unlock()
 	}
 
-	// Load chart, calculate required params like hash,
-	// and upload the chart right away.
+	// Load and validate all charts before uploading any of them, so that an
+	// invalid chart does not leave the batch half pushed.
 
-	chart, err := helmutil.LoadChart(fname)
+	// If cached index exists, the charts are looked up in it first.
+	cachedIndex, err := helmutil.LoadIndex(repoEntry.CacheFile())
 	if err != nil {
-		return err
+		cachedIndex = nil
 	}
 
-	if cachedIndex, err := helmutil.LoadIndex(repoEntry.CacheFile()); err == nil {
-		// If cached index exists, check if the same chart version exists in it.
-		if cachedIndex.Has(chart.Name(), chart.Version()) {
-			if act.ignoreIfExists {
-				return nil
-			}
-			if !act.force {
-				return ErrChartExists
+	var charts []pushedChart
+	loaded := make(map[string]string)
+	for _, fpath := range fpaths {
+		ch, err := act.loadChart(ctx, storage, repoEntry, cachedIndex, fpath)
+		if err != nil {
+			return err
+		}
+		if ch == nil {
+			continue
+		}
+
+		key := ch.chart.Name() + "-" + ch.chart.Version()
+		if other, ok := loaded[key]; ok {
+			return fmt.Errorf("charts %s and %s have the same name and version", other, ch.fname)
+		}
+		loaded[key] = ch.fname
+
+		charts = append(charts, *ch)
+	}
+	if len(charts) == 0 {
+		return nil
+	}
+
+	// Fetch current index, update it and upload it back. The upload is
+	// conditional on the index not being changed since it was fetched,
+	// otherwise the update is retried on top of the fresh index.
+
+	baseURL := repoEntry.URL()
+	if cfg.relative(act.relative) {
+		baseURL = ""
+	}
+	addCharts := func(idx helmutil.Index) error {
+		for _, ch := range charts {
+			if err := idx.AddOrReplace(ch.chart.Metadata().Value(), ch.fname, baseURL, ch.hash); err != nil {
+				return errors.WithMessagef(err, "add/replace chart %s in the index", ch.fname)
 			}
+		}
+		idx.SortEntries()
+		return nil
+	}
 
-			// Fallthrough on --force.
+	if act.dryRun {
+		idx, _, err := fetchIndex(ctx, storage, repoEntry)
+		if err != nil {
+			return err
 		}
+		return addCharts(idx)
 	}
 
-	hash, err := helmutil.DigestFile(fname)
-	if err != nil {
-		return errors.WithMessage(err, "get chart digest")
+	if err := act.uploadCharts(ctx, storage, repoEntry, charts); err != nil {
+		act.rollback(storage, repoEntry, charts)
+		return err
 	}
 
-	fchart, err := os.Open(fname)
+	idx, err := updateIndex(ctx, storage, repoEntry, act.acl, addCharts)
 	if err != nil {
-		return errors.Wrap(err, "open chart file")
+		act.rollback(storage, repoEntry, charts)
+		return err
+	}
+
+	if err := idx.WriteFile(repoEntry.CacheFile(), 0644); err != nil {
+		return errors.WithMessage(err, "update local index")
 	}
 
-	exists, err := storage.Exists(ctx, repoEntry.URL()+"/"+fname)
+	return nil
+}
+
+// loadChart loads the chart archive, or packages the chart directory, and
+// calculates the required params like hash. It returns nil if the chart
+// already exists in the repository and should be skipped.
+func (act pushAction) loadChart(
+	ctx context.Context,
+	storage backend.Storage,
+	repoEntry helmutil.RepoEntry,
+	cachedIndex helmutil.Index,
+	fpath string,
+) (*pushedChart, error) {
+	fname := filepath.Base(fpath)
+
+	fi, err := os.Stat(fpath)
 	if err != nil {
-		return errors.WithMessage(err, "check if chart already exists in the repository")
+		return nil, errors.Wrap(err, "stat chart path")
+	}
+
+	var chart helmutil.Chart
+	var archive []byte
+	if fi.IsDir() {
+		chart, archive, err = helmutil.PackageChart(fpath, act.version, act.appVersion)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "package chart %s", fname)
+		}
+		fname = fmt.Sprintf("%s-%s.tgz", chart.Name(), chart.Version())
+	} else {
+		if act.version != "" || act.appVersion != "" {
+			return nil, fmt.Errorf("cannot override the version of chart archive %s, only chart directories can be versioned", fname)
+		}
+		chart, err = helmutil.LoadChart(fpath)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "load chart %s", fname)
+		}
+	}
+
+	exists := cachedIndex != nil && cachedIndex.Has(chart.Name(), chart.Version())
+	if !exists {
+		exists, err = storage.Exists(ctx, repoEntry.URL()+"/"+fname)
+		if err != nil {
+			return nil, errors.WithMessage(err, "check if chart already exists in the repository")
+		}
 	}
 
 	if exists {
 		if act.ignoreIfExists {
-			return nil
+			return nil, nil
 		}
 		if !act.force {
-			return ErrChartExists
+			if len(act.chartPaths) > 1 {
+				log.Printf("[ERROR] chart %s already exists in the repository", fname)
+			}
+			return nil, ErrChartExists
 		}
 
 		// Fallthrough on --force.
 	}
 
-	if !act.dryRun {
-		chartMetaJSON, err := chart.Metadata().MarshalJSON()
-		if err != nil {
-			return err
+	var hash string
+	if archive != nil {
+		hash, err = helmutil.Digest(bytes.NewReader(archive))
+	} else {
+		hash, err = helmutil.DigestFile(fpath)
+	}
+	if err != nil {
+		return nil, errors.WithMessagef(err, "get digest of chart %s", fname)
+	}
+
+	ch := &pushedChart{
+		fpath:   fpath,
+		fname:   fname,
+		chart:   chart,
+		hash:    hash,
+		archive: archive,
+		exists:  exists,
+	}
+	if ch.provenance, err = act.loadProvenance(*ch); err != nil {
+		return nil, err
+	}
+
+	if act.requireSignature {
+		if err := act.verifyProvenance(*ch); err != nil {
+			return nil, err
 		}
-		if _, err := storage.PutChart(ctx, repoEntry.URL()+"/"+fname, fchart, string(chartMetaJSON), act.acl, hash, act.contentType); err != nil {
-			return errors.WithMessage(err, "upload chart to s3")
+	}
+
+	return ch, nil
+}
+
+// verifyProvenance verifies the chart against its provenance file with the
+// keyring.
+func (act pushAction) verifyProvenance(ch pushedChart) error {
+	if ch.provenance == nil {
+		return errors.WithMessagef(ErrChartNotSigned, "the repository accepts signed charts only, but %s", ch.fname)
+	}
+
+	archive := ch.archive
+	if archive == nil {
+		var err error
+		if archive, err = os.ReadFile(ch.fpath); err != nil {
+			return errors.Wrap(err, "read chart file")
 		}
 	}
 
-	// The gap between index fetching and uploading should be as small as
-	// possible to make the best effort to avoid race conditions.
-	// See https://github.com/hypnoglow/helm-s3/issues/18 for more info.
+	if err := helmutil.VerifyChart(ch.fname, archive, ch.provenance, act.keyring); err != nil {
+		return errors.WithMessagef(err, "verify chart %s", ch.fname)
+	}
+	return nil
+}
 
-	// Fetch current index, update it and upload it back.
+// loadProvenance returns the provenance file of the chart. It signs the chart
+// if requested, otherwise it reads the provenance file given by the flag or
+// the one next to the chart archive. It returns nil if the chart is not
+// signed.
+func (act pushAction) loadProvenance(ch pushedChart) ([]byte, error) {
+	switch {
+	case act.sign:
+		archive := ch.archive
+		if archive == nil {
+			var err error
+			if archive, err = os.ReadFile(ch.fpath); err != nil {
+				return nil, errors.Wrap(err, "read chart file")
+			}
+		}
+		prov, err := helmutil.SignChart(ch.fname, archive, act.keyring, act.key)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "sign chart %s", ch.fname)
+		}
+		return prov, nil
 
-	b, err := storage.FetchRaw(ctx, repoEntry.IndexURL())
-	if err != nil {
-		return errors.WithMessage(err, "fetch current repo index")
+	case act.prov != "":
+		prov, err := os.ReadFile(act.prov)
+		if err != nil {
+			return nil, errors.Wrap(err, "read provenance file")
+		}
+		return prov, nil
+
+	case ch.archive == nil:
+		prov, err := os.ReadFile(ch.fpath + provenanceSuffix)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, nil
+			}
+			return nil, errors.Wrap(err, "read provenance file")
+		}
+		return prov, nil
+
+	default:
+		return nil, nil
 	}
+}
 
-	idx := helmutil.NewIndex()
-	if err := idx.UnmarshalBinary(b); err != nil {
-		return errors.WithMessage(err, "load index from downloaded file")
+// uploadCharts uploads the chart files to the repository in parallel.
+func (act pushAction) uploadCharts(ctx context.Context, storage backend.Storage, repoEntry helmutil.RepoEntry, charts []pushedChart) error {
+	concurrency := act.concurrency
+	if concurrency < 1 {
+		concurrency = 1
 	}
-	baseURL := repoEntry.URL()
-	if act.relative {
-		baseURL = ""
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	errs := make([]error, len(charts))
+	for i := range charts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = act.uploadChart(ctx, storage, repoEntry, charts[i])
+		}(i)
 	}
-	if err := idx.AddOrReplace(chart.Metadata().Value(), fname, baseURL, hash); err != nil {
-		return errors.WithMessage(err, "add/replace chart in the index")
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
-	idx.SortEntries()
+	return nil
+}
 
-	idxReader, err := idx.Reader()
+// uploadChart uploads the chart file to the repository.
+func (act pushAction) uploadChart(ctx context.Context, storage backend.Storage, repoEntry helmutil.RepoEntry, ch pushedChart) error {
+	chartMetaJSON, err := ch.chart.Metadata().MarshalJSON()
 	if err != nil {
-		return errors.WithMessage(err, "get index reader")
+		return err
 	}
 
-	if !act.dryRun {
-		if err := storage.PutIndex(ctx, repoEntry.URL(), act.acl, idxReader); err != nil {
-			return errors.WithMessage(err, "upload index to s3")
+	var r io.Reader
+	if ch.archive != nil {
+		r = bytes.NewReader(ch.archive)
+	} else {
+		fchart, err := os.Open(ch.fpath)
+		if err != nil {
+			return errors.Wrap(err, "open chart file")
 		}
+		defer fchart.Close()
+		r = fchart
+	}
 
-		if err := idx.WriteFile(repoEntry.CacheFile(), 0644); err != nil {
-			return errors.WithMessage(err, "update local index")
+	chartURL := repoEntry.URL() + "/" + ch.fname
+	if _, err := storage.PutChart(ctx, chartURL, r, string(chartMetaJSON), act.acl, ch.hash, act.contentType); err != nil {
+		return errors.WithMessagef(err, "upload chart %s to s3", ch.fname)
+	}
+
+	if ch.provenance == nil {
+		if ch.exists {
+			return deleteStaleProvenance(ctx, storage, chartURL)
 		}
+		return nil
 	}
 
+	if err := storage.PutRaw(ctx, chartURL+provenanceSuffix, bytes.NewReader(ch.provenance), act.acl, provenanceContentType); err != nil {
+		return errors.WithMessagef(err, "upload provenance file of chart %s to s3", ch.fname)
+	}
 	return nil
 }
+
+// deleteStaleProvenance deletes the provenance file of the chart replaced by
+// one without a provenance file, as it would not match the chart anymore.
+func deleteStaleProvenance(ctx context.Context, storage backend.Storage, chartURL string) error {
+	err := storage.Delete(ctx, chartURL+provenanceSuffix)
+	return errors.WithMessagef(err, "delete stale provenance file of chart %s", path.Base(chartURL))
+}
+
+// rollback deletes the chart files of the batch that did not exist in the
+// repository before the push. Replaced chart files cannot be restored.
+func (act pushAction) rollback(storage backend.Storage, repoEntry helmutil.RepoEntry, charts []pushedChart) {
+	// The context of the push might be already done.
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	for _, ch := range charts {
+		if ch.exists {
+			continue
+		}
+		chartURL := repoEntry.URL() + "/" + ch.fname
+		for _, uri := range []string{chartURL, chartURL + provenanceSuffix} {
+			if err := storage.Delete(ctx, uri); err != nil {
+				log.Printf("[ERROR] failed to roll back the upload of chart %s: %s", ch.fname, err)
+			}
+		}
+	}
+}
+
+// expandChartPaths returns the absolute paths of the chart archives and
+// chart directories given by paths, directories of chart archives or glob
+// patterns.
+func expandChartPaths(paths []string) ([]string, error) {
+	var fpaths []string
+	seen := make(map[string]bool)
+	add := func(fpath string) error {
+		abs, err := filepath.Abs(fpath)
+		if err != nil {
+			return errors.WithMessage(err, "get chart abs path")
+		}
+		if !seen[abs] {
+			seen[abs] = true
+			fpaths = append(fpaths, abs)
+		}
+		return nil
+	}
+
+	for _, p := range paths {
+		// Shells expand glob patterns, but quoted patterns are passed as is.
+		if strings.ContainsAny(p, "*?[") {
+			matches, err := filepath.Glob(p)
+			if err != nil {
+				return nil, errors.Wrapf(err, "match charts by pattern %s", p)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no charts match pattern %s", p)
+			}
+			for _, m := range matches {
+				if err := add(m); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "stat chart path")
+		}
+		if !fi.IsDir() || isChartDir(p) {
+			if err := add(p); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		matches, err := filepath.Glob(filepath.Join(p, "*.tgz"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "list charts in directory %s", p)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no charts found in directory %s", p)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			if err := add(m); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return fpaths, nil
+}
+
+// isChartDir returns true if the directory is an unpackaged chart.
+func isChartDir(dir string) bool {
+	fi, err := os.Stat(filepath.Join(dir, "Chart.yaml"))
+	return err == nil && !fi.IsDir()
+}
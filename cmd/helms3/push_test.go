@@ -0,0 +1,593 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/s3test"
+)
+
+func TestPushAction(t *testing.T) {
+	for backendName, setup := range testBackends {
+		setup := setup
+		t.Run(backendName, func(t *testing.T) {
+			repo := setup(t)
+
+			act := pushAction{
+				chartPaths: []string{testChartPath},
+				repoName:   testRepoName,
+				lockTTL:    time.Minute,
+			}
+			require.NoError(t, act.Run(context.Background()))
+
+			require.True(t, repo.hasFile(t, "foo-1.2.3.tgz"))
+			require.False(t, repo.hasFile(t, ".helm-s3.lock"))
+			require.True(t, repo.index(t).Has(testChartName, testChartVersion))
+		})
+	}
+}
+
+func TestPushAction_Exists(t *testing.T) {
+	testCases := map[string]struct {
+		act         pushAction
+		expectedErr error
+	}{
+		"no flags": {
+			act:         pushAction{},
+			expectedErr: ErrChartExists,
+		},
+		"ignore if exists": {
+			act:         pushAction{ignoreIfExists: true},
+			expectedErr: nil,
+		},
+		"force": {
+			act:         pushAction{force: true},
+			expectedErr: nil,
+		},
+		"force and ignore if exists": {
+			act:         pushAction{force: true, ignoreIfExists: true},
+			expectedErr: ErrForceAndIgnoreIfExists,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+
+				first := pushAction{chartPaths: []string{testChartPath}, repoName: testRepoName}
+				require.NoError(t, first.Run(context.Background()))
+
+				tc.act.chartPaths = []string{testChartPath}
+				tc.act.repoName = testRepoName
+				require.Equal(t, tc.expectedErr, tc.act.Run(context.Background()))
+
+				require.True(t, repo.index(t).Has(testChartName, testChartVersion))
+			})
+		}
+	}
+}
+
+func TestPushAction_DryRun(t *testing.T) {
+	for backendName, setup := range testBackends {
+		setup := setup
+		t.Run(backendName, func(t *testing.T) {
+			repo := setup(t)
+
+			act := pushAction{
+				chartPaths: []string{testChartPath},
+				repoName:   testRepoName,
+				dryRun:     true,
+			}
+			require.NoError(t, act.Run(context.Background()))
+
+			require.False(t, repo.hasFile(t, "foo-1.2.3.tgz"))
+			require.False(t, repo.index(t).Has(testChartName, testChartVersion))
+		})
+	}
+}
+
+func TestPushAction_S3Failures(t *testing.T) {
+	testCases := map[string]struct {
+		failure       s3test.Failure
+		expectError   bool
+		expectInIndex bool
+	}{
+		"chart upload denied": {
+			failure:       s3test.Failure{Op: "PutObject", Key: "charts/foo-1.2.3.tgz", StatusCode: http.StatusForbidden, Code: "AccessDenied"},
+			expectError:   true,
+			expectInIndex: false,
+		},
+		"index upload denied": {
+			failure:       s3test.Failure{Op: "PutObject", Key: "charts/index.yaml", StatusCode: http.StatusForbidden, Code: "AccessDenied"},
+			expectError:   true,
+			expectInIndex: false,
+		},
+		"index modified concurrently once": {
+			failure:       s3test.Failure{Op: "PutObject", Key: "charts/index.yaml", StatusCode: http.StatusPreconditionFailed, Code: "PreconditionFailed", Times: 1},
+			expectError:   false,
+			expectInIndex: true,
+		},
+		"transient server error": {
+			failure:       s3test.Failure{Op: "HeadObject", Key: "charts/foo-1.2.3.tgz", StatusCode: http.StatusInternalServerError, Code: "InternalError", Times: 1},
+			expectError:   false,
+			expectInIndex: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			repo := setupS3Repo(t)
+			repo.server.InjectFailure(tc.failure)
+
+			act := pushAction{
+				chartPaths: []string{testChartPath},
+				repoName:   testRepoName,
+				lockTTL:    time.Minute,
+			}
+			err := act.Run(context.Background())
+			if tc.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.Equal(t, tc.expectInIndex, repo.index(t).Has(testChartName, testChartVersion))
+			// Charts that did not make it to the index are rolled back.
+			require.Equal(t, tc.expectInIndex, repo.hasFile(t, "foo-1.2.3.tgz"))
+			require.False(t, repo.hasFile(t, ".helm-s3.lock"))
+		})
+	}
+}
+
+func TestPushAction_Batch(t *testing.T) {
+	testCases := map[string]struct {
+		chartPaths func(dir string) []string
+	}{
+		"directory": {
+			chartPaths: func(dir string) []string { return []string{dir} },
+		},
+		"glob pattern": {
+			chartPaths: func(dir string) []string { return []string{filepath.Join(dir, "*.tgz")} },
+		},
+		"multiple paths": {
+			chartPaths: func(dir string) []string {
+				return []string{
+					filepath.Join(dir, "bar-0.1.0.tgz"),
+					filepath.Join(dir, "baz-0.2.0.tgz"),
+					filepath.Join(dir, "foo-2.0.0.tgz"),
+				}
+			},
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+
+				dir := t.TempDir()
+				writeTestChart(t, dir, "bar", "0.1.0")
+				writeTestChart(t, dir, "baz", "0.2.0")
+				writeTestChart(t, dir, "foo", "2.0.0")
+
+				var indexPuts int
+				if repo.server != nil {
+					indexPuts = repo.server.KeyCalls("PutObject", "charts/index.yaml")
+				}
+
+				act := pushAction{
+					chartPaths:  tc.chartPaths(dir),
+					repoName:    testRepoName,
+					lockTTL:     time.Minute,
+					concurrency: 2,
+				}
+				require.NoError(t, act.Run(context.Background()))
+
+				idx := repo.index(t)
+				for _, chart := range [][2]string{{"bar", "0.1.0"}, {"baz", "0.2.0"}, {"foo", "2.0.0"}} {
+					require.True(t, repo.hasFile(t, chart[0]+"-"+chart[1]+".tgz"))
+					require.True(t, idx.Has(chart[0], chart[1]))
+				}
+
+				// The index is written once for the whole batch.
+				if repo.server != nil {
+					require.Equal(t, indexPuts+1, repo.server.KeyCalls("PutObject", "charts/index.yaml"))
+				}
+			})
+		}
+	}
+}
+
+func TestPushAction_BatchRollback(t *testing.T) {
+	testCases := map[string]struct {
+		setup       func(t *testing.T, dir string)
+		expectedErr error
+	}{
+		"invalid chart": {
+			setup: func(t *testing.T, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "broken-1.0.0.tgz"), []byte("not a chart"), 0644))
+			},
+		},
+		"existing chart": {
+			setup: func(t *testing.T, dir string) {
+				push := pushAction{chartPaths: []string{testChartPath}, repoName: testRepoName}
+				require.NoError(t, push.Run(context.Background()))
+
+				b, err := os.ReadFile(testChartPath)
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "foo-1.2.3.tgz"), b, 0644))
+			},
+			expectedErr: ErrChartExists,
+		},
+		"duplicate version": {
+			setup: func(t *testing.T, dir string) {
+				b, err := os.ReadFile(filepath.Join(dir, "bar-0.1.0.tgz"))
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "bar-copy.tgz"), b, 0644))
+			},
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+
+				dir := t.TempDir()
+				writeTestChart(t, dir, "bar", "0.1.0")
+				tc.setup(t, dir)
+
+				act := pushAction{
+					chartPaths: []string{dir},
+					repoName:   testRepoName,
+					lockTTL:    time.Minute,
+				}
+				err := act.Run(context.Background())
+				require.Error(t, err)
+				if tc.expectedErr != nil {
+					require.Equal(t, tc.expectedErr, err)
+				}
+
+				require.False(t, repo.hasFile(t, "bar-0.1.0.tgz"))
+				require.False(t, repo.index(t).Has("bar", "0.1.0"))
+			})
+		}
+	}
+}
+
+func TestPushAction_BatchUploadFailure(t *testing.T) {
+	repo := setupS3Repo(t)
+	repo.server.InjectFailure(s3test.Failure{Op: "PutObject", Key: "charts/baz-0.2.0.tgz", StatusCode: http.StatusForbidden, Code: "AccessDenied"})
+
+	dir := t.TempDir()
+	writeTestChart(t, dir, "bar", "0.1.0")
+	writeTestChart(t, dir, "baz", "0.2.0")
+
+	act := pushAction{
+		chartPaths: []string{dir},
+		repoName:   testRepoName,
+		lockTTL:    time.Minute,
+	}
+	require.Error(t, act.Run(context.Background()))
+
+	require.False(t, repo.hasFile(t, "bar-0.1.0.tgz"))
+	require.False(t, repo.hasFile(t, "baz-0.2.0.tgz"))
+	require.Empty(t, repo.index(t).Entries())
+}
+
+func TestPushAction_ChartDirectory(t *testing.T) {
+	chartDir := mustAbs("../../test/e2e/data/foo")
+
+	testCases := map[string]struct {
+		act              pushAction
+		expectFile       string
+		expectVersion    string
+		expectAppVersion string
+		expectError      bool
+	}{
+		"no overrides": {
+			act:              pushAction{chartPaths: []string{chartDir}},
+			expectFile:       "foo-0.1.0.tgz",
+			expectVersion:    "0.1.0",
+			expectAppVersion: "1.0",
+		},
+		"version override": {
+			act:              pushAction{chartPaths: []string{chartDir}, version: "1.0.0-rc.1"},
+			expectFile:       "foo-1.0.0-rc.1.tgz",
+			expectVersion:    "1.0.0-rc.1",
+			expectAppVersion: "1.0",
+		},
+		"version and app version override": {
+			act:              pushAction{chartPaths: []string{chartDir}, version: "2.0.0", appVersion: "2.1"},
+			expectFile:       "foo-2.0.0.tgz",
+			expectVersion:    "2.0.0",
+			expectAppVersion: "2.1",
+		},
+		"version override of chart archive": {
+			act:         pushAction{chartPaths: []string{testChartPath}, version: "2.0.0"},
+			expectError: true,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+
+				tc.act.repoName = testRepoName
+				tc.act.lockTTL = time.Minute
+				err := tc.act.Run(context.Background())
+				if tc.expectError {
+					require.Error(t, err)
+					require.Empty(t, repo.index(t).Entries())
+					return
+				}
+				require.NoError(t, err)
+
+				require.True(t, repo.hasFile(t, tc.expectFile))
+
+				entries := repo.index(t).Entries()
+				require.Len(t, entries, 1)
+				require.Equal(t, "foo", entries[0].Name)
+				require.Equal(t, tc.expectVersion, entries[0].Version)
+				require.Equal(t, tc.expectAppVersion, entries[0].AppVersion)
+			})
+		}
+	}
+}
+
+func TestPushAction_Provenance(t *testing.T) {
+	testCases := map[string]struct {
+		setup       func(t *testing.T, dir string) pushAction
+		expectProv  string
+		expectError error
+	}{
+		"no provenance file": {
+			setup: func(t *testing.T, dir string) pushAction {
+				return pushAction{}
+			},
+		},
+		"provenance file next to the chart": {
+			setup: func(t *testing.T, dir string) pushAction {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "foo-1.2.3.tgz.prov"), []byte("sibling"), 0644))
+				return pushAction{}
+			},
+			expectProv: "sibling",
+		},
+		"provenance file by flag": {
+			setup: func(t *testing.T, dir string) pushAction {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "foo-1.2.3.tgz.prov"), []byte("sibling"), 0644))
+				fpath := filepath.Join(t.TempDir(), "signature")
+				require.NoError(t, os.WriteFile(fpath, []byte("flag"), 0644))
+				return pushAction{prov: fpath}
+			},
+			expectProv: "flag",
+		},
+		"sign": {
+			setup: func(t *testing.T, dir string) pushAction {
+				return pushAction{sign: true, key: testKeyName, keyring: testKeyring}
+			},
+			expectProv: "foo-1.2.3.tgz: sha256:",
+		},
+		"sign without key": {
+			setup: func(t *testing.T, dir string) pushAction {
+				return pushAction{sign: true, keyring: testKeyring}
+			},
+			expectError: errors.New("--key is required to sign charts"),
+		},
+		"sign and provenance file by flag": {
+			setup: func(t *testing.T, dir string) pushAction {
+				return pushAction{sign: true, key: testKeyName, keyring: testKeyring, prov: testProvPath(t)}
+			},
+			expectError: ErrSignAndProv,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+
+				dir := t.TempDir()
+				b, err := os.ReadFile(testChartPath)
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "foo-1.2.3.tgz"), b, 0644))
+
+				act := tc.setup(t, dir)
+				act.chartPaths = []string{filepath.Join(dir, "foo-1.2.3.tgz")}
+				act.repoName = testRepoName
+				act.lockTTL = time.Minute
+				err = act.Run(context.Background())
+				if tc.expectError != nil {
+					require.EqualError(t, err, tc.expectError.Error())
+					require.False(t, repo.hasFile(t, "foo-1.2.3.tgz"))
+					return
+				}
+				require.NoError(t, err)
+
+				require.True(t, repo.hasFile(t, "foo-1.2.3.tgz"))
+				if tc.expectProv == "" {
+					require.False(t, repo.hasFile(t, "foo-1.2.3.tgz.prov"))
+					return
+				}
+				require.Contains(t, string(repo.file(t, "foo-1.2.3.tgz.prov")), tc.expectProv)
+			})
+		}
+	}
+}
+
+func TestPushAction_ForceRemovesStaleProvenance(t *testing.T) {
+	for backendName, setup := range testBackends {
+		setup := setup
+		t.Run(backendName, func(t *testing.T) {
+			repo := setup(t)
+
+			signed := pushAction{chartPaths: []string{testChartPath}, repoName: testRepoName, prov: testProvPath(t)}
+			require.NoError(t, signed.Run(context.Background()))
+			require.True(t, repo.hasFile(t, "foo-1.2.3.tgz.prov"))
+
+			unsigned := pushAction{chartPaths: []string{testChartPath}, repoName: testRepoName, force: true}
+			require.NoError(t, unsigned.Run(context.Background()))
+			require.False(t, repo.hasFile(t, "foo-1.2.3.tgz.prov"))
+		})
+	}
+}
+
+func TestPushAction_RequireSignature(t *testing.T) {
+	testCases := map[string]struct {
+		act              pushAction
+		requireByConfig  bool
+		expectedErrCause error
+		expectError      bool
+	}{
+		"signed chart": {
+			act: pushAction{requireSignature: true, sign: true, key: testKeyName, keyring: testKeyring},
+		},
+		"unsigned chart": {
+			act:              pushAction{requireSignature: true, keyring: testPublicKeyring},
+			expectedErrCause: ErrChartNotSigned,
+		},
+		"tampered provenance file": {
+			act:         pushAction{requireSignature: true, keyring: testPublicKeyring, prov: testProvPath(t)},
+			expectError: true,
+		},
+		"unsigned chart without requirement": {
+			act: pushAction{keyring: testPublicKeyring},
+		},
+		"unsigned chart required by config": {
+			act:              pushAction{keyring: testPublicKeyring},
+			requireByConfig:  true,
+			expectedErrCause: ErrChartNotSigned,
+		},
+		"signed chart required by config": {
+			act:             pushAction{sign: true, key: testKeyName, keyring: testKeyring},
+			requireByConfig: true,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+
+				if tc.requireByConfig {
+					set := configSetAction{repoName: testRepoName, key: "requireSignature", value: "true"}
+					require.NoError(t, set.Run(context.Background()))
+				}
+
+				tc.act.chartPaths = []string{testChartPath}
+				tc.act.repoName = testRepoName
+				tc.act.lockTTL = time.Minute
+				err := tc.act.Run(context.Background())
+				switch {
+				case tc.expectedErrCause != nil:
+					require.Equal(t, tc.expectedErrCause, errors.Cause(err))
+				case tc.expectError:
+					require.Error(t, err)
+				default:
+					require.NoError(t, err)
+					require.True(t, repo.index(t).Has(testChartName, testChartVersion))
+					return
+				}
+
+				require.False(t, repo.hasFile(t, "foo-1.2.3.tgz"))
+				require.False(t, repo.index(t).Has(testChartName, testChartVersion))
+			})
+		}
+	}
+}
+
+func TestPushAction_RepoConfigDefaults(t *testing.T) {
+	testCases := map[string]struct {
+		config            map[string]string
+		act               pushAction
+		expectRelative    bool
+		expectContentType string
+	}{
+		"no config": {
+			expectContentType: defaultChartsContentType,
+		},
+		"relative by config": {
+			config:            map[string]string{"relative": "true"},
+			expectRelative:    true,
+			expectContentType: defaultChartsContentType,
+		},
+		"flag overrides relative": {
+			config:            map[string]string{"relative": "true"},
+			act:               pushAction{relative: boolPtr(false)},
+			expectContentType: defaultChartsContentType,
+		},
+		"content type by config": {
+			config:            map[string]string{"contentType": "application/x-tar"},
+			expectContentType: "application/x-tar",
+		},
+		"flag overrides content type": {
+			config:            map[string]string{"contentType": "application/x-tar"},
+			act:               pushAction{contentType: "application/octet-stream"},
+			expectContentType: "application/octet-stream",
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+
+				for key, value := range tc.config {
+					set := configSetAction{repoName: testRepoName, key: key, value: value}
+					require.NoError(t, set.Run(context.Background()))
+				}
+
+				tc.act.chartPaths = []string{testChartPath}
+				tc.act.repoName = testRepoName
+				tc.act.lockTTL = time.Minute
+				require.NoError(t, tc.act.Run(context.Background()))
+
+				entries := repo.index(t).Entries()
+				require.Len(t, entries, 1)
+				require.Len(t, entries[0].URLs, 1)
+				expectURL := repo.uri + "/foo-1.2.3.tgz"
+				if tc.expectRelative {
+					expectURL = "foo-1.2.3.tgz"
+				}
+				require.Equal(t, expectURL, entries[0].URLs[0])
+
+				if repo.server != nil {
+					obj, ok := repo.server.Object("test-bucket", "charts/foo-1.2.3.tgz")
+					require.True(t, ok)
+					require.Equal(t, tc.expectContentType, obj.ContentType)
+				}
+			})
+		}
+	}
+}
@@ -17,18 +17,38 @@ package main
 import (
 	"context"
 	"log"
+	"path"
+	"time"
 
 	"github.com/pkg/errors"
 
-	"github.com/banzaicloud/helm-s3/internal/awss3"
-	"github.com/banzaicloud/helm-s3/internal/awsutil"
+	"github.com/banzaicloud/helm-s3/internal/backend"
 	"github.com/banzaicloud/helm-s3/internal/helmutil"
 )
 
 type reindexAction struct {
 	repoName string
+	lockTTL  time.Duration
+
+	// acl and relative default to the repository config if they are not
+	// set.
 	acl      string
-	relative bool
+	relative *bool
+
+	// concurrency is the number of charts processed in parallel.
+	concurrency int
+
+	// incremental makes reindex update the current index instead of
+	// rebuilding it, processing only the charts that changed since they were
+	// indexed.
+	incremental bool
+}
+
+// reindexStats are the statistics of an incremental reindex.
+type reindexStats struct {
+	updated   int
+	removed   int
+	unchanged int
 }
 
 func (act reindexAction) Run(ctx context.Context) error {
@@ -37,44 +57,101 @@ func (act reindexAction) Run(ctx context.Context) error {
 		return err
 	}
 
-	sess, err := awsutil.Session(awsutil.DynamicBucketRegion(repoEntry.URL()))
+	storage, err := backend.New(repoEntry.URL())
 	if err != nil {
 		return err
 	}
-	storage := awss3.New(sess)
 
-	items, errs := storage.Traverse(ctx, repoEntry.URL())
+	cfg, err := loadRepoConfig(ctx, storage, repoEntry.URL())
+	if err != nil {
+		return err
+	}
+	act.acl = cfg.acl(act.acl)
+
+	unlock, err := lockRepo(ctx, storage, repoEntry.URL(), act.lockTTL)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	baseURL := repoEntry.URL()
+	if cfg.relative(act.relative) {
+		baseURL = ""
+	}
+
+	opts := backend.TraverseOptions{Concurrency: act.concurrency}
 
-	builtIndex := make(chan helmutil.Index, 1)
+	// Index entries of the current index keyed by the chart file name.
+	var indexed map[string][]helmutil.IndexEntry
+	if act.incremental {
+		idx, _, err := fetchIndex(ctx, storage, repoEntry)
+		if err != nil {
+			return err
+		}
+		indexed = indexedFiles(idx)
+
+		// The chart file is considered unchanged if it has not been modified
+		// since its index entry was created, which the listing tells without
+		// requesting the chart metadata. Modified chart files are still
+		// unchanged if the digest recorded in their metadata is the digest
+		// of their index entry, e.g. if the same chart was pushed again.
+		opts.NotModified = func(filename string, modified time.Time) bool {
+			entries := indexed[filename]
+			return len(entries) == 1 && !modified.After(entries[0].Created)
+		}
+		opts.Unchanged = func(filename, digest string) bool {
+			entries := indexed[filename]
+			return len(entries) == 1 && entries[0].Digest == digest
+		}
+	}
+
+	items, errs := storage.Traverse(ctx, repoEntry.URL(), opts)
+
+	traversed := make(chan []backend.ChartInfo, 1)
 	go func() {
-		idx := helmutil.NewIndex()
+		var charts []backend.ChartInfo
 		for item := range items {
-			baseURL := repoEntry.URL()
-			if act.relative {
-				baseURL = ""
-			}
-			if err := idx.Add(item.Meta.Value(), item.Filename, baseURL, item.Hash); err != nil {
-				log.Printf("[ERROR] failed to add chart to the index: %s", err)
-			}
+			charts = append(charts, item)
 		}
-		idx.SortEntries()
-
-		builtIndex <- idx
+		traversed <- charts
 	}()
 
 	for err = range errs {
 		return errors.Wrap(err, "traverse the chart repository")
 	}
 
-	idx := <-builtIndex
-
-	r, err := idx.Reader()
-	if err != nil {
-		return errors.Wrap(err, "get index reader")
-	}
+	charts := <-traversed
+
+	var idx helmutil.Index
+	if act.incremental {
+		var stats reindexStats
+		idx, err = updateIndex(ctx, storage, repoEntry, act.acl, func(idx helmutil.Index) error {
+			stats = act.applyChanges(idx, indexed, charts, baseURL)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf(
+			"[INFO] %d charts added or updated, %d removed, %d unchanged",
+			stats.updated, stats.removed, stats.unchanged,
+		)
+	} else {
+		idx = helmutil.NewIndex()
+		for _, item := range charts {
+			if err := idx.Add(item.Meta.Value(), item.Filename, baseURL, item.Hash); err != nil {
+				log.Printf("[ERROR] failed to add chart to the index: %s", err)
+			}
+		}
+		idx.SortEntries()
 
-	if err := storage.PutIndex(ctx, repoEntry.URL(), act.acl, r); err != nil {
-		return errors.Wrap(err, "upload index to the repository")
+		r, err := idx.Reader()
+		if err != nil {
+			return errors.Wrap(err, "get index reader")
+		}
+		if err := storage.PutIndex(ctx, repoEntry.URL(), act.acl, r); err != nil {
+			return errors.WithMessage(err, "upload index to the repository")
+		}
 	}
 
 	if err := idx.WriteFile(repoEntry.CacheFile(), 0644); err != nil {
@@ -83,3 +160,63 @@ func (act reindexAction) Run(ctx context.Context) error {
 
 	return nil
 }
+
+// applyChanges updates the index with the traversed charts. The entries of the
+// changed chart files are replaced, and the entries of the chart files
+// indexed before the traversal that vanished since are removed. It is applied
+// to a freshly fetched index on every index update attempt.
+func (act reindexAction) applyChanges(idx helmutil.Index, indexed map[string][]helmutil.IndexEntry, charts []backend.ChartInfo, baseURL string) reindexStats {
+	var stats reindexStats
+	current := indexedFiles(idx)
+	seen := make(map[string]bool)
+	for _, item := range charts {
+		seen[item.Filename] = true
+		if item.Unchanged {
+			stats.unchanged++
+			continue
+		}
+
+		// The chart file might have been replaced by another chart version,
+		// so drop whatever it provided before.
+		for _, entry := range current[item.Filename] {
+			if _, err := idx.Delete(entry.Name, entry.Version); err != nil {
+				log.Printf("[ERROR] failed to remove chart from the index: %s", err)
+			}
+		}
+
+		if err := idx.Add(item.Meta.Value(), item.Filename, baseURL, item.Hash); err != nil {
+			log.Printf("[ERROR] failed to add chart to the index: %s", err)
+			continue
+		}
+		stats.updated++
+	}
+
+	// Drop the entries of the chart files that vanished.
+	for filename := range indexed {
+		if seen[filename] {
+			continue
+		}
+		for _, entry := range current[filename] {
+			if _, err := idx.Delete(entry.Name, entry.Version); err != nil {
+				log.Printf("[ERROR] failed to remove chart from the index: %s", err)
+			}
+			stats.removed++
+		}
+	}
+
+	idx.SortEntries()
+	return stats
+}
+
+// indexedFiles returns the entries of the index keyed by the chart file name.
+func indexedFiles(idx helmutil.Index) map[string][]helmutil.IndexEntry {
+	indexed := make(map[string][]helmutil.IndexEntry)
+	for _, entry := range idx.Entries() {
+		if len(entry.URLs) == 0 {
+			continue
+		}
+		filename := path.Base(entry.URLs[0])
+		indexed[filename] = append(indexed[filename], entry)
+	}
+	return indexed
+}
@@ -0,0 +1,229 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+	"github.com/banzaicloud/helm-s3/internal/s3test"
+)
+
+func TestReindexAction(t *testing.T) {
+	testCases := map[string]struct {
+		setup func(t *testing.T, repo testRepo)
+	}{
+		"chart pushed by the plugin": {
+			setup: func(t *testing.T, repo testRepo) {
+				push := pushAction{chartPaths: []string{testChartPath}, repoName: testRepoName}
+				require.NoError(t, push.Run(context.Background()))
+
+				// Wipe the index.
+				require.NoError(t, initAction{uri: repo.uri}.Run(context.Background()))
+			},
+		},
+		"chart copied without metadata": {
+			setup: func(t *testing.T, repo testRepo) {
+				b, err := os.ReadFile(testChartPath)
+				require.NoError(t, err)
+				repo.putFile(t, "foo-1.2.3.tgz", b)
+			},
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+				tc.setup(t, repo)
+				require.False(t, repo.index(t).Has(testChartName, testChartVersion))
+
+				act := reindexAction{
+					repoName: testRepoName,
+					lockTTL:  time.Minute,
+				}
+				require.NoError(t, act.Run(context.Background()))
+
+				require.True(t, repo.index(t).Has(testChartName, testChartVersion))
+			})
+		}
+	}
+}
+
+func TestReindexAction_Incremental(t *testing.T) {
+	testCases := map[string]struct {
+		setup         func(t *testing.T, repo testRepo)
+		expectInIndex bool
+		expectKept    bool
+	}{
+		"unchanged chart": {
+			setup: func(t *testing.T, repo testRepo) {
+				push := pushAction{chartPaths: []string{testChartPath}, repoName: testRepoName}
+				require.NoError(t, push.Run(context.Background()))
+			},
+			expectInIndex: true,
+			expectKept:    true,
+		},
+		"new chart": {
+			setup: func(t *testing.T, repo testRepo) {
+				b, err := os.ReadFile(testChartPath)
+				require.NoError(t, err)
+				repo.putFile(t, "foo-1.2.3.tgz", b)
+			},
+			expectInIndex: true,
+		},
+		"replaced chart": {
+			setup: func(t *testing.T, repo testRepo) {
+				push := pushAction{chartPaths: []string{testChartPath}, repoName: testRepoName}
+				require.NoError(t, push.Run(context.Background()))
+
+				// The chart file is replaced by another archive of the same
+				// chart version by other tools.
+				b, err := os.ReadFile(writeTestChart(t, t.TempDir(), testChartName, testChartVersion))
+				require.NoError(t, err)
+				repo.putFile(t, "foo-1.2.3.tgz", b)
+				// The listing has a precision of a second, so make sure the
+				// chart file is modified after it was indexed.
+				repo.touchFile(t, "foo-1.2.3.tgz", time.Now().Add(time.Minute))
+				if repo.server == nil {
+					require.NoError(t, os.Remove(filepath.Join(repo.dir, "foo-1.2.3.tgz.meta.json")))
+				}
+			},
+			expectInIndex: true,
+		},
+		"vanished chart": {
+			setup: func(t *testing.T, repo testRepo) {
+				push := pushAction{chartPaths: []string{testChartPath}, repoName: testRepoName}
+				require.NoError(t, push.Run(context.Background()))
+				repo.removeFile(t, "foo-1.2.3.tgz")
+			},
+			expectInIndex: false,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+				tc.setup(t, repo)
+				before := repo.index(t)
+
+				act := reindexAction{
+					repoName:    testRepoName,
+					lockTTL:     time.Minute,
+					incremental: true,
+				}
+				require.NoError(t, act.Run(context.Background()))
+
+				idx := repo.index(t)
+				require.Equal(t, tc.expectInIndex, idx.Has(testChartName, testChartVersion))
+				if !tc.expectInIndex {
+					return
+				}
+
+				digest, err := helmutil.Digest(bytes.NewReader(repo.file(t, "foo-1.2.3.tgz")))
+				require.NoError(t, err)
+				entry := indexEntry(t, idx, testChartName, testChartVersion)
+				require.Equal(t, digest, entry.Digest)
+
+				// Unchanged entries are kept as they were.
+				if tc.expectKept {
+					require.Equal(t, indexEntry(t, before, testChartName, testChartVersion), entry)
+				}
+			})
+		}
+	}
+}
+
+func TestReindexAction_IncrementalConflict(t *testing.T) {
+	backoff := indexUpdateBackoff
+	indexUpdateBackoff = time.Millisecond
+	t.Cleanup(func() { indexUpdateBackoff = backoff })
+
+	repo := setupS3Repo(t)
+	b, err := os.ReadFile(testChartPath)
+	require.NoError(t, err)
+	repo.putFile(t, "foo-1.2.3.tgz", b)
+
+	// The index is modified by someone else once before the reindex uploads
+	// it.
+	repo.server.InjectFailure(s3test.Failure{Op: "PutObject", Key: "charts/index.yaml", StatusCode: http.StatusPreconditionFailed, Code: "PreconditionFailed", Times: 1})
+	puts := repo.server.KeyCalls("PutObject", "charts/index.yaml")
+
+	act := reindexAction{
+		repoName:    testRepoName,
+		lockTTL:     time.Minute,
+		incremental: true,
+	}
+	require.NoError(t, act.Run(context.Background()))
+
+	require.Equal(t, puts+2, repo.server.KeyCalls("PutObject", "charts/index.yaml"))
+	require.True(t, repo.index(t).Has(testChartName, testChartVersion))
+}
+
+func TestReindexAction_IncrementalRequests(t *testing.T) {
+	repo := setupS3Repo(t)
+
+	dir := t.TempDir()
+	push := pushAction{
+		chartPaths: []string{writeTestChart(t, dir, "foo", "1.0.0"), writeTestChart(t, dir, "bar", "1.0.0"), writeTestChart(t, dir, "baz", "1.0.0")},
+		repoName:   testRepoName,
+	}
+	require.NoError(t, push.Run(context.Background()))
+
+	// Bar is replaced and qux is added by other tools.
+	b, err := os.ReadFile(writeTestChart(t, t.TempDir(), "bar", "1.0.0"))
+	require.NoError(t, err)
+	repo.putFile(t, "bar-1.0.0.tgz", b)
+	repo.touchFile(t, "bar-1.0.0.tgz", time.Now().Add(time.Minute))
+	qux, err := os.ReadFile(writeTestChart(t, dir, "qux", "1.0.0"))
+	require.NoError(t, err)
+	repo.putFile(t, "qux-1.0.0.tgz", qux)
+
+	heads := make(map[string]int)
+	for _, name := range []string{"foo", "bar", "baz", "qux"} {
+		heads[name] = repo.server.KeyCalls("HeadObject", "charts/"+name+"-1.0.0.tgz")
+	}
+
+	act := reindexAction{
+		repoName:    testRepoName,
+		lockTTL:     time.Minute,
+		incremental: true,
+	}
+	require.NoError(t, act.Run(context.Background()))
+
+	// Only the new and the modified chart files are requested.
+	for name, expected := range map[string]int{"foo": 0, "bar": 1, "baz": 0, "qux": 1} {
+		require.Equal(t, heads[name]+expected, repo.server.KeyCalls("HeadObject", "charts/"+name+"-1.0.0.tgz"), name)
+	}
+
+	idx := repo.index(t)
+	for _, name := range []string{"foo", "bar", "baz", "qux"} {
+		require.True(t, idx.Has(name, "1.0.0"), name)
+	}
+	digest, err := helmutil.Digest(bytes.NewReader(b))
+	require.NoError(t, err)
+	require.Equal(t, digest, indexEntry(t, idx, "bar", "1.0.0").Digest)
+}
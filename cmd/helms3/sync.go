@@ -0,0 +1,266 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+// Actions of the sync plan.
+const (
+	syncAdd    = "add"
+	syncUpdate = "update"
+	syncDelete = "delete"
+)
+
+type syncAction struct {
+	srcRepo, dstRepo string
+	acl              string
+	lockTTL          time.Duration
+
+	// delete makes sync delete the chart versions missing from the source
+	// repository from the destination repository.
+	delete bool
+
+	// dryRun makes sync only print the plan.
+	dryRun bool
+
+	// keyring is used to verify the charts if the destination repository
+	// accepts signed charts only.
+	keyring string
+}
+
+// syncedChart is a chart version to be added to, updated in or deleted from
+// the destination repository by sync.
+type syncedChart struct {
+	action string
+	entry  helmutil.IndexEntry
+}
+
+func (act syncAction) Run(ctx context.Context) error {
+	srcEntry, err := helmutil.LookupRepoEntry(act.srcRepo)
+	if err != nil {
+		return err
+	}
+	dstEntry, err := helmutil.LookupRepoEntry(act.dstRepo)
+	if err != nil {
+		return err
+	}
+	if srcEntry.URL() == dstEntry.URL() {
+		return errors.New("the source and the destination repositories are the same")
+	}
+
+	srcStorage, err := backend.New(srcEntry.URL())
+	if err != nil {
+		return err
+	}
+	dstStorage, err := backend.New(dstEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	dstCfg, err := loadRepoConfig(ctx, dstStorage, dstEntry.URL())
+	if err != nil {
+		return err
+	}
+	act.acl = dstCfg.acl(act.acl)
+
+	// Only the destination repository is modified, so only it is locked.
+	if !act.dryRun {
+		unlock, err := lockRepo(ctx, dstStorage, dstEntry.URL(), act.lockTTL)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	srcIdx, _, err := fetchIndex(ctx, srcStorage, srcEntry)
+	if err != nil {
+		return err
+	}
+	dstIdx, _, err := fetchIndex(ctx, dstStorage, dstEntry)
+	if err != nil {
+		return err
+	}
+
+	plan := planSync(srcIdx.Entries(), dstIdx.Entries(), act.delete)
+	if len(plan) == 0 {
+		fmt.Printf("Repository %s is in sync with %s.\n", act.dstRepo, act.srcRepo)
+		return nil
+	}
+
+	if err := printSyncPlan(os.Stdout, plan); err != nil {
+		return err
+	}
+
+	if act.dryRun {
+		fmt.Printf("Dry run: %d chart versions would be synced to repository %s.\n", len(plan), act.dstRepo)
+		return nil
+	}
+
+	// Chart files are transferred before the index references them, and
+	// deleted only after the index no longer does.
+
+	var (
+		charts  []copiedChart
+		deleted []syncedChart
+		failed  int
+	)
+	for _, p := range plan {
+		if p.action == syncDelete {
+			deleted = append(deleted, p)
+			continue
+		}
+
+		cp := copyAction{
+			name:    p.entry.Name,
+			version: p.entry.Version,
+			srcRepo: act.srcRepo,
+			dstRepo: act.dstRepo,
+			keyring: act.keyring,
+		}
+		ch, err := cp.findChart(srcIdx, srcEntry, dstEntry)
+		if err == nil {
+			err = cp.transfer(ctx, srcStorage, dstStorage, dstCfg, act.acl, ch)
+		}
+		if err != nil {
+			log.Printf("[ERROR] failed to sync chart %s %s: %s", p.entry.Name, p.entry.Version, err)
+			failed++
+			continue
+		}
+		charts = append(charts, ch)
+	}
+
+	// The source repository may be only partially synced, so nothing is
+	// deleted until every chart version is transferred.
+	if failed > 0 && len(deleted) > 0 {
+		log.Printf("[WARN] skipping the deletion of %d chart versions, as some chart versions failed to sync", len(deleted))
+		deleted = nil
+	}
+
+	baseURL := dstEntry.URL()
+	if dstCfg.relative(nil) {
+		baseURL = ""
+	}
+
+	var (
+		uris    []string
+		removed int
+	)
+	idx, err := updateIndex(ctx, dstStorage, dstEntry, act.acl, func(idx helmutil.Index) error {
+		for _, ch := range charts {
+			// The digest is kept, as the chart file is the same.
+			if err := idx.AddOrReplace(ch.meta.Value(), ch.fname, baseURL, ch.entry.Digest); err != nil {
+				return errors.WithMessagef(err, "add/replace chart %s in the index", ch.fname)
+			}
+		}
+
+		uris, removed = uris[:0], 0
+		for _, p := range deleted {
+			if !idx.Has(p.entry.Name, p.entry.Version) {
+				continue
+			}
+			url, err := idx.Delete(p.entry.Name, p.entry.Version)
+			if err != nil {
+				return errors.Wrapf(err, "remove chart %s %s from the index", p.entry.Name, p.entry.Version)
+			}
+			if url != "" {
+				url = resolveChartURL(dstEntry, url)
+				uris = append(uris, url, url+provenanceSuffix)
+			}
+			removed++
+		}
+
+		idx.SortEntries()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := dstStorage.DeleteBatch(ctx, uris); err != nil {
+		return errors.WithMessage(err, "delete chart files")
+	}
+
+	if err := idx.WriteFile(dstEntry.CacheFile(), 0644); err != nil {
+		return errors.WithMessage(err, "update local index")
+	}
+
+	fmt.Printf("Synced %d chart versions from repository %s to %s, deleted %d chart versions.\n", len(charts), act.srcRepo, act.dstRepo, removed)
+	if failed > 0 {
+		return fmt.Errorf("failed to sync %d chart versions, run sync again to retry", failed)
+	}
+	return nil
+}
+
+// planSync returns the changes making the destination entries match the
+// source entries. Chart versions are compared by their digests, so the URLs
+// may differ, e.g. when only one of the repositories uses relative URLs.
+func planSync(srcEntries, dstEntries []helmutil.IndexEntry, del bool) []syncedChart {
+	key := func(entry helmutil.IndexEntry) string {
+		return entry.Name + " " + entry.Version
+	}
+
+	dst := make(map[string]helmutil.IndexEntry, len(dstEntries))
+	for _, entry := range dstEntries {
+		dst[key(entry)] = entry
+	}
+
+	var plan []syncedChart
+	src := make(map[string]bool, len(srcEntries))
+	for _, entry := range srcEntries {
+		src[key(entry)] = true
+
+		dstEntry, ok := dst[key(entry)]
+		switch {
+		case !ok:
+			plan = append(plan, syncedChart{action: syncAdd, entry: entry})
+		case dstEntry.Digest != entry.Digest:
+			plan = append(plan, syncedChart{action: syncUpdate, entry: entry})
+		}
+	}
+
+	if del {
+		for _, entry := range dstEntries {
+			if !src[key(entry)] {
+				plan = append(plan, syncedChart{action: syncDelete, entry: entry})
+			}
+		}
+	}
+
+	return plan
+}
+
+// printSyncPlan prints the changes to the destination repository to w in the
+// form of a table.
+func printSyncPlan(w io.Writer, plan []syncedChart) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tCHART\tVERSION\tDIGEST")
+	for _, p := range plan {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.action, p.entry.Name, p.entry.Version, p.entry.Digest)
+	}
+	return tw.Flush()
+}
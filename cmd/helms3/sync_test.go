@@ -0,0 +1,161 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+	"github.com/banzaicloud/helm-s3/internal/s3test"
+)
+
+func TestSyncAction(t *testing.T) {
+	const dstRepoName = "dr-charts"
+
+	testCases := map[string]struct {
+		act          syncAction
+		dstConfig    map[string]string
+		expectCharts []string
+	}{
+		"sync": {
+			expectCharts: []string{"bar 1.0.0", "baz 1.0.0", "foo 1.2.3"},
+		},
+		"delete": {
+			act:          syncAction{delete: true},
+			expectCharts: []string{"bar 1.0.0", "foo 1.2.3"},
+		},
+		"dry run": {
+			act:          syncAction{delete: true, dryRun: true},
+			expectCharts: []string{"baz 1.0.0", "foo 1.2.3"},
+		},
+		"destination with relative urls": {
+			act:          syncAction{delete: true},
+			dstConfig:    map[string]string{"relative": "true"},
+			expectCharts: []string{"bar 1.0.0", "foo 1.2.3"},
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				src := setup(t)
+				dst := src.addRepo(t, dstRepoName)
+				for key, value := range tc.dstConfig {
+					set := configSetAction{repoName: dstRepoName, key: key, value: value}
+					require.NoError(t, set.Run(context.Background()))
+				}
+
+				// The destination has another foo 1.2.3 chart and a baz chart
+				// missing from the source.
+				dir := t.TempDir()
+				push := pushAction{chartPaths: []string{testChartPath, writeTestChart(t, dir, "bar", "1.0.0")}, repoName: testRepoName}
+				require.NoError(t, push.Run(context.Background()))
+				push = pushAction{
+					chartPaths: []string{writeTestChart(t, dir, "foo", "1.2.3"), writeTestChart(t, dir, "baz", "1.0.0")},
+					repoName:   dstRepoName,
+				}
+				require.NoError(t, push.Run(context.Background()))
+
+				tc.act.srcRepo = testRepoName
+				tc.act.dstRepo = dstRepoName
+				tc.act.lockTTL = time.Minute
+				output := captureStdout(t, func() {
+					require.NoError(t, tc.act.Run(context.Background()))
+				})
+				var plan []string
+				for _, line := range strings.Split(string(output), "\n") {
+					if fields := strings.Fields(line); len(fields) == 4 {
+						plan = append(plan, strings.Join(fields[:3], " "))
+					}
+				}
+				require.Contains(t, plan, "add bar 1.0.0")
+				require.Contains(t, plan, "update foo 1.2.3")
+				require.Equal(t, tc.act.delete, contains(plan, "delete baz 1.0.0"))
+
+				var synced []string
+				for _, entry := range dst.index(t).Entries() {
+					synced = append(synced, entry.Name+" "+entry.Version)
+				}
+				require.ElementsMatch(t, tc.expectCharts, synced)
+				require.Equal(t, !tc.act.dryRun, dst.hasFile(t, "bar-1.0.0.tgz"))
+				require.Equal(t, !tc.act.delete || tc.act.dryRun, dst.hasFile(t, "baz-1.0.0.tgz"))
+
+				if tc.act.dryRun {
+					return
+				}
+
+				digest, err := helmutil.DigestFile(testChartPath)
+				require.NoError(t, err)
+				entry := indexEntry(t, dst.index(t), testChartName, testChartVersion)
+				require.Equal(t, digest, entry.Digest)
+				if tc.dstConfig["relative"] == "true" {
+					require.Equal(t, "foo-1.2.3.tgz", entry.URLs[0])
+				} else {
+					require.Equal(t, dst.uri+"/foo-1.2.3.tgz", entry.URLs[0])
+				}
+
+				// Syncing again changes nothing.
+				output = captureStdout(t, func() {
+					require.NoError(t, tc.act.Run(context.Background()))
+				})
+				require.Contains(t, string(output), "is in sync with")
+			})
+		}
+	}
+}
+
+func TestSyncAction_FailedTransfer(t *testing.T) {
+	const dstRepoName = "dr-charts"
+
+	src := setupS3Repo(t)
+	dst := src.addRepo(t, dstRepoName)
+
+	dir := t.TempDir()
+	push := pushAction{chartPaths: []string{writeTestChart(t, dir, "bar", "1.0.0"), testChartPath}, repoName: testRepoName}
+	require.NoError(t, push.Run(context.Background()))
+	push = pushAction{chartPaths: []string{writeTestChart(t, dir, "baz", "1.0.0")}, repoName: dstRepoName}
+	require.NoError(t, push.Run(context.Background()))
+
+	// Both the server-side copy and the upload of bar fail.
+	src.server.InjectFailure(s3test.Failure{Op: "CopyObject", Key: "charts/bar-1.0.0.tgz", StatusCode: http.StatusForbidden, Code: "AccessDenied"})
+	src.server.InjectFailure(s3test.Failure{Op: "PutObject", Key: "charts/bar-1.0.0.tgz", StatusCode: http.StatusForbidden, Code: "AccessDenied"})
+
+	act := syncAction{
+		srcRepo: testRepoName,
+		dstRepo: dstRepoName,
+		lockTTL: time.Minute,
+		delete:  true,
+	}
+	output := captureStdout(t, func() {
+		require.Error(t, act.Run(context.Background()))
+	})
+	require.Contains(t, string(output), "Synced 1 chart versions from repository test-charts to dr-charts, deleted 0 chart versions.")
+
+	// The deletion is skipped, as the source is only partially synced.
+	var synced []string
+	for _, entry := range dst.index(t).Entries() {
+		synced = append(synced, entry.Name+" "+entry.Version)
+	}
+	require.ElementsMatch(t, []string{"baz 1.0.0", "foo 1.2.3"}, synced)
+	require.True(t, dst.hasFile(t, "baz-1.0.0.tgz"))
+	require.False(t, dst.hasFile(t, "bar-1.0.0.tgz"))
+}
@@ -0,0 +1,324 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains utilities for testing code in this package.
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+	"github.com/banzaicloud/helm-s3/internal/s3test"
+)
+
+const (
+	// testRepoName is the name of the repository set up by setupHelmRepo.
+	testRepoName = "test-charts"
+
+	// testChartName and testChartVersion describe the chart in testChartPath.
+	testChartName    = "foo"
+	testChartVersion = "1.2.3"
+)
+
+// testChartPath is the absolute path of the test chart archive.
+var testChartPath = mustAbs("../../test/e2e/data/foo-1.2.3.tgz")
+
+// testKeyring is the absolute path of the keyring holding the secret key
+// named testKeyName.
+var testKeyring = mustAbs("../../test/e2e/data/keyring/helm-s3-test.secret")
+
+// testPublicKeyring is the absolute path of the keyring holding the public
+// key named testKeyName.
+var testPublicKeyring = mustAbs("../../test/e2e/data/keyring/helm-s3-test.pub")
+
+// testKeyName is the name of the test signing key.
+const testKeyName = "helm-s3 test"
+
+func mustAbs(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		panic(err)
+	}
+	return abs
+}
+
+// testRepo is a repository set up for a test.
+type testRepo struct {
+	// uri is the repository URI.
+	uri string
+
+	// dir is the directory of file:// repositories.
+	dir string
+
+	// server is the fake S3 server of s3:// repositories.
+	server *s3test.Server
+}
+
+// testBackends are the functions setting up a test repository on every
+// storage backend, keyed by the backend URI scheme.
+var testBackends = map[string]func(t *testing.T) testRepo{
+	"file": setupLocalRepo,
+	"s3":   setupS3Repo,
+}
+
+// setupLocalRepo sets up a Helm v3 environment with a single initialized
+// file:// repository named testRepoName in a temporary directory.
+func setupLocalRepo(t *testing.T) testRepo {
+	t.Helper()
+
+	repoDir := filepath.Join(t.TempDir(), "repo")
+	repo := testRepo{
+		uri: (&url.URL{Scheme: "file", Path: filepath.ToSlash(repoDir)}).String(),
+		dir: repoDir,
+	}
+	setupHelmRepo(t, repo.uri)
+
+	return repo
+}
+
+// setupS3Repo sets up a Helm v3 environment with a single initialized s3://
+// repository named testRepoName on a fake S3 server.
+func setupS3Repo(t *testing.T) testRepo {
+	t.Helper()
+
+	server := s3test.NewServer()
+	t.Cleanup(server.Close)
+	server.Setenv(t)
+	server.CreateBucket("test-bucket")
+
+	repo := testRepo{
+		uri:    "s3://test-bucket/charts",
+		server: server,
+	}
+	setupHelmRepo(t, repo.uri)
+
+	return repo
+}
+
+// setupHelmRepo sets up a Helm v3 environment in a temporary directory with
+// a single repository named testRepoName and initializes the repository.
+func setupHelmRepo(t *testing.T, repoURI string) {
+	t.Helper()
+
+	tmp := t.TempDir()
+	cacheDir := filepath.Join(tmp, "cache")
+	repoFile := filepath.Join(tmp, "repositories.yaml")
+
+	require.NoError(t, os.MkdirAll(cacheDir, 0755))
+	require.NoError(t, os.WriteFile(repoFile, []byte(fmt.Sprintf(
+		"apiVersion: v1\nrepositories:\n- name: %s\n  url: %s\n", testRepoName, repoURI,
+	)), 0644))
+
+	setenv(t, "HELM_S3_MODE", "3")
+	setenv(t, "HELM_REPOSITORY_CONFIG", repoFile)
+	setenv(t, "HELM_REPOSITORY_CACHE", cacheDir)
+	helmutil.SetupHelm()
+
+	require.NoError(t, initAction{uri: repoURI}.Run(context.Background()))
+}
+
+// setenv sets the environment variable for the duration of the test.
+func setenv(t *testing.T, name, value string) {
+	t.Helper()
+
+	old, ok := os.LookupEnv(name)
+	require.NoError(t, os.Setenv(name, value))
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// addRepo adds another repository with the name to the Helm environment, on
+// the same storage backend as the repository, and initializes it. S3
+// repositories are added in a new bucket of the same name.
+func (r testRepo) addRepo(t *testing.T, name string) testRepo {
+	t.Helper()
+
+	repo := testRepo{server: r.server}
+	if r.server != nil {
+		r.server.CreateBucket(name)
+		repo.uri = "s3://" + name + "/charts"
+	} else {
+		repo.dir = filepath.Join(filepath.Dir(r.dir), name)
+		repo.uri = (&url.URL{Scheme: "file", Path: filepath.ToSlash(repo.dir)}).String()
+	}
+
+	f, err := os.OpenFile(os.Getenv("HELM_REPOSITORY_CONFIG"), os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(f, "- name: %s\n  url: %s\n", name, repo.uri)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, initAction{uri: repo.uri}.Run(context.Background()))
+
+	return repo
+}
+
+// hasFile returns true if the file exists in the repository.
+func (r testRepo) hasFile(t *testing.T, name string) bool {
+	t.Helper()
+
+	storage, err := backend.New(r.uri)
+	require.NoError(t, err)
+
+	exists, err := storage.Exists(context.Background(), r.uri+"/"+name)
+	require.NoError(t, err)
+
+	return exists
+}
+
+// putFile puts the file to the repository bypassing the plugin, as if it was
+// copied there by other tools.
+func (r testRepo) putFile(t *testing.T, name string, b []byte) {
+	t.Helper()
+
+	if r.server != nil {
+		r.server.PutObject("test-bucket", "charts/"+name, b, nil)
+		return
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(r.dir, name), b, 0644))
+}
+
+// touchFile sets the time the file in the repository was last modified.
+func (r testRepo) touchFile(t *testing.T, name string, modified time.Time) {
+	t.Helper()
+
+	if r.server != nil {
+		r.server.SetLastModified("test-bucket", "charts/"+name, modified)
+		return
+	}
+	require.NoError(t, os.Chtimes(filepath.Join(r.dir, name), modified, modified))
+}
+
+// file downloads the file from the repository.
+func (r testRepo) file(t *testing.T, name string) []byte {
+	t.Helper()
+
+	storage, err := backend.New(r.uri)
+	require.NoError(t, err)
+
+	b, err := storage.FetchRaw(context.Background(), r.uri+"/"+name)
+	require.NoError(t, err)
+
+	return b
+}
+
+// removeFile removes the file from the repository bypassing the plugin.
+func (r testRepo) removeFile(t *testing.T, name string) {
+	t.Helper()
+
+	storage, err := backend.New(r.uri)
+	require.NoError(t, err)
+
+	require.NoError(t, storage.Delete(context.Background(), r.uri+"/"+name))
+}
+
+// index downloads and loads the repository index.
+func (r testRepo) index(t *testing.T) helmutil.Index {
+	t.Helper()
+
+	storage, err := backend.New(r.uri)
+	require.NoError(t, err)
+
+	b, err := storage.FetchRaw(context.Background(), r.uri+"/index.yaml")
+	require.NoError(t, err)
+
+	idx := helmutil.NewIndex()
+	require.NoError(t, idx.UnmarshalBinary(b))
+
+	return idx
+}
+
+// captureStdout returns everything written to the standard output by f.
+func captureStdout(t *testing.T, f func()) []byte {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		output <- b
+	}()
+
+	f()
+	require.NoError(t, w.Close())
+
+	return <-output
+}
+
+// writeTestChart writes a minimal chart archive with the given name and
+// version to the directory and returns its path.
+func writeTestChart(t *testing.T, dir, name, version string) string {
+	t.Helper()
+
+	chartYAML := []byte(fmt.Sprintf("apiVersion: v2\nname: %s\nversion: %s\n", name, version))
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Name: name + "/Chart.yaml",
+		Mode: 0644,
+		Size: int64(len(chartYAML)),
+	}))
+	_, err := tw.Write(chartYAML)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	fpath := filepath.Join(dir, name+"-"+version+".tgz")
+	require.NoError(t, os.WriteFile(fpath, buf.Bytes(), 0644))
+
+	return fpath
+}
+
+// testProvPath writes a dummy provenance file of the test chart to a temporary
+// directory and returns its path.
+func testProvPath(t *testing.T) string {
+	t.Helper()
+
+	fpath := filepath.Join(t.TempDir(), "foo-1.2.3.tgz.prov")
+	require.NoError(t, os.WriteFile(fpath, []byte("-----BEGIN PGP SIGNED MESSAGE-----\n"), 0644))
+
+	return fpath
+}
+
+// boolPtr returns a pointer to the bool value.
+func boolPtr(v bool) *bool {
+	return &v
+}
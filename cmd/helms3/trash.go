@@ -0,0 +1,350 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+const (
+	// trashDir is the directory of the repository where soft deleted chart
+	// files are kept. Charts in subdirectories are not indexed.
+	trashDir = ".trash"
+
+	// trashIndexFilename is the name of the file in trashDir holding the
+	// tombstones of the soft deleted chart versions.
+	trashIndexFilename = "tombstones.yaml"
+)
+
+// tombstone is the record of a soft deleted chart version.
+type tombstone struct {
+	Name    string    `json:"name"`
+	Version string    `json:"version"`
+	Deleted time.Time `json:"deleted"`
+
+	// Files are the URIs the chart files were deleted from. Their copies
+	// are kept in the trash under the same names, in a folder of the chart
+	// version.
+	Files []string `json:"files"`
+
+	// Entry is the index entry of the chart version, as encoded by
+	// helmutil.Index.MarshalEntry.
+	Entry json.RawMessage `json:"entry"`
+}
+
+// trashIndex holds the tombstones of the soft deleted chart versions.
+type trashIndex struct {
+	Tombstones []tombstone `json:"tombstones"`
+}
+
+// find returns the position of the tombstone of the chart version or -1 if
+// there is none.
+func (t trashIndex) find(name, version string) int {
+	for i, ts := range t.Tombstones {
+		if ts.Name == name && ts.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// trashURI returns the URI of the copy of a file of the chart version in the
+// trash. Copies are kept by chart name and version, as files of different
+// charts may share a name under different URLs.
+func trashURI(repoURL string, ts tombstone, uri string) string {
+	return repoURL + "/" + trashDir + "/" + ts.Name + "/" + ts.Version + "/" + path.Base(uri)
+}
+
+// fetchTrash downloads the trash index. Repositories without the trash index
+// have an empty trash.
+func fetchTrash(ctx context.Context, storage backend.Storage, repoURL string) (trashIndex, error) {
+	var trash trashIndex
+
+	b, err := storage.FetchRaw(ctx, repoURL+"/"+trashDir+"/"+trashIndexFilename)
+	if err != nil {
+		if err == backend.ErrObjectNotFound {
+			return trash, nil
+		}
+		return trash, errors.WithMessage(err, "fetch trash index")
+	}
+
+	if err := yaml.Unmarshal(b, &trash); err != nil {
+		return trash, errors.Wrap(err, "unmarshal trash index")
+	}
+
+	return trash, nil
+}
+
+// putTrash uploads the trash index.
+func putTrash(ctx context.Context, storage backend.Storage, repoURL, acl string, trash trashIndex) error {
+	b, err := yaml.Marshal(trash)
+	if err != nil {
+		return errors.Wrap(err, "marshal trash index")
+	}
+
+	err = storage.PutRaw(ctx, repoURL+"/"+trashDir+"/"+trashIndexFilename, bytes.NewReader(b), acl, "application/x-yaml")
+	return errors.WithMessage(err, "upload trash index")
+}
+
+// copyToTrash copies the files of the chart versions being deleted to the
+// trash, leaving the originals to be deleted once the versions are removed
+// from the index. Files that do not exist, like missing provenance files, are
+// skipped. It returns the URIs of the copies.
+func copyToTrash(ctx context.Context, storage backend.Storage, repoURL, acl string, tombstones []tombstone) ([]string, error) {
+	var copies []string
+	for i, ts := range tombstones {
+		var files []string
+		for _, uri := range ts.Files {
+			err := storage.Copy(ctx, uri, trashURI(repoURL, ts, uri), acl)
+			if err == backend.ErrObjectNotFound {
+				continue
+			}
+			if err != nil {
+				return copies, errors.WithMessagef(err, "move %s to the trash", path.Base(uri))
+			}
+			files = append(files, uri)
+			copies = append(copies, trashURI(repoURL, ts, uri))
+		}
+		tombstones[i].Files = files
+	}
+	return copies, nil
+}
+
+// recordTombstones adds the tombstones of the chart versions copied to the
+// trash to the trash index.
+func recordTombstones(ctx context.Context, storage backend.Storage, repoURL, acl string, tombstones []tombstone) error {
+	trash, err := fetchTrash(ctx, storage, repoURL)
+	if err != nil {
+		return err
+	}
+	for _, ts := range tombstones {
+		// A chart version deleted again replaces its previous copy.
+		if i := trash.find(ts.Name, ts.Version); i >= 0 {
+			trash.Tombstones = append(trash.Tombstones[:i], trash.Tombstones[i+1:]...)
+		}
+		trash.Tombstones = append(trash.Tombstones, ts)
+	}
+	return putTrash(ctx, storage, repoURL, acl, trash)
+}
+
+// discardTrashCopies deletes the trash copies of chart versions which are
+// still in the index. Failing to do so only leaves unreferenced copies
+// behind, so errors are logged rather than returned.
+func discardTrashCopies(ctx context.Context, storage backend.Storage, copies []string) {
+	if len(copies) == 0 {
+		return
+	}
+	if err := storage.DeleteBatch(ctx, copies); err != nil {
+		log.Printf("[WARN] failed to delete chart files copied to the trash: %s", err)
+	}
+}
+
+type undeleteAction struct {
+	name, version, repoName, acl string
+	lockTTL                      time.Duration
+}
+
+func (act undeleteAction) Run(ctx context.Context) error {
+	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
+	if err != nil {
+		return err
+	}
+
+	storage, err := backend.New(repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadRepoConfig(ctx, storage, repoEntry.URL())
+	if err != nil {
+		return err
+	}
+	act.acl = cfg.acl(act.acl)
+
+	unlock, err := lockRepo(ctx, storage, repoEntry.URL(), act.lockTTL)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	trash, err := fetchTrash(ctx, storage, repoEntry.URL())
+	if err != nil {
+		return err
+	}
+	i := trash.find(act.name, act.version)
+	if i < 0 {
+		return fmt.Errorf("chart %s version %s not found in the trash", act.name, act.version)
+	}
+	ts := trash.Tombstones[i]
+
+	// Check that the version has not been pushed again before overwriting
+	// its chart files.
+	idx, _, err := fetchIndex(ctx, storage, repoEntry)
+	if err != nil {
+		return err
+	}
+	if idx.Has(act.name, act.version) {
+		return errors.WithMessagef(ErrChartExists, "chart %s version %s", act.name, act.version)
+	}
+
+	var copies []string
+	for _, uri := range ts.Files {
+		if err := storage.Copy(ctx, trashURI(repoEntry.URL(), ts, uri), uri, act.acl); err != nil {
+			return errors.WithMessagef(err, "restore %s from the trash", path.Base(uri))
+		}
+		copies = append(copies, trashURI(repoEntry.URL(), ts, uri))
+	}
+
+	idx, err = updateIndex(ctx, storage, repoEntry, act.acl, func(idx helmutil.Index) error {
+		if idx.Has(act.name, act.version) {
+			return errors.WithMessagef(ErrChartExists, "chart %s version %s", act.name, act.version)
+		}
+		if err := idx.RestoreEntry(ts.Entry); err != nil {
+			return errors.WithMessagef(err, "restore chart %s version %s in the index", act.name, act.version)
+		}
+		idx.SortEntries()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	trash.Tombstones = append(trash.Tombstones[:i], trash.Tombstones[i+1:]...)
+	if err := putTrash(ctx, storage, repoEntry.URL(), act.acl, trash); err != nil {
+		return err
+	}
+	if err := storage.DeleteBatch(ctx, copies); err != nil {
+		return errors.WithMessage(err, "delete chart files from the trash")
+	}
+
+	if err := idx.WriteFile(repoEntry.CacheFile(), 0644); err != nil {
+		return errors.WithMessage(err, "update local index")
+	}
+
+	return nil
+}
+
+type trashListAction struct {
+	repoName string
+}
+
+func (act trashListAction) Run(ctx context.Context) error {
+	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
+	if err != nil {
+		return err
+	}
+
+	storage, err := backend.New(repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	trash, err := fetchTrash(ctx, storage, repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "CHART\tVERSION\tDELETED")
+	for _, ts := range trash.Tombstones {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", ts.Name, ts.Version, ts.Deleted.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+type trashPurgeAction struct {
+	repoName string
+	acl      string
+	lockTTL  time.Duration
+
+	// olderThan limits purging to the chart versions deleted longer ago
+	// than the duration. Zero purges the whole trash.
+	olderThan time.Duration
+}
+
+func (act trashPurgeAction) Run(ctx context.Context) error {
+	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
+	if err != nil {
+		return err
+	}
+
+	storage, err := backend.New(repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadRepoConfig(ctx, storage, repoEntry.URL())
+	if err != nil {
+		return err
+	}
+	act.acl = cfg.acl(act.acl)
+
+	unlock, err := lockRepo(ctx, storage, repoEntry.URL(), act.lockTTL)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	trash, err := fetchTrash(ctx, storage, repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var kept []tombstone
+	var purged []string
+	for _, ts := range trash.Tombstones {
+		if now.Sub(ts.Deleted) <= act.olderThan {
+			kept = append(kept, ts)
+			continue
+		}
+		for _, uri := range ts.Files {
+			purged = append(purged, trashURI(repoEntry.URL(), ts, uri))
+		}
+	}
+
+	n := len(trash.Tombstones) - len(kept)
+	if n == 0 {
+		fmt.Printf("Nothing to purge from the trash of repository %s.\n", act.repoName)
+		return nil
+	}
+
+	// The tombstones are removed first, so that they never refer to purged
+	// chart files.
+	trash.Tombstones = kept
+	if err := putTrash(ctx, storage, repoEntry.URL(), act.acl, trash); err != nil {
+		return err
+	}
+	if err := storage.DeleteBatch(ctx, purged); err != nil {
+		return errors.WithMessage(err, "delete chart files from the trash")
+	}
+
+	fmt.Printf("Purged %d chart versions from the trash of repository %s.\n", n, act.repoName)
+	return nil
+}
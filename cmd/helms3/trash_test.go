@@ -0,0 +1,244 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+	"github.com/banzaicloud/helm-s3/internal/s3test"
+)
+
+func TestDeleteAction_Soft(t *testing.T) {
+	testCases := map[string]struct {
+		config  map[string]string
+		soft    *bool
+		expectT bool
+	}{
+		"soft delete flag": {
+			soft:    boolPtr(true),
+			expectT: true,
+		},
+		"soft delete by config": {
+			config:  map[string]string{"softDelete": "true"},
+			expectT: true,
+		},
+		"flag overrides config": {
+			config:  map[string]string{"softDelete": "true"},
+			soft:    boolPtr(false),
+			expectT: false,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+
+				for key, value := range tc.config {
+					set := configSetAction{repoName: testRepoName, key: key, value: value}
+					require.NoError(t, set.Run(context.Background()))
+				}
+
+				push := pushAction{chartPaths: []string{testChartPath}, repoName: testRepoName, prov: testProvPath(t)}
+				require.NoError(t, push.Run(context.Background()))
+
+				del := deleteAction{
+					name:     testChartName,
+					version:  testChartVersion,
+					repoName: testRepoName,
+					lockTTL:  time.Minute,
+					soft:     tc.soft,
+				}
+				require.NoError(t, del.Run(context.Background()))
+
+				require.False(t, repo.index(t).Has(testChartName, testChartVersion))
+				require.False(t, repo.hasFile(t, "foo-1.2.3.tgz"))
+				require.False(t, repo.hasFile(t, "foo-1.2.3.tgz.prov"))
+				require.Equal(t, tc.expectT, repo.hasFile(t, ".trash/foo/1.2.3/foo-1.2.3.tgz"))
+				require.Equal(t, tc.expectT, repo.hasFile(t, ".trash/foo/1.2.3/foo-1.2.3.tgz.prov"))
+
+				undel := undeleteAction{
+					name:     testChartName,
+					version:  testChartVersion,
+					repoName: testRepoName,
+					lockTTL:  time.Minute,
+				}
+				err := undel.Run(context.Background())
+				if !tc.expectT {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+
+				require.True(t, repo.index(t).Has(testChartName, testChartVersion))
+				require.True(t, repo.hasFile(t, "foo-1.2.3.tgz"))
+				require.True(t, repo.hasFile(t, "foo-1.2.3.tgz.prov"))
+				require.False(t, repo.hasFile(t, ".trash/foo/1.2.3/foo-1.2.3.tgz"))
+				require.False(t, repo.hasFile(t, ".trash/foo/1.2.3/foo-1.2.3.tgz.prov"))
+
+				chart, err := os.ReadFile(testChartPath)
+				require.NoError(t, err)
+				require.Equal(t, chart, repo.file(t, "foo-1.2.3.tgz"))
+
+				// The chart is no longer in the trash.
+				require.Error(t, undel.Run(context.Background()))
+			})
+		}
+	}
+}
+
+func TestDeleteAction_SoftIndexFailure(t *testing.T) {
+	repo := setupS3Repo(t)
+
+	push := pushAction{chartPaths: []string{testChartPath}, repoName: testRepoName}
+	require.NoError(t, push.Run(context.Background()))
+
+	repo.server.InjectFailure(s3test.Failure{Op: "PutObject", Key: "charts/index.yaml", StatusCode: http.StatusForbidden, Code: "AccessDenied"})
+	del := deleteAction{name: testChartName, version: testChartVersion, repoName: testRepoName, lockTTL: time.Minute, soft: boolPtr(true)}
+	require.Error(t, del.Run(context.Background()))
+
+	// The chart is still in the repository, and neither its tombstone nor
+	// its copy are left in the trash.
+	require.True(t, repo.index(t).Has(testChartName, testChartVersion))
+	require.True(t, repo.hasFile(t, "foo-1.2.3.tgz"))
+	require.False(t, repo.hasFile(t, ".trash/foo/1.2.3/foo-1.2.3.tgz"))
+
+	output := captureStdout(t, func() {
+		require.NoError(t, trashListAction{repoName: testRepoName}.Run(context.Background()))
+	})
+	require.NotContains(t, string(output), testChartName)
+}
+
+func TestDeleteAction_SoftSameFilename(t *testing.T) {
+	repo := setupS3Repo(t)
+
+	// The chart versions share the file name in different folders.
+	idx := helmutil.NewIndex()
+	charts := map[string][]byte{}
+	for folder, version := range map[string]string{"a": "1.0.0", "b": "1.1.0"} {
+		fpath := writeTestChart(t, t.TempDir(), "bar", version)
+		b, err := os.ReadFile(fpath)
+		require.NoError(t, err)
+		repo.putFile(t, folder+"/chart.tgz", b)
+		charts[version] = b
+
+		ch, err := helmutil.LoadChart(fpath)
+		require.NoError(t, err)
+		digest, err := helmutil.DigestFile(fpath)
+		require.NoError(t, err)
+		require.NoError(t, idx.Add(ch.Metadata().Value(), folder+"/chart.tgz", repo.uri, digest))
+	}
+	b, err := idx.MarshalBinary()
+	require.NoError(t, err)
+	repo.putFile(t, "index.yaml", b)
+
+	del := deleteAction{name: "bar", allVersions: true, yes: true, repoName: testRepoName, soft: boolPtr(true)}
+	require.NoError(t, del.Run(context.Background()))
+	require.False(t, repo.hasFile(t, "a/chart.tgz"))
+	require.False(t, repo.hasFile(t, "b/chart.tgz"))
+
+	for folder, version := range map[string]string{"a": "1.0.0", "b": "1.1.0"} {
+		undel := undeleteAction{name: "bar", version: version, repoName: testRepoName}
+		require.NoError(t, undel.Run(context.Background()))
+		require.Equal(t, charts[version], repo.file(t, folder+"/chart.tgz"))
+	}
+}
+
+func TestUndeleteAction_Pushed(t *testing.T) {
+	for backendName, setup := range testBackends {
+		setup := setup
+		t.Run(backendName, func(t *testing.T) {
+			setup(t)
+
+			push := pushAction{chartPaths: []string{testChartPath}, repoName: testRepoName}
+			require.NoError(t, push.Run(context.Background()))
+
+			del := deleteAction{name: testChartName, version: testChartVersion, repoName: testRepoName, soft: boolPtr(true)}
+			require.NoError(t, del.Run(context.Background()))
+
+			// The version was pushed again after it was deleted.
+			require.NoError(t, push.Run(context.Background()))
+
+			undel := undeleteAction{name: testChartName, version: testChartVersion, repoName: testRepoName}
+			require.Equal(t, ErrChartExists, errors.Cause(undel.Run(context.Background())))
+		})
+	}
+}
+
+func TestTrashPurgeAction(t *testing.T) {
+	testCases := map[string]struct {
+		olderThan    time.Duration
+		expectPurged bool
+	}{
+		"purge all": {
+			olderThan:    0,
+			expectPurged: true,
+		},
+		"purge older": {
+			olderThan:    time.Hour,
+			expectPurged: false,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+
+				dir := t.TempDir()
+				push := pushAction{
+					chartPaths: []string{
+						writeTestChart(t, dir, "bar", "1.0.0"),
+						writeTestChart(t, dir, "bar", "1.1.0"),
+					},
+					repoName: testRepoName,
+				}
+				require.NoError(t, push.Run(context.Background()))
+
+				del := deleteAction{name: "bar", allVersions: true, yes: true, repoName: testRepoName, soft: boolPtr(true)}
+				require.NoError(t, del.Run(context.Background()))
+
+				output := captureStdout(t, func() {
+					require.NoError(t, trashListAction{repoName: testRepoName}.Run(context.Background()))
+				})
+				require.Contains(t, string(output), "bar     1.0.0")
+				require.Contains(t, string(output), "bar     1.1.0")
+
+				purge := trashPurgeAction{repoName: testRepoName, olderThan: tc.olderThan}
+				require.NoError(t, purge.Run(context.Background()))
+
+				for _, version := range []string{"1.0.0", "1.1.0"} {
+					require.Equal(t, !tc.expectPurged, repo.hasFile(t, ".trash/bar/"+version+"/bar-"+version+".tgz"))
+				}
+
+				output = captureStdout(t, func() {
+					require.NoError(t, trashListAction{repoName: testRepoName}.Run(context.Background()))
+				})
+				require.Equal(t, !tc.expectPurged, strings.Contains(string(output), "bar"))
+			})
+		}
+	}
+}
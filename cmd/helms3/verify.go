@@ -0,0 +1,398 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+// ErrIndexDrift signals that the repository index does not match the charts
+// in the repository.
+var ErrIndexDrift = errors.New("index does not match the repository contents")
+
+// Kinds of drift between the index and the repository contents.
+const (
+	driftMissingObject    = "missing object"
+	driftNotIndexed       = "not indexed"
+	driftDigestMismatch   = "digest mismatch"
+	driftDuplicateVersion = "duplicate version"
+	driftStaleMetadata    = "stale metadata"
+)
+
+type verifyAction struct {
+	repoName string
+	lockTTL  time.Duration
+
+	// acl and relative default to the repository config if they are not
+	// set.
+	acl      string
+	relative *bool
+
+	// concurrency is the number of charts processed in parallel.
+	concurrency int
+
+	// deep makes verify download every chart to check its actual digest in
+	// addition to the chart-digest metadata.
+	deep bool
+
+	// fix makes verify repair the index instead of only reporting the drift.
+	fix bool
+}
+
+// drift is a mismatch between the index and the repository contents.
+type drift struct {
+	kind     string
+	name     string
+	version  string
+	filename string
+	detail   string
+}
+
+// verifiedChart is a chart file found in the repository.
+type verifiedChart struct {
+	info    backend.ChartInfo
+	name    string
+	version string
+
+	// digest is the digest of the chart file contents, set in deep mode only.
+	digest string
+}
+
+// indexDigest returns the digest the index entry of the chart should have.
+func (c verifiedChart) indexDigest() string {
+	if c.digest != "" {
+		return c.digest
+	}
+	return c.info.Hash
+}
+
+func (act verifyAction) Run(ctx context.Context) error {
+	repoEntry, err := helmutil.LookupRepoEntry(act.repoName)
+	if err != nil {
+		return err
+	}
+
+	storage, err := backend.New(repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadRepoConfig(ctx, storage, repoEntry.URL())
+	if err != nil {
+		return err
+	}
+	act.acl = cfg.acl(act.acl)
+
+	if act.fix {
+		unlock, err := lockRepo(ctx, storage, repoEntry.URL(), act.lockTTL)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	charts, err := act.collectCharts(ctx, storage, repoEntry.URL())
+	if err != nil {
+		return err
+	}
+
+	idx, _, err := fetchIndex(ctx, storage, repoEntry)
+	if err != nil {
+		return err
+	}
+
+	drifts := findDrift(idx.Entries(), charts)
+	if len(drifts) == 0 {
+		fmt.Printf("The index of repository %s matches its contents.\n", act.repoName)
+		return nil
+	}
+
+	if err := printDrift(os.Stdout, drifts); err != nil {
+		return err
+	}
+
+	if !act.fix {
+		return ErrIndexDrift
+	}
+
+	baseURL := repoEntry.URL()
+	if cfg.relative(act.relative) {
+		baseURL = ""
+	}
+
+	// The index is repaired against the charts found above, because they do
+	// not change while we are holding the lock.
+	idx, err = updateIndex(ctx, storage, repoEntry, act.acl, func(idx helmutil.Index) error {
+		return repairIndex(idx, charts, baseURL)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := idx.WriteFile(repoEntry.CacheFile(), 0644); err != nil {
+		return errors.WithMessage(err, "update local index")
+	}
+
+	fmt.Printf("The index of repository %s was successfully repaired.\n", act.repoName)
+	return nil
+}
+
+// collectCharts returns the charts in the repository keyed by file name.
+func (act verifyAction) collectCharts(ctx context.Context, storage backend.Storage, repoURL string) (map[string]verifiedChart, error) {
+	items, errs := storage.Traverse(ctx, repoURL, backend.TraverseOptions{Concurrency: act.concurrency})
+
+	type result struct {
+		charts map[string]verifiedChart
+		err    error
+	}
+	collected := make(chan result, 1)
+	go func() {
+		charts := make(map[string]verifiedChart)
+		for item := range items {
+			chart, err := act.verifiedChart(ctx, storage, repoURL, item)
+			if err != nil {
+				collected <- result{err: err}
+				// Drain the items so that the traversal can finish.
+				for range items {
+				}
+				return
+			}
+			charts[item.Filename] = chart
+		}
+		collected <- result{charts: charts}
+	}()
+
+	for err := range errs {
+		return nil, errors.Wrap(err, "traverse the chart repository")
+	}
+
+	res := <-collected
+	return res.charts, res.err
+}
+
+// verifiedChart returns the chart found in the repository, downloading the
+// chart file in deep mode.
+func (act verifyAction) verifiedChart(ctx context.Context, storage backend.Storage, repoURL string, item backend.ChartInfo) (verifiedChart, error) {
+	b, err := item.Meta.MarshalJSON()
+	if err != nil {
+		return verifiedChart{}, errors.Wrapf(err, "marshal metadata of chart %s", item.Filename)
+	}
+
+	var meta struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return verifiedChart{}, errors.Wrapf(err, "unmarshal metadata of chart %s", item.Filename)
+	}
+
+	chart := verifiedChart{info: item, name: meta.Name, version: meta.Version}
+	if !act.deep {
+		return chart, nil
+	}
+
+	b, err = storage.FetchRaw(ctx, repoURL+"/"+item.Filename)
+	if err != nil {
+		return verifiedChart{}, errors.WithMessagef(err, "fetch chart %s", item.Filename)
+	}
+	chart.digest, err = helmutil.Digest(bytes.NewReader(b))
+	if err != nil {
+		return verifiedChart{}, errors.WithMessagef(err, "get digest of chart %s", item.Filename)
+	}
+
+	return chart, nil
+}
+
+// findDrift compares the index entries with the charts in the repository
+// keyed by file name.
+func findDrift(entries []helmutil.IndexEntry, charts map[string]verifiedChart) []drift {
+	var drifts []drift
+
+	seen := make(map[string]bool)
+	referenced := make(map[string]bool)
+	for _, entry := range entries {
+		var filename string
+		if len(entry.URLs) > 0 {
+			filename = path.Base(entry.URLs[0])
+		}
+		referenced[filename] = true
+
+		d := drift{name: entry.Name, version: entry.Version, filename: filename}
+
+		key := entry.Name + "-" + entry.Version
+		if seen[key] {
+			d.kind = driftDuplicateVersion
+			d.detail = "the version is indexed more than once"
+			drifts = append(drifts, d)
+			continue
+		}
+		seen[key] = true
+
+		chart, ok := charts[filename]
+		if !ok {
+			d.kind = driftMissingObject
+			d.detail = "the chart file does not exist"
+			drifts = append(drifts, d)
+			continue
+		}
+
+		// The actual digest of the chart file, if known, takes precedence
+		// over the metadata that might be stale. Stale metadata of a chart
+		// file matching the index is reported on its own, as the index entry
+		// is right.
+		switch {
+		case chart.digest != "" && chart.digest != entry.Digest:
+			d.kind = driftDigestMismatch
+			d.detail = fmt.Sprintf("index has %s, chart file has %s", entry.Digest, chart.digest)
+			drifts = append(drifts, d)
+		case chart.info.Hash != entry.Digest && chart.digest != "":
+			d.kind = driftStaleMetadata
+			d.detail = fmt.Sprintf("chart file has %s, chart-digest metadata has %s", chart.digest, chart.info.Hash)
+			drifts = append(drifts, d)
+		case chart.info.Hash != entry.Digest:
+			d.kind = driftDigestMismatch
+			d.detail = fmt.Sprintf("index has %s, chart-digest metadata has %s", entry.Digest, chart.info.Hash)
+			drifts = append(drifts, d)
+		}
+	}
+
+	for _, filename := range sortedFilenames(charts) {
+		if referenced[filename] {
+			continue
+		}
+		chart := charts[filename]
+		drifts = append(drifts, drift{
+			kind:     driftNotIndexed,
+			name:     chart.name,
+			version:  chart.version,
+			filename: filename,
+			detail:   "the chart file is not referenced by the index",
+		})
+	}
+
+	return drifts
+}
+
+// repairIndex fixes the drift between the index and the charts in the
+// repository. Every chart version with a broken entry is removed from the
+// index and indexed again from its chart file, if there is any, keeping the
+// creation time of its entry. Stale metadata is left alone, as the index
+// entry is right.
+func repairIndex(idx helmutil.Index, charts map[string]verifiedChart, baseURL string) error {
+	created := make(map[string]time.Time)
+	for _, d := range findDrift(idx.Entries(), charts) {
+		if d.kind == driftNotIndexed || d.kind == driftStaleMetadata {
+			continue
+		}
+		for _, entry := range idx.Entries() {
+			key := entry.Name + "-" + entry.Version
+			if _, ok := created[key]; !ok && entry.Name == d.name && entry.Version == d.version {
+				created[key] = entry.Created
+			}
+		}
+		for idx.Has(d.name, d.version) {
+			if _, err := idx.Delete(d.name, d.version); err != nil {
+				return errors.Wrapf(err, "remove chart %s %s from the index", d.name, d.version)
+			}
+		}
+	}
+
+	referenced := make(map[string]bool)
+	for _, entry := range idx.Entries() {
+		if len(entry.URLs) > 0 {
+			referenced[path.Base(entry.URLs[0])] = true
+		}
+	}
+
+	for _, filename := range sortedFilenames(charts) {
+		if referenced[filename] {
+			continue
+		}
+
+		chart := charts[filename]
+		if idx.Has(chart.name, chart.version) {
+			log.Printf("[WARN] chart file %s is a duplicate of indexed chart %s %s, skipping", filename, chart.name, chart.version)
+			continue
+		}
+		if err := idx.Add(chart.info.Meta.Value(), filename, baseURL, chart.indexDigest()); err != nil {
+			return errors.Wrapf(err, "add chart %s to the index", filename)
+		}
+		if t, ok := created[chart.name+"-"+chart.version]; ok {
+			if err := setCreated(idx, chart.name, chart.version, t); err != nil {
+				return errors.WithMessagef(err, "keep creation time of chart %s", filename)
+			}
+		}
+	}
+
+	idx.SortEntries()
+	return nil
+}
+
+// setCreated sets the creation time of the index entry of the chart version.
+func setCreated(idx helmutil.Index, name, version string, created time.Time) error {
+	b, err := idx.MarshalEntry(name, version)
+	if err != nil {
+		return err
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return errors.Wrap(err, "unmarshal index entry")
+	}
+	entry["created"] = created
+	if b, err = json.Marshal(entry); err != nil {
+		return errors.Wrap(err, "marshal index entry")
+	}
+
+	if _, err := idx.Delete(name, version); err != nil {
+		return err
+	}
+	return idx.RestoreEntry(b)
+}
+
+// printDrift prints the drift to w in the form of a table.
+func printDrift(w io.Writer, drifts []drift) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "PROBLEM\tCHART\tVERSION\tFILE\tDETAIL")
+	for _, d := range drifts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.kind, d.name, d.version, d.filename, d.detail)
+	}
+	return tw.Flush()
+}
+
+// sortedFilenames returns the file names of the charts in sorted order.
+func sortedFilenames(charts map[string]verifiedChart) []string {
+	filenames := make([]string, 0, len(charts))
+	for filename := range charts {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
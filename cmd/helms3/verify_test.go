@@ -0,0 +1,220 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyAction(t *testing.T) {
+	pushChart := func(t *testing.T, repo testRepo) {
+		push := pushAction{chartPaths: []string{testChartPath}, repoName: testRepoName}
+		require.NoError(t, push.Run(context.Background()))
+	}
+
+	testCases := map[string]struct {
+		setup               func(t *testing.T, repo testRepo)
+		deep                bool
+		expectDrift         []string
+		expectDriftAfterFix []string
+		expectIndexed       bool
+		expectEntryKept     bool
+	}{
+		"consistent": {
+			setup:         pushChart,
+			expectIndexed: true,
+		},
+		"consistent deep": {
+			setup:         pushChart,
+			deep:          true,
+			expectIndexed: true,
+		},
+		"missing object": {
+			setup: func(t *testing.T, repo testRepo) {
+				pushChart(t, repo)
+				repo.removeFile(t, "foo-1.2.3.tgz")
+			},
+			expectDrift: []string{driftMissingObject},
+		},
+		"not indexed": {
+			setup: func(t *testing.T, repo testRepo) {
+				b, err := os.ReadFile(testChartPath)
+				require.NoError(t, err)
+				repo.putFile(t, "foo-1.2.3.tgz", b)
+			},
+			expectDrift:   []string{driftNotIndexed},
+			expectIndexed: true,
+		},
+		"digest mismatch": {
+			setup: func(t *testing.T, repo testRepo) {
+				pushChart(t, repo)
+				corruptIndexDigest(t, repo)
+			},
+			expectDrift:   []string{driftDigestMismatch},
+			expectIndexed: true,
+		},
+		"digest mismatch deep": {
+			setup: func(t *testing.T, repo testRepo) {
+				pushChart(t, repo)
+				corruptIndexDigest(t, repo)
+			},
+			deep:          true,
+			expectDrift:   []string{driftDigestMismatch},
+			expectIndexed: true,
+		},
+		"stale metadata deep": {
+			setup: func(t *testing.T, repo testRepo) {
+				pushChart(t, repo)
+				corruptChartDigestMetadata(t, repo)
+			},
+			deep:        true,
+			expectDrift: []string{driftStaleMetadata},
+			// The index entry is right, so it is left alone.
+			expectDriftAfterFix: []string{driftStaleMetadata},
+			expectIndexed:       true,
+			expectEntryKept:     true,
+		},
+		"duplicate version": {
+			setup: func(t *testing.T, repo testRepo) {
+				b, err := os.ReadFile(testChartPath)
+				require.NoError(t, err)
+				repo.putFile(t, "foo-1.2.3.tgz", b)
+				repo.putFile(t, "foo-copy.tgz", b)
+
+				act := reindexAction{repoName: testRepoName, lockTTL: time.Minute}
+				require.NoError(t, act.Run(context.Background()))
+			},
+			expectDrift: []string{driftDuplicateVersion},
+			// The copy cannot be indexed next to the original.
+			expectDriftAfterFix: []string{driftNotIndexed},
+			expectIndexed:       true,
+		},
+	}
+
+	for backendName, setup := range testBackends {
+		for name, tc := range testCases {
+			setup, tc := setup, tc
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				repo := setup(t)
+				tc.setup(t, repo)
+				before := repo.index(t)
+
+				act := verifyAction{
+					repoName: testRepoName,
+					lockTTL:  time.Minute,
+					deep:     tc.deep,
+				}
+				requireDrift(t, act, tc.expectDrift)
+
+				act.fix = true
+				var err error
+				captureStdout(t, func() {
+					err = act.Run(context.Background())
+				})
+				require.NoError(t, err)
+
+				// Repaired entries keep their creation time.
+				if tc.expectIndexed && before.Has(testChartName, testChartVersion) {
+					created := indexEntry(t, before, testChartName, testChartVersion).Created
+					entry := indexEntry(t, repo.index(t), testChartName, testChartVersion)
+					require.True(t, created.Equal(entry.Created), "created %s, want %s", entry.Created, created)
+				}
+				if tc.expectEntryKept {
+					require.Equal(t, indexEntry(t, before, testChartName, testChartVersion), indexEntry(t, repo.index(t), testChartName, testChartVersion))
+				}
+
+				act.fix = false
+				requireDrift(t, act, tc.expectDriftAfterFix)
+
+				entries := repo.index(t).Entries()
+				if tc.expectIndexed {
+					require.Len(t, entries, 1)
+					require.Equal(t, testChartName, entries[0].Name)
+					require.Equal(t, testChartVersion, entries[0].Version)
+				} else {
+					require.Empty(t, entries)
+				}
+			})
+		}
+	}
+}
+
+// requireDrift runs the verify action and requires it to report exactly the
+// given kinds of drift.
+func requireDrift(t *testing.T, act verifyAction, kinds []string) {
+	t.Helper()
+
+	var err error
+	output := captureStdout(t, func() {
+		err = act.Run(context.Background())
+	})
+	if len(kinds) == 0 {
+		require.NoError(t, err)
+		require.Contains(t, string(output), "matches its contents")
+		return
+	}
+
+	require.Equal(t, ErrIndexDrift, err)
+	lines := bytes.Split(bytes.TrimSpace(output), []byte("\n"))
+	require.Len(t, lines, len(kinds)+1)
+	for i, kind := range kinds {
+		require.True(t, bytes.HasPrefix(lines[i+1], []byte(kind)), "unexpected drift: %s", lines[i+1])
+	}
+}
+
+// corruptIndexDigest replaces the digest of the chart in the repository index.
+func corruptIndexDigest(t *testing.T, repo testRepo) {
+	t.Helper()
+
+	idx := repo.index(t)
+	b, err := idx.MarshalBinary()
+	require.NoError(t, err)
+
+	digest := []byte(idx.Entries()[0].Digest)
+	b = bytes.ReplaceAll(b, digest, bytes.Repeat([]byte("f"), len(digest)))
+	repo.putFile(t, "index.yaml", b)
+}
+
+// corruptChartDigestMetadata replaces the chart-digest metadata of the chart
+// in the repository, leaving the chart file and the index as they are.
+func corruptChartDigestMetadata(t *testing.T, repo testRepo) {
+	t.Helper()
+
+	digest := indexEntry(t, repo.index(t), testChartName, testChartVersion).Digest
+	stale := strings.Repeat("f", len(digest))
+
+	if repo.server != nil {
+		obj, ok := repo.server.Object("test-bucket", "charts/foo-1.2.3.tgz")
+		require.True(t, ok)
+		require.Equal(t, digest, obj.Metadata["Chart-Digest"])
+		obj.Metadata["Chart-Digest"] = stale
+		repo.server.PutObject("test-bucket", "charts/foo-1.2.3.tgz", obj.Body, obj.Metadata)
+		return
+	}
+
+	fpath := filepath.Join(repo.dir, "foo-1.2.3.tgz.meta.json")
+	b, err := os.ReadFile(fpath)
+	require.NoError(t, err)
+	require.Contains(t, string(b), digest)
+	require.NoError(t, os.WriteFile(fpath, bytes.ReplaceAll(b, []byte(digest), []byte(stale)), 0644))
+}
@@ -1,6 +1,6 @@
 module github.com/banzaicloud/helm-s3
 
-go 1.15
+go 1.16
 
 // See: https://github.com/helm/helm/issues/9354
 replace (
@@ -12,7 +12,7 @@ require (
 	emperror.dev/errors v0.8.0
 	github.com/Masterminds/semver v1.5.0
 	github.com/Masterminds/semver/v3 v3.1.1
-	github.com/alecthomas/units v0.0.0-20210208195552-ff826a37aa15 // indirect
+	github.com/alecthomas/units v0.0.0-20210208195552-ff826a37aa15
 	github.com/aws/aws-sdk-go v1.38.35
 	github.com/ghodss/yaml v1.0.0
 	github.com/google/go-cmp v0.5.5 // indirect
@@ -0,0 +1,307 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awss3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+)
+
+const (
+	// defaultDownloadPartSize is the size of the parts of the objects
+	// downloaded by parallel ranged requests.
+	defaultDownloadPartSize = 8 << 20
+
+	// defaultDownloadConcurrency is the number of parts downloaded in
+	// parallel.
+	defaultDownloadConcurrency = 4
+
+	// defaultParallelDownloadThreshold is the size of the objects above which
+	// they are downloaded in parts by parallel ranged requests.
+	defaultParallelDownloadThreshold = 32 << 20
+
+	// downloadRetries is the number of times an interrupted download of an
+	// object or a part is resumed.
+	downloadRetries = 3
+)
+
+// downloadRetryBackoff is the delay before resuming an interrupted download
+// the first time. It is doubled after every retry. Tests shorten it.
+var downloadRetryBackoff = 100 * time.Millisecond
+
+// Download streams the object from URI to w.
+//
+// A download interrupted by a network error is resumed by requesting the rest
+// of the object by byte range. Objects larger than the parallel download
+// threshold are downloaded in parts by parallel ranged requests, holding only
+// the parts being downloaded in memory.
+// Uri must be in the form of s3 protocol: s3://bucket-name/key[...].
+func (s *Storage) Download(ctx context.Context, uri string, w io.Writer) error {
+	_, err := s.DownloadIfNoneMatch(ctx, uri, "", w)
+	return err
+}
+
+// DownloadIfNoneMatch streams the object from URI to w like Download, unless
+// the ETag of the object is etag, in which case it returns
+// backend.ErrNotModified. It returns the ETag of the downloaded object.
+// Uri must be in the form of s3 protocol: s3://bucket-name/key[...].
+func (s *Storage) DownloadIfNoneMatch(ctx context.Context, uri, etag string, w io.Writer) (string, error) {
+	bucket, key, err := parseURI(uri)
+	if err != nil {
+		return "", err
+	}
+
+	d := &objectDownload{client: s3.New(s.session), bucket: bucket, key: key}
+
+	// Only the first part is requested, so that the rest of a large object
+	// is not streamed before it is requested in parts anyway. The size of
+	// the object is told by the content range of the response.
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", s.downloadPartSize-1)),
+	}
+	if etag != "" {
+		input.IfNoneMatch = aws.String(etag)
+	}
+	out, err := d.client.GetObjectWithContext(ctx, input)
+	if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() == http.StatusRequestedRangeNotSatisfiable {
+		// The object is empty, which has no range.
+		input.Range = nil
+		out, err = d.client.GetObjectWithContext(ctx, input)
+	}
+	if err != nil {
+		if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() == http.StatusNotModified {
+			return "", backend.ErrNotModified
+		}
+		if nfErr := notFoundError(err); nfErr != nil {
+			return "", nfErr
+		}
+		return "", errors.Wrap(err, "fetch object from s3")
+	}
+	d.etag = aws.StringValue(out.ETag)
+	first := aws.Int64Value(out.ContentLength)
+	size, err := objectSize(out)
+	if err != nil {
+		out.Body.Close()
+		return "", err
+	}
+
+	// The first part is read from the response at hand. The rest is
+	// requested at once, or in parts in parallel if the object is large.
+	if err := d.copyRange(ctx, out.Body, 0, first, w); err != nil {
+		return "", err
+	}
+	if first >= size {
+		return d.etag, nil
+	}
+	if size <= s.parallelDownloadThreshold {
+		if err := d.copyRange(ctx, nil, first, size, w); err != nil {
+			return "", err
+		}
+		return d.etag, nil
+	}
+	if err := d.copyParts(ctx, first, size, s.downloadPartSize, s.downloadConcurrency, w); err != nil {
+		return "", err
+	}
+	return d.etag, nil
+}
+
+// objectSize returns the size of the object given the response to a ranged
+// request, which is the whole object if the range was not applied.
+func objectSize(out *s3.GetObjectOutput) (int64, error) {
+	rng := aws.StringValue(out.ContentRange)
+	if rng == "" {
+		return aws.Int64Value(out.ContentLength), nil
+	}
+
+	i := strings.LastIndex(rng, "/")
+	if i < 0 {
+		return 0, fmt.Errorf("invalid content range %q", rng)
+	}
+	size, err := strconv.ParseInt(rng[i+1:], 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid content range %q", rng)
+	}
+	return size, nil
+}
+
+// objectDownload is an object being downloaded.
+type objectDownload struct {
+	client      *s3.S3
+	bucket, key string
+
+	// etag is the ETag of the object as of the first request. Later requests
+	// are conditional on it, so that the parts of different object versions
+	// are never mixed.
+	etag string
+}
+
+// getRange requests the byte range of the object.
+func (d *objectDownload) getRange(ctx context.Context, rng string) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.key),
+		Range:  aws.String(rng),
+	}
+	if d.etag != "" {
+		input.IfMatch = aws.String(d.etag)
+	}
+	return d.client.GetObjectWithContext(ctx, input)
+}
+
+// copyRange copies the bytes of the object from offset to end, exclusive, to
+// w. The bytes are read from body if it is set, otherwise they are requested.
+// If requesting or reading the bytes fails, the rest of the range is requested
+// again. It always closes the body.
+func (d *objectDownload) copyRange(ctx context.Context, body io.ReadCloser, offset, end int64, w io.Writer) error {
+	for retries := 0; ; retries++ {
+		if body == nil {
+			out, err := d.getRange(ctx, fmt.Sprintf("bytes=%d-%d", offset, end-1))
+			if err != nil {
+				// An object changed since the first request is not requested
+				// again, as it would not match the bytes already written.
+				if retries == downloadRetries || isPreconditionFailed(err) || ctx.Err() != nil {
+					return errors.Wrap(err, "fetch object from s3")
+				}
+				if err := waitRetry(ctx, retries); err != nil {
+					return errors.Wrap(err, "fetch object from s3")
+				}
+				continue
+			}
+			body = out.Body
+		}
+
+		ew := &errWriter{w: w}
+		n, err := io.Copy(ew, io.LimitReader(body, end-offset))
+		body.Close()
+		body = nil
+		offset += n
+
+		if ew.err != nil {
+			return errors.Wrap(ew.err, "write object")
+		}
+		if err == nil && offset < end {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			return nil
+		}
+		if retries == downloadRetries {
+			return errors.Wrap(err, "read object from s3")
+		}
+		if err := waitRetry(ctx, retries); err != nil {
+			return errors.Wrap(err, "read object from s3")
+		}
+	}
+}
+
+// waitRetry waits before the retry following the number of retries so far,
+// doubling the delay after every retry.
+func waitRetry(ctx context.Context, retries int) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(downloadRetryBackoff << retries):
+		return nil
+	}
+}
+
+// copyParts downloads the bytes of the object from offset to size in parts by
+// concurrent ranged requests and writes them to w in order.
+func (d *objectDownload) copyParts(ctx context.Context, offset, size, partSize int64, concurrency int, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type part struct {
+		b   []byte
+		err error
+	}
+
+	var parts []chan part
+	for start := offset; start < size; start += partSize {
+		parts = append(parts, make(chan part, 1))
+	}
+
+	// A part is requested only once there is room for it among the parts
+	// held in memory, which is freed as the parts are written.
+	sem := make(chan struct{}, concurrency)
+	go func() {
+		for i := range parts {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			start := offset + int64(i)*partSize
+			end := start + partSize
+			if end > size {
+				end = size
+			}
+			go func(i int, start, end int64) {
+				buf := bytes.NewBuffer(make([]byte, 0, end-start))
+				err := d.copyRange(ctx, nil, start, end, buf)
+				parts[i] <- part{b: buf.Bytes(), err: err}
+			}(i, start, end)
+		}
+	}()
+
+	for _, ch := range parts {
+		var p part
+		select {
+		case p = <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if p.err != nil {
+			return p.err
+		}
+		if _, err := w.Write(p.b); err != nil {
+			return errors.Wrap(err, "write object")
+		}
+		<-sem
+	}
+
+	return nil
+}
+
+// errWriter records the error of the writer, to tell it from the errors of
+// the reader when copying.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	n, err := ew.w.Write(p)
+	if err != nil {
+		ew.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,276 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awss3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+)
+
+// lockFilename is the name of the lock object in the repository.
+const lockFilename = ".helm-s3.lock"
+
+// Lock is an advisory lock held on a repository.
+// It implements backend.Lock.
+//
+// S3 offers no transactions, so the lock only protects against other
+// helm-s3 processes that also use the lock. It is not safe for concurrent use.
+type Lock struct {
+	storage *Storage
+	uri     string
+	info    backend.LockInfo
+
+	// etag is the ETag of the lock object as last written by us.
+	etag string
+}
+
+// Info returns information about the lock.
+func (l *Lock) Info() backend.LockInfo {
+	return l.info
+}
+
+// Renew extends the lock to expire ttl from now. The lock object is replaced
+// only if it is still the one written by us.
+func (l *Lock) Renew(ctx context.Context, ttl time.Duration) error {
+	bucket, key, err := parseURI(l.uri)
+	if err != nil {
+		return err
+	}
+
+	info := l.info
+	info.Expires = time.Now().UTC().Add(ttl)
+	etag, err := l.storage.putLock(ctx, bucket, key, info, map[string]string{"If-Match": l.etag})
+	if err != nil {
+		if isPreconditionFailed(err) || notFoundError(err) == backend.ErrObjectNotFound {
+			return backend.ErrLocked
+		}
+		return errors.Wrap(err, "put lock object to s3")
+	}
+
+	l.info, l.etag = info, etag
+	return nil
+}
+
+// Release releases the lock if it is still held by us.
+//
+// The lock object is deleted only if it has the ETag it was read with, so
+// that a lock taken over in the meantime is not deleted. S3 compatible
+// backends that ignore conditional deletes leave a short window between the
+// read and the delete, in which the lock could be taken over and deleted.
+func (l *Lock) Release(ctx context.Context) error {
+	bucket, key, err := parseURI(l.uri)
+	if err != nil {
+		return err
+	}
+
+	current, etag, err := l.storage.fetchLock(ctx, bucket, key)
+	if err != nil {
+		if err == backend.ErrObjectNotFound {
+			// Somebody has broken the lock, nothing to release.
+			return nil
+		}
+		return err
+	}
+	if current.Owner != l.info.Owner {
+		// The lock expired and was taken over by somebody else.
+		return nil
+	}
+
+	_, err = s3.New(l.storage.session).DeleteObjectWithContext(
+		ctx,
+		&s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		},
+		// The SDK has no field for conditional deletes, so If-Match is set
+		// as a header.
+		request.WithSetRequestHeaders(map[string]string{"If-Match": etag}),
+	)
+	if err != nil {
+		if isPreconditionFailed(err) || notFoundError(err) == backend.ErrObjectNotFound {
+			// The lock was taken over or broken since we read it.
+			return nil
+		}
+		return errors.Wrap(err, "delete lock object from s3")
+	}
+
+	return nil
+}
+
+// AcquireLock acquires the advisory lock on the repository for the given
+// duration. If the repository is already locked by someone else, it returns
+// backend.ErrLocked. Locks that have expired are taken over.
+// RepoURI must be in the form of s3 protocol: s3://bucket-name/key[...].
+func (s *Storage) AcquireLock(ctx context.Context, repoURI string, ttl time.Duration) (backend.Lock, error) {
+	uri := lockURI(repoURI)
+	bucket, key, err := parseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now().UTC()
+	info := backend.LockInfo{
+		Owner:    uuid.New().String(),
+		Hostname: hostname,
+		Acquired: now,
+		Expires:  now.Add(ttl),
+	}
+
+	// The lock object is only created if it does not exist yet, or replaced
+	// if it is still the same stale lock we have just seen.
+	var condition map[string]string
+	current, etag, err := s.fetchLock(ctx, bucket, key)
+	switch {
+	case err == backend.ErrObjectNotFound:
+		condition = map[string]string{"If-None-Match": "*"}
+	case err != nil:
+		return nil, err
+	case !current.Expired():
+		return nil, lockedError(current)
+	default:
+		condition = map[string]string{"If-Match": etag}
+	}
+
+	if _, err := s.putLock(ctx, bucket, key, info, condition); err != nil {
+		if isPreconditionFailed(err) {
+			return nil, backend.ErrLocked
+		}
+		return nil, errors.Wrap(err, "put lock object to s3")
+	}
+
+	// S3 compatible backends may silently ignore conditional headers, so
+	// make sure that we are the one who won the race.
+	current, etag, err = s.fetchLock(ctx, bucket, key)
+	if err != nil {
+		return nil, errors.WithMessage(err, "verify lock")
+	}
+	if current.Owner != info.Owner {
+		return nil, lockedError(current)
+	}
+
+	return &Lock{storage: s, uri: uri, info: info, etag: etag}, nil
+}
+
+// FetchLock returns information about the current repository lock or nil
+// if the repository is not locked.
+// RepoURI must be in the form of s3 protocol: s3://bucket-name/key[...].
+func (s *Storage) FetchLock(ctx context.Context, repoURI string) (*backend.LockInfo, error) {
+	bucket, key, err := parseURI(lockURI(repoURI))
+	if err != nil {
+		return nil, err
+	}
+
+	info, _, err := s.fetchLock(ctx, bucket, key)
+	if err != nil {
+		if err == backend.ErrObjectNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// BreakLock unconditionally removes the repository lock, regardless of who
+// is holding it.
+// RepoURI must be in the form of s3 protocol: s3://bucket-name/key[...].
+func (s *Storage) BreakLock(ctx context.Context, repoURI string) error {
+	return s.Delete(ctx, lockURI(repoURI))
+}
+
+// putLock uploads the lock object with the conditional headers and returns its
+// ETag.
+func (s *Storage) putLock(ctx context.Context, bucket, key string, info backend.LockInfo, condition map[string]string) (string, error) {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal lock info")
+	}
+
+	out, err := s3.New(s.session).PutObjectWithContext(
+		ctx,
+		&s3.PutObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			ContentType:          aws.String("application/json"),
+			ServerSideEncryption: s.getSSE(),
+			SSEKMSKeyId:          s.getSSEKMSKeyID(),
+			Body:                 bytes.NewReader(b),
+		},
+		request.WithSetRequestHeaders(condition),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(out.ETag), nil
+}
+
+// fetchLock downloads the lock object and returns the lock info along with
+// the object ETag.
+func (s *Storage) fetchLock(ctx context.Context, bucket, key string) (backend.LockInfo, string, error) {
+	out, err := s3.New(s.session).GetObjectWithContext(
+		ctx,
+		&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	if err != nil {
+		if nfErr := notFoundError(err); nfErr != nil {
+			return backend.LockInfo{}, "", nfErr
+		}
+		return backend.LockInfo{}, "", errors.Wrap(err, "fetch lock object from s3")
+	}
+	defer out.Body.Close()
+
+	b, err := io.ReadAll(out.Body)
+	if err != nil {
+		return backend.LockInfo{}, "", errors.Wrap(err, "read lock object from s3")
+	}
+
+	var info backend.LockInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return backend.LockInfo{}, "", errors.Wrap(err, "unmarshal lock info")
+	}
+
+	return info, aws.StringValue(out.ETag), nil
+}
+
+// lockedError returns backend.ErrLocked annotated with the current lock holder.
+func lockedError(info backend.LockInfo) error {
+	return errors.Wrapf(
+		backend.ErrLocked,
+		"held by %s on host %s until %s",
+		info.Owner, info.Hostname, info.Expires.Format(time.RFC3339),
+	)
+}
+
+// lockURI returns the URI of the lock object for the repository.
+func lockURI(repoURI string) string {
+	return strings.TrimSuffix(repoURI, "/") + "/" + lockFilename
+}
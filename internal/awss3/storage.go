@@ -19,17 +19,21 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/pkg/errors"
 
+	"github.com/banzaicloud/helm-s3/internal/awsutil"
+	"github.com/banzaicloud/helm-s3/internal/backend"
 	"github.com/banzaicloud/helm-s3/internal/helmutil"
 )
 
@@ -40,47 +44,109 @@ const (
 	// S3MetadataSoftLimitBytes is application-specific soft limit
 	// for the number of bytes in S3 object metadata.
 	s3MetadataSoftLimitBytes = 1900
-)
 
-var (
-	// ErrBucketNotFound signals that a bucket was not found.
-	ErrBucketNotFound = errors.New("bucket not found")
+	// deleteObjectsMaxKeys is the maximum number of keys S3 deletes in a
+	// single DeleteObjects request.
+	deleteObjectsMaxKeys = 1000
 
-	// ErrObjectNotFound signals that an object was not found.
-	ErrObjectNotFound = errors.New("object not found")
+	// errCodeNoSuchVersion is the S3 error code of requests for a missing
+	// object version.
+	errCodeNoSuchVersion = "NoSuchVersion"
 )
 
+func init() {
+	backend.Register("s3", func(uri string) (backend.Storage, error) {
+		sess, err := awsutil.Session(awsutil.DynamicBucketRegion(uri))
+		if err != nil {
+			return nil, err
+		}
+		return New(sess), nil
+	})
+}
+
 // New returns a new Storage.
 func New(session *session.Session) *Storage {
-	return &Storage{session: session}
+	return &Storage{
+		session:                   session,
+		downloadPartSize:          defaultDownloadPartSize,
+		downloadConcurrency:       defaultDownloadConcurrency,
+		parallelDownloadThreshold: defaultParallelDownloadThreshold,
+	}
+}
+
+// Storage provides an interface to work with AWS S3 objects by s3 protocol.
+// It implements backend.Storage, backend.Encrypter, backend.Versioner and
+// backend.ConditionalDownloader.
+type Storage struct {
+	session *session.Session
+
+	// sse and sseKMSKeyID are the server-side encryption settings set by
+	// SetEncryption.
+	sse         string
+	sseKMSKeyID string
+
+	// downloadPartSize, downloadConcurrency and parallelDownloadThreshold
+	// control the parallel ranged requests of Download.
+	downloadPartSize          int64
+	downloadConcurrency       int
+	parallelDownloadThreshold int64
+}
+
+// SetEncryption sets the server-side encryption mode and the KMS key used for
+// the objects put to the storage. The AWS_S3_SSE environment variable takes
+// precedence over the mode.
+func (s *Storage) SetEncryption(mode, kmsKeyID string) {
+	s.sse = mode
+	s.sseKMSKeyID = kmsKeyID
 }
 
-// Returns desired encryption.
-func getSSE() *string {
+// getSSE returns the desired server-side encryption mode.
+func (s *Storage) getSSE() *string {
 	sse := os.Getenv(awsS3encryption)
+	if sse == "" {
+		sse = s.sse
+	}
 	if sse == "" {
 		return nil
 	}
 	return &sse
 }
 
-// Storage provides an interface to work with AWS S3 objects by s3 protocol.
-type Storage struct {
-	session *session.Session
+// getSSEKMSKeyID returns the KMS key to encrypt the objects with. It is set
+// only if the objects are encrypted with KMS.
+func (s *Storage) getSSEKMSKeyID() *string {
+	if s.sseKMSKeyID == "" || aws.StringValue(s.getSSE()) != s3.ServerSideEncryptionAwsKms {
+		return nil
+	}
+	return aws.String(s.sseKMSKeyID)
 }
 
-// Traverse traverses all charts in the repository.
-func (s *Storage) Traverse(ctx context.Context, repoURI string) (<-chan ChartInfo, <-chan error) {
-	charts := make(chan ChartInfo, 1)
+// Traverse traverses all charts in the repository. Chart metadata is fetched
+// by up to opts.Concurrency parallel requests, but the charts are always
+// returned in the listing order.
+func (s *Storage) Traverse(ctx context.Context, repoURI string, opts backend.TraverseOptions) (<-chan backend.ChartInfo, <-chan error) {
+	charts := make(chan backend.ChartInfo, 1)
 	errs := make(chan error, 1)
-	go s.traverse(ctx, repoURI, charts, errs)
+	go s.traverse(ctx, repoURI, opts, charts, errs)
 	return charts, errs
 }
 
+// chartResult is the result of fetching info about a single chart.
+type chartResult struct {
+	item backend.ChartInfo
+	err  error
+}
+
+// pendingChart is a chart being processed.
+type pendingChart struct {
+	key    string
+	result chan chartResult
+}
+
 // traverse traverses all charts in the repository.
 // It writes an info item about every chart to items, and errors to errs.
 // It always closes both channels when returns.
-func (s *Storage) traverse(ctx context.Context, repoURI string, items chan<- ChartInfo, errs chan<- error) {
+func (s *Storage) traverse(ctx context.Context, repoURI string, opts backend.TraverseOptions, items chan<- backend.ChartInfo, errs chan<- error) {
 	defer close(items)
 	defer close(errs)
 
@@ -90,30 +156,108 @@ func (s *Storage) traverse(ctx context.Context, repoURI string, items chan<- Cha
 		return
 	}
 
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// Stop the listing and the workers when we return early.
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Every listed chart gets its own result channel, which are queued in the
+	// listing order. The queue capacity bounds the number of charts being
+	// processed at the same time.
+	pending := make(chan pendingChart, concurrency-1)
+	go s.listCharts(listCtx, bucket, prefixKey, opts, pending)
+
+	for chart := range pending {
+		if err := ctx.Err(); err != nil {
+			errs <- errors.Wrapf(err, "process s3 object %s", chart.key)
+			return
+		}
+
+		var res chartResult
+		select {
+		case res = <-chart.result:
+		case <-ctx.Done():
+			errs <- errors.Wrapf(ctx.Err(), "process s3 object %s", chart.key)
+			return
+		}
+		if res.err != nil {
+			errs <- res.err
+			return
+		}
+
+		select {
+		case items <- res.item:
+		case <-ctx.Done():
+			errs <- errors.Wrapf(ctx.Err(), "process s3 object %s", chart.key)
+			return
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		errs <- errors.Wrap(err, "list s3 bucket objects")
+	}
+}
+
+// listCharts lists all charts in the repository and starts fetching info about
+// every modified chart in a separate goroutine. It queues every chart to
+// pending, and closes pending when returns.
+func (s *Storage) listCharts(
+	ctx context.Context,
+	bucket string,
+	prefixKey string,
+	opts backend.TraverseOptions,
+	pending chan<- pendingChart,
+) {
+	defer close(pending)
+
+	// queue queues the chart unless ctx is done.
+	queue := func(chart pendingChart) bool {
+		select {
+		case pending <- chart:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
 	client := s3.New(s.session)
 
+	// List the repository folder only. The delimiter makes S3 collapse
+	// subfolders into common prefixes, so that their content is never
+	// enumerated, because chart repository is flat and cannot contain nested
+	// directories. Repos can be s3://bucket/repo/subdir OR
+	// s3://bucket/repo/subdir/, so make sure the prefix is a folder.
+	prefix := prefixKey
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
 	var continuationToken *string
 	for {
-		listOut, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
+		listOut, err := client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
 			Bucket:            aws.String(bucket),
-			Prefix:            aws.String(prefixKey),
+			Prefix:            aws.String(prefix),
+			Delimiter:         aws.String("/"),
 			ContinuationToken: continuationToken,
 		})
 		if err != nil {
-			errs <- errors.Wrap(err, "list s3 bucket objects")
+			result := make(chan chartResult, 1)
+			result <- chartResult{err: errors.Wrap(err, "list s3 bucket objects")}
+			queue(pendingChart{key: prefix, result: result})
 			return
 		}
 
 		for _, obj := range listOut.Contents {
 			// We need to make object key relative to repo root.
-			key := strings.TrimPrefix(*obj.Key, prefixKey)
-			// Additionally trim prefix slash if exists, because repos can be:
-			// s3://bucket/repo/subdir OR s3://bucket/repo/subdir/
-			key = strings.TrimPrefix(key, "/")
+			key := strings.TrimPrefix(*obj.Key, prefix)
 
 			if strings.Contains(key, "/") {
-				// This is a subfolder. Ignore it, because chart repository
-				// is flat and cannot contain nested directories.
+				// This is a subfolder listed by a S3 compatible backend
+				// that does not support the delimiter. Ignore it.
 				continue
 			}
 
@@ -124,70 +268,28 @@ func (s *Storage) traverse(ctx context.Context, repoURI string, items chan<- Cha
 				continue
 			}
 
-			metaOut, err := client.HeadObject(&s3.HeadObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    obj.Key,
-			})
-			if err != nil {
-				errs <- errors.Wrap(err, "head s3 object")
+			modified := aws.TimeValue(obj.LastModified)
+
+			result := make(chan chartResult, 1)
+			if !queue(pendingChart{key: *obj.Key, result: result}) {
 				return
 			}
 
-			reindexItem := ChartInfo{Filename: key}
-
-			serializedChartMeta, hasMeta := metaOut.Metadata[strings.Title(metaChartMetadata)]
-			chartDigest, hasDigest := metaOut.Metadata[strings.Title(metaChartDigest)]
-			if !hasMeta || !hasDigest {
-				// Some charts in the repository can have no metadata.
-				//
-				// This might happen in few cases:
-				// - Chart was uploaded manually, not using 'helm s3 push';
-				// - Chart was pushed before we started adding metadata to objects;
-				// - Chart metadata was too big to add to the S3 object metadata (see issues
-				//   https://github.com/hypnoglow/helm-s3/issues/120 and
-				//   https://github.com/hypnoglow/helm-s3/issues/112 )
-				//
-				// In this case we have to download the ch file itself.
-				objectOut, err := client.GetObject(&s3.GetObjectInput{
-					Bucket: aws.String(bucket),
-					Key:    obj.Key,
-				})
-				if err != nil {
-					errs <- errors.Wrap(err, "get s3 object")
-					return
-				}
-
-				buf := &bytes.Buffer{}
-				tr := io.TeeReader(objectOut.Body, buf)
-
-				ch, err := helmutil.LoadArchive(tr)
-				objectOut.Body.Close()
-				if err != nil {
-					errs <- errors.Wrap(err, "load archive from s3 object")
-					return
-				}
+			// The listing tells if the chart was modified, so charts not
+			// modified since they were indexed cost no request at all.
+			if opts.NotModified != nil && opts.NotModified(key, modified) {
+				result <- chartResult{item: backend.ChartInfo{Filename: key, Modified: modified, Unchanged: true}}
+				continue
+			}
 
-				digest, err := helmutil.Digest(buf)
+			go func(objectKey *string, filename string) {
+				item, err := s.chartInfo(ctx, client, bucket, objectKey, filename, opts.Unchanged)
 				if err != nil {
-					errs <- errors.WithMessage(err, "get chart hash")
-					return
+					err = errors.WithMessagef(err, "process s3 object %s", *objectKey)
 				}
-
-				reindexItem.Meta = ch.Metadata()
-				reindexItem.Hash = digest
-			} else {
-				meta := helmutil.NewChartMetadata()
-				if err := meta.UnmarshalJSON([]byte(*serializedChartMeta)); err != nil {
-					errs <- errors.Wrap(err, "unserialize chart meta")
-					return
-				}
-
-				reindexItem.Meta = meta
-				reindexItem.Hash = *chartDigest
-			}
-
-			// Process meta and hash.
-			items <- reindexItem
+				item.Modified = modified
+				result <- chartResult{item: item, err: err}
+			}(obj.Key, key)
 		}
 
 		// Decide if need to load more objects.
@@ -198,11 +300,80 @@ func (s *Storage) traverse(ctx context.Context, repoURI string, items chan<- Cha
 	}
 }
 
-// ChartInfo contains info about particular chart.
-type ChartInfo struct {
-	Meta     helmutil.ChartMetadata
-	Filename string
-	Hash     string
+// chartInfo returns info about the chart object, preferably from the object
+// metadata. The chart is reported unchanged without loading its metadata if
+// unchanged reports so for the digest in the object metadata.
+func (s *Storage) chartInfo(
+	ctx context.Context,
+	client *s3.S3,
+	bucket string,
+	objectKey *string,
+	filename string,
+	unchanged func(filename, digest string) bool,
+) (backend.ChartInfo, error) {
+	metaOut, err := client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    objectKey,
+	})
+	if err != nil {
+		return backend.ChartInfo{}, errors.Wrap(err, "head s3 object")
+	}
+
+	reindexItem := backend.ChartInfo{Filename: filename}
+
+	serializedChartMeta, hasMeta := metaOut.Metadata[strings.Title(metaChartMetadata)]
+	chartDigest, hasDigest := metaOut.Metadata[strings.Title(metaChartDigest)]
+	if hasDigest && unchanged != nil && unchanged(filename, *chartDigest) {
+		reindexItem.Hash = *chartDigest
+		reindexItem.Unchanged = true
+		return reindexItem, nil
+	}
+	if !hasMeta || !hasDigest {
+		// Some charts in the repository can have no metadata.
+		//
+		// This might happen in few cases:
+		// - Chart was uploaded manually, not using 'helm s3 push';
+		// - Chart was pushed before we started adding metadata to objects;
+		// - Chart metadata was too big to add to the S3 object metadata (see issues
+		//   https://github.com/hypnoglow/helm-s3/issues/120 and
+		//   https://github.com/hypnoglow/helm-s3/issues/112 )
+		//
+		// In this case we have to download the ch file itself.
+		objectOut, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    objectKey,
+		})
+		if err != nil {
+			return backend.ChartInfo{}, errors.Wrap(err, "get s3 object")
+		}
+
+		buf := &bytes.Buffer{}
+		tr := io.TeeReader(objectOut.Body, buf)
+
+		ch, err := helmutil.LoadArchive(tr)
+		objectOut.Body.Close()
+		if err != nil {
+			return backend.ChartInfo{}, errors.Wrap(err, "load archive from s3 object")
+		}
+
+		digest, err := helmutil.Digest(buf)
+		if err != nil {
+			return backend.ChartInfo{}, errors.WithMessage(err, "get chart hash")
+		}
+
+		reindexItem.Meta = ch.Metadata()
+		reindexItem.Hash = digest
+	} else {
+		meta := helmutil.NewChartMetadata()
+		if err := meta.UnmarshalJSON([]byte(*serializedChartMeta)); err != nil {
+			return backend.ChartInfo{}, errors.Wrap(err, "unserialize chart meta")
+		}
+
+		reindexItem.Meta = meta
+		reindexItem.Hash = *chartDigest
+	}
+
+	return reindexItem, nil
 }
 
 // FetchRaw downloads the object from URI and returns it in the form of byte slice.
@@ -222,13 +393,8 @@ func (s *Storage) FetchRaw(ctx context.Context, uri string) ([]byte, error) {
 			Key:    aws.String(key),
 		})
 	if err != nil {
-		if ae, ok := err.(awserr.Error); ok {
-			if ae.Code() == s3.ErrCodeNoSuchBucket {
-				return nil, ErrBucketNotFound
-			}
-			if ae.Code() == s3.ErrCodeNoSuchKey {
-				return nil, ErrObjectNotFound
-			}
+		if nfErr := notFoundError(err); nfErr != nil {
+			return nil, nfErr
 		}
 		return nil, errors.Wrap(err, "fetch object from s3")
 	}
@@ -236,6 +402,38 @@ func (s *Storage) FetchRaw(ctx context.Context, uri string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// FetchIndex downloads the index file from URI and returns it in the form of
+// byte slice along with its ETag. The ETag can be passed to PutIndexIfMatch
+// to upload the modified index only if nobody changed it in the meantime.
+// Uri must be in the form of s3 protocol: s3://bucket-name/key[...].
+func (s *Storage) FetchIndex(ctx context.Context, uri string) ([]byte, string, error) {
+	bucket, key, err := parseURI(uri)
+	if err != nil {
+		return nil, "", err
+	}
+
+	out, err := s3.New(s.session).GetObjectWithContext(
+		ctx,
+		&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	if err != nil {
+		if nfErr := notFoundError(err); nfErr != nil {
+			return nil, "", nfErr
+		}
+		return nil, "", errors.Wrap(err, "fetch index from s3")
+	}
+	defer out.Body.Close()
+
+	b, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "read index from s3")
+	}
+
+	return b, aws.StringValue(out.ETag), nil
+}
+
 // Exists returns true if an object exists in the storage.
 func (s *Storage) Exists(ctx context.Context, uri string) (bool, error) {
 	bucket, key, err := parseURI(uri)
@@ -243,10 +441,12 @@ func (s *Storage) Exists(ctx context.Context, uri string) (bool, error) {
 		return false, err
 	}
 
-	_, err = s3.New(s.session).HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
+	_, err = s3.New(s.session).HeadObjectWithContext(
+		ctx,
+		&s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
 	if err != nil {
 		// That's weird that there is no NotFound constant in aws sdk.
 		if ae, ok := err.(awserr.Error); ok && ae.Code() == "NotFound" {
@@ -280,7 +480,8 @@ func (s *Storage) PutChart(
 			Key:                  aws.String(key),
 			ACL:                  aws.String(acl),
 			ContentType:          aws.String(contentType),
-			ServerSideEncryption: getSSE(),
+			ServerSideEncryption: s.getSSE(),
+			SSEKMSKeyId:          s.getSSEKMSKeyID(),
 			Body:                 r,
 			Metadata:             assembleObjectMetadata(chartMeta, chartDigest),
 		},
@@ -292,9 +493,50 @@ func (s *Storage) PutChart(
 	return result.Location, nil
 }
 
+// PutRaw puts the object to the storage as is.
+// Uri must be in the form of s3 protocol: s3://bucket-name/key[...].
+func (s *Storage) PutRaw(ctx context.Context, uri string, r io.Reader, acl, contentType string) error {
+	bucket, key, err := parseURI(uri)
+	if err != nil {
+		return err
+	}
+
+	input := &s3manager.UploadInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		ACL:                  aws.String(acl),
+		ServerSideEncryption: s.getSSE(),
+		SSEKMSKeyId:          s.getSSEKMSKeyID(),
+		Body:                 r,
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+
+	if _, err := s3manager.NewUploader(s.session).UploadWithContext(ctx, input); err != nil {
+		return errors.Wrap(err, "upload object to s3")
+	}
+
+	return nil
+}
+
 // PutIndex puts the index file to the storage.
 // Uri must be in the form of s3 protocol: s3://bucket-name/key[...].
 func (s *Storage) PutIndex(ctx context.Context, uri, acl string, r io.Reader) error {
+	return s.putIndex(ctx, uri, acl, "", r)
+}
+
+// PutIndexIfMatch puts the index file to the storage only if the current
+// index has the given ETag, as returned by FetchIndex. Otherwise it returns
+// backend.ErrIndexModified.
+// Uri must be in the form of s3 protocol: s3://bucket-name/key[...].
+func (s *Storage) PutIndexIfMatch(ctx context.Context, uri, acl, etag string, r io.Reader) error {
+	return s.putIndex(ctx, uri, acl, etag, r)
+}
+
+// putIndex puts the index file to the storage, conditionally on the current
+// index ETag if it is not empty.
+func (s *Storage) putIndex(ctx context.Context, uri, acl, etag string, r io.Reader) error {
 	if strings.HasPrefix(uri, "index.yaml") {
 		return errors.New("uri must not contain \"index.yaml\" suffix, it appends automatically")
 	}
@@ -304,22 +546,154 @@ func (s *Storage) PutIndex(ctx context.Context, uri, acl string, r io.Reader) er
 	if err != nil {
 		return err
 	}
-	_, err = s3manager.NewUploader(s.session).UploadWithContext(
+
+	// The index is uploaded by a single PutObject request even if it is
+	// large, as a multipart upload cannot be made conditional.
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "read index")
+	}
+
+	var opts []request.Option
+	if etag != "" {
+		// The SDK has no field for conditional writes, so If-Match is set
+		// as a header.
+		opts = append(opts, request.WithSetRequestHeaders(map[string]string{"If-Match": etag}))
+	}
+
+	_, err = s3.New(s.session).PutObjectWithContext(
 		ctx,
-		&s3manager.UploadInput{
+		&s3.PutObjectInput{
 			Bucket:               aws.String(bucket),
 			Key:                  aws.String(key),
 			ACL:                  aws.String(acl),
-			ServerSideEncryption: getSSE(),
-			Body:                 r,
-		})
+			ServerSideEncryption: s.getSSE(),
+			SSEKMSKeyId:          s.getSSEKMSKeyID(),
+			Body:                 bytes.NewReader(b),
+		},
+		opts...,
+	)
 	if err != nil {
+		// If-Match fails with NoSuchKey if the index has been deleted.
+		if isPreconditionFailed(err) || (etag != "" && notFoundError(err) == backend.ErrObjectNotFound) {
+			return backend.ErrIndexModified
+		}
 		return errors.Wrap(err, "upload index to S3 bucket")
 	}
 
 	return nil
 }
 
+// Copy copies the object along with its metadata on the server side.
+// Uris must be in the form of s3 protocol: s3://bucket-name/key[...].
+func (s *Storage) Copy(ctx context.Context, srcURI, dstURI, acl string) error {
+	srcBucket, srcKey, err := parseURI(srcURI)
+	if err != nil {
+		return err
+	}
+	dstBucket, dstKey, err := parseURI(dstURI)
+	if err != nil {
+		return err
+	}
+
+	source := (&url.URL{Path: srcBucket + "/" + srcKey}).EscapedPath()
+	_, err = s3.New(s.session).CopyObjectWithContext(
+		ctx,
+		&s3.CopyObjectInput{
+			Bucket:               aws.String(dstBucket),
+			Key:                  aws.String(dstKey),
+			CopySource:           aws.String(source),
+			ACL:                  aws.String(acl),
+			MetadataDirective:    aws.String(s3.MetadataDirectiveCopy),
+			ServerSideEncryption: s.getSSE(),
+			SSEKMSKeyId:          s.getSSEKMSKeyID(),
+		},
+	)
+	if err != nil {
+		if nf := notFoundError(err); nf != nil {
+			return nf
+		}
+		return errors.Wrap(err, "copy object in s3")
+	}
+
+	return nil
+}
+
+// Versions returns the versions of the object, the newest first. Objects in
+// buckets without versioning have the single version "null".
+// Uri must be in the form of s3 protocol: s3://bucket-name/key[...].
+func (s *Storage) Versions(ctx context.Context, uri string) ([]backend.ObjectVersion, error) {
+	bucket, key, err := parseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []backend.ObjectVersion
+	err = s3.New(s.session).ListObjectVersionsPagesWithContext(
+		ctx,
+		&s3.ListObjectVersionsInput{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(key),
+		},
+		func(page *s3.ListObjectVersionsOutput, _ bool) bool {
+			for _, v := range page.Versions {
+				// The prefix matches other keys too, like index.yaml.bak.
+				if aws.StringValue(v.Key) != key {
+					continue
+				}
+				versions = append(versions, backend.ObjectVersion{
+					ID:       aws.StringValue(v.VersionId),
+					Modified: aws.TimeValue(v.LastModified),
+					Latest:   aws.BoolValue(v.IsLatest),
+				})
+			}
+			return true
+		},
+	)
+	if err != nil {
+		if nf := notFoundError(err); nf != nil {
+			return nil, nf
+		}
+		return nil, errors.Wrap(err, "list object versions in s3")
+	}
+
+	return versions, nil
+}
+
+// FetchVersion downloads the version of the object.
+// Uri must be in the form of s3 protocol: s3://bucket-name/key[...].
+func (s *Storage) FetchVersion(ctx context.Context, uri, versionID string) ([]byte, error) {
+	bucket, key, err := parseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := s3.New(s.session).GetObjectWithContext(
+		ctx,
+		&s3.GetObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(key),
+			VersionId: aws.String(versionID),
+		})
+	if err != nil {
+		if ae, ok := err.(awserr.Error); ok && ae.Code() == errCodeNoSuchVersion {
+			return nil, backend.ErrObjectNotFound
+		}
+		if nf := notFoundError(err); nf != nil {
+			return nil, nf
+		}
+		return nil, errors.Wrap(err, "fetch object version from s3")
+	}
+	defer out.Body.Close()
+
+	b, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "read object version from s3")
+	}
+
+	return b, nil
+}
+
 // Delete deletes the object by uri.
 // Uri must be in the form of s3 protocol: s3://bucket-name/key[...].
 func (s *Storage) Delete(ctx context.Context, uri string) error {
@@ -342,6 +716,90 @@ func (s *Storage) Delete(ctx context.Context, uri string) error {
 	return nil
 }
 
+// DeleteBatch deletes the objects by uris using as few DeleteObjects requests
+// as possible.
+// Uris must be in the form of s3 protocol: s3://bucket-name/key[...].
+func (s *Storage) DeleteBatch(ctx context.Context, uris []string) error {
+	// Keys are grouped by bucket, keeping the order of buckets stable.
+	var buckets []string
+	keys := make(map[string][]string)
+	for _, uri := range uris {
+		bucket, key, err := parseURI(uri)
+		if err != nil {
+			return err
+		}
+		if _, ok := keys[bucket]; !ok {
+			buckets = append(buckets, bucket)
+		}
+		keys[bucket] = append(keys[bucket], key)
+	}
+
+	client := s3.New(s.session)
+	for _, bucket := range buckets {
+		for batch := keys[bucket]; len(batch) > 0; {
+			n := len(batch)
+			if n > deleteObjectsMaxKeys {
+				n = deleteObjectsMaxKeys
+			}
+
+			objects := make([]*s3.ObjectIdentifier, n)
+			for i, key := range batch[:n] {
+				objects[i] = &s3.ObjectIdentifier{Key: aws.String(key)}
+			}
+			batch = batch[n:]
+
+			out, err := client.DeleteObjectsWithContext(
+				ctx,
+				&s3.DeleteObjectsInput{
+					Bucket: aws.String(bucket),
+					Delete: &s3.Delete{
+						Objects: objects,
+						Quiet:   aws.Bool(true),
+					},
+				},
+			)
+			if err != nil {
+				return errors.Wrap(err, "delete objects from s3")
+			}
+			if len(out.Errors) > 0 {
+				e := out.Errors[0]
+				return errors.Errorf(
+					"delete objects from s3: failed to delete %d objects, first %s: %s",
+					len(out.Errors), aws.StringValue(e.Key), aws.StringValue(e.Message),
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// notFoundError returns backend.ErrBucketNotFound or backend.ErrObjectNotFound if the AWS
+// error signals a missing bucket or key, otherwise it returns nil.
+func notFoundError(err error) error {
+	if ae, ok := err.(awserr.Error); ok {
+		switch ae.Code() {
+		case s3.ErrCodeNoSuchBucket:
+			return backend.ErrBucketNotFound
+		case s3.ErrCodeNoSuchKey:
+			return backend.ErrObjectNotFound
+		}
+	}
+	return nil
+}
+
+// isPreconditionFailed returns true if the AWS error signals that a
+// conditional write was rejected because the object has been changed.
+func isPreconditionFailed(err error) bool {
+	if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() == http.StatusPreconditionFailed {
+		return true
+	}
+	if ae, ok := err.(awserr.Error); ok {
+		return ae.Code() == "PreconditionFailed" || ae.Code() == "ConditionalRequestConflict"
+	}
+	return false
+}
+
 // parseURI returns bucket and key from URIs like:
 // - s3://bucket-name/dir
 // - s3://bucket-name/dir/file.ext.
@@ -0,0 +1,953 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awss3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/s3test"
+)
+
+const (
+	testBucket  = "test-bucket"
+	testRepoURI = "s3://test-bucket/charts"
+)
+
+// setupStorage returns a Storage backed by a fake S3 server with an empty
+// test bucket.
+func setupStorage(t *testing.T) (*Storage, *s3test.Server) {
+	t.Helper()
+
+	server := s3test.NewServer()
+	t.Cleanup(server.Close)
+	server.CreateBucket(testBucket)
+
+	return New(server.Session()), server
+}
+
+// setenv sets the environment variable for the duration of the test.
+func setenv(t *testing.T, name, value string) {
+	t.Helper()
+
+	old, ok := os.LookupEnv(name)
+	require.NoError(t, os.Setenv(name, value))
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func readTestChart(t *testing.T) []byte {
+	t.Helper()
+
+	b, err := os.ReadFile("../../test/e2e/data/foo-1.2.3.tgz")
+	require.NoError(t, err)
+
+	return b
+}
+
+func TestStorage_Traverse(t *testing.T) {
+	chart := readTestChart(t)
+	chartMeta := `{"name":"foo","version":"1.2.3"}`
+
+	testCases := map[string]struct {
+		setup             func(t *testing.T, storage *Storage, server *s3test.Server)
+		maxKeys           int
+		concurrency       int
+		expectedFilenames []string
+		expectedGets      int
+	}{
+		"metadata": {
+			setup: func(t *testing.T, storage *Storage, server *s3test.Server) {
+				_, err := storage.PutChart(context.Background(), testRepoURI+"/foo-1.2.3.tgz", bytes.NewReader(chart), chartMeta, "", "sha256:foo", "")
+				require.NoError(t, err)
+			},
+			expectedFilenames: []string{"foo-1.2.3.tgz"},
+			expectedGets:      0,
+		},
+		"no metadata": {
+			setup: func(t *testing.T, storage *Storage, server *s3test.Server) {
+				server.PutObject(testBucket, "charts/foo-1.2.3.tgz", chart, nil)
+			},
+			expectedFilenames: []string{"foo-1.2.3.tgz"},
+			expectedGets:      1,
+		},
+		"metadata over the limit": {
+			setup: func(t *testing.T, storage *Storage, server *s3test.Server) {
+				bigMeta := `{"name":"foo","version":"1.2.3","description":"` + strings.Repeat("x", s3test.MetadataLimitBytes) + `"}`
+				_, err := storage.PutChart(context.Background(), testRepoURI+"/foo-1.2.3.tgz", bytes.NewReader(chart), bigMeta, "", "sha256:foo", "")
+				require.NoError(t, err)
+
+				obj, ok := server.Object(testBucket, "charts/foo-1.2.3.tgz")
+				require.True(t, ok)
+				require.Empty(t, obj.Metadata)
+			},
+			expectedFilenames: []string{"foo-1.2.3.tgz"},
+			expectedGets:      1,
+		},
+		"pagination": {
+			setup: func(t *testing.T, storage *Storage, server *s3test.Server) {
+				for _, key := range []string{"a-0.1.0.tgz", "b-0.1.0.tgz", "c-0.1.0.tgz", "index.yaml", "sub/d-0.1.0.tgz"} {
+					server.PutObject(testBucket, "charts/"+key, chart, map[string]string{
+						metaChartMetadata: chartMeta,
+						metaChartDigest:   "sha256:foo",
+					})
+				}
+				server.PutObject(testBucket, "other/e-0.1.0.tgz", chart, nil)
+			},
+			maxKeys:           2,
+			expectedFilenames: []string{"a-0.1.0.tgz", "b-0.1.0.tgz", "c-0.1.0.tgz"},
+			expectedGets:      0,
+		},
+		"concurrency": {
+			setup: func(t *testing.T, storage *Storage, server *s3test.Server) {
+				for i := 0; i < 20; i++ {
+					server.PutObject(testBucket, fmt.Sprintf("charts/foo-0.%02d.0.tgz", i), chart, nil)
+				}
+			},
+			maxKeys:     7,
+			concurrency: 4,
+			expectedFilenames: func() []string {
+				var filenames []string
+				for i := 0; i < 20; i++ {
+					filenames = append(filenames, fmt.Sprintf("foo-0.%02d.0.tgz", i))
+				}
+				return filenames
+			}(),
+			expectedGets: 20,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			storage, server := setupStorage(t)
+			tc.setup(t, storage, server)
+			server.SetMaxKeys(tc.maxKeys)
+
+			items, errs := storage.Traverse(context.Background(), testRepoURI, backend.TraverseOptions{Concurrency: tc.concurrency})
+
+			var filenames []string
+			for item := range items {
+				b, err := item.Meta.MarshalJSON()
+				require.NoError(t, err)
+				require.Contains(t, string(b), `"name":"foo"`)
+				filenames = append(filenames, item.Filename)
+			}
+			require.NoError(t, <-errs)
+
+			// Charts are returned in the listing order.
+			require.Equal(t, tc.expectedFilenames, filenames)
+			require.Equal(t, tc.expectedGets, server.Calls("GetObject"))
+		})
+	}
+}
+
+func TestStorage_Traverse_Subfolders(t *testing.T) {
+	testCases := map[string]struct {
+		repoURI string
+	}{
+		"repo folder": {
+			repoURI: testRepoURI,
+		},
+		"repo folder with trailing slash": {
+			repoURI: testRepoURI + "/",
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			storage, server := setupStorage(t)
+			server.SetMaxKeys(10)
+
+			chart := readTestChart(t)
+			server.PutObject(testBucket, "charts/foo-1.2.3.tgz", chart, nil)
+			server.PutObject(testBucket, "charts-old/foo-1.0.0.tgz", chart, nil)
+			server.PutObject(testBucket, "chartsfoo-1.1.0.tgz", chart, nil)
+			for i := 0; i < 1000; i++ {
+				server.PutObject(testBucket, fmt.Sprintf("charts/big/file-%d.tgz", i), nil, nil)
+			}
+
+			items, errs := storage.Traverse(context.Background(), tc.repoURI, backend.TraverseOptions{Concurrency: 1})
+
+			var filenames []string
+			for item := range items {
+				filenames = append(filenames, item.Filename)
+			}
+			require.NoError(t, <-errs)
+
+			require.Equal(t, []string{"foo-1.2.3.tgz"}, filenames)
+			require.Equal(t, 1, server.Calls("ListObjectsV2"))
+		})
+	}
+}
+
+func TestStorage_Traverse_Canceled(t *testing.T) {
+	storage, server := setupStorage(t)
+	for i := 0; i < 10; i++ {
+		server.PutObject(testBucket, fmt.Sprintf("charts/foo-0.%d.0.tgz", i), readTestChart(t), nil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	items, errs := storage.Traverse(ctx, testRepoURI, backend.TraverseOptions{Concurrency: 4})
+
+	<-items
+	cancel()
+
+	// Drain the items, so that traverse is not blocked on sending them.
+	count := 1
+	for range items {
+		count++
+	}
+	require.Equal(t, context.Canceled, errors.Cause(<-errs))
+	require.Less(t, count, 10)
+}
+
+func TestStorage_Traverse_Timeout(t *testing.T) {
+	storage, server := setupStorage(t)
+	for i := 0; i < 10; i++ {
+		server.PutObject(testBucket, fmt.Sprintf("charts/foo-0.%d.0.tgz", i), readTestChart(t), nil)
+	}
+	server.InjectFailure(s3test.Failure{Op: "HeadObject", Key: "charts/foo-0.3.0.tgz", Delay: time.Minute})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	items, errs := storage.Traverse(ctx, testRepoURI, backend.TraverseOptions{Concurrency: 2})
+
+	var count int
+	for range items {
+		count++
+	}
+	err := <-errs
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "charts/foo-0.3.0.tgz")
+	require.LessOrEqual(t, count, 3)
+	require.Less(t, time.Since(start), 10*time.Second)
+}
+
+func TestStorage_Exists(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testCases := map[string]struct {
+		ctx         context.Context
+		uri         string
+		expected    bool
+		expectError bool
+	}{
+		"existing object": {
+			ctx:      context.Background(),
+			uri:      testRepoURI + "/foo-1.2.3.tgz",
+			expected: true,
+		},
+		"missing object": {
+			ctx:      context.Background(),
+			uri:      testRepoURI + "/bar-1.2.3.tgz",
+			expected: false,
+		},
+		"canceled context": {
+			ctx:         canceled,
+			uri:         testRepoURI + "/foo-1.2.3.tgz",
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			storage, server := setupStorage(t)
+			server.PutObject(testBucket, "charts/foo-1.2.3.tgz", readTestChart(t), nil)
+
+			exists, err := storage.Exists(tc.ctx, tc.uri)
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, exists)
+		})
+	}
+}
+
+func TestStorage_FetchRaw(t *testing.T) {
+	testCases := map[string]struct {
+		uri         string
+		failure     *s3test.Failure
+		expectedErr error
+	}{
+		"existing object": {
+			uri:         testRepoURI + "/index.yaml",
+			expectedErr: nil,
+		},
+		"missing object": {
+			uri:         testRepoURI + "/missing.yaml",
+			expectedErr: backend.ErrObjectNotFound,
+		},
+		"missing bucket": {
+			uri:         "s3://missing-bucket/charts/index.yaml",
+			expectedErr: backend.ErrBucketNotFound,
+		},
+		"access denied": {
+			uri:         testRepoURI + "/index.yaml",
+			failure:     &s3test.Failure{Op: "GetObject", StatusCode: http.StatusForbidden, Code: "AccessDenied"},
+			expectedErr: errors.New("fetch object from s3"),
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			storage, server := setupStorage(t)
+			server.PutObject(testBucket, "charts/index.yaml", []byte("apiVersion: v1\n"), nil)
+			if tc.failure != nil {
+				server.InjectFailure(*tc.failure)
+			}
+
+			b, err := storage.FetchRaw(context.Background(), tc.uri)
+			switch {
+			case tc.expectedErr == nil:
+				require.NoError(t, err)
+				require.Equal(t, "apiVersion: v1\n", string(b))
+			case tc.failure != nil:
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectedErr.Error())
+			default:
+				require.Equal(t, tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestStorage_Download(t *testing.T) {
+	body := make([]byte, 100)
+	for i := range body {
+		body[i] = byte(i)
+	}
+
+	testCases := map[string]struct {
+		uri          string
+		failures     []s3test.Failure
+		parts        bool
+		parallel     bool
+		expectedGets int
+		expectedErr  error
+	}{
+		"object": {
+			uri:          testRepoURI + "/foo-1.2.3.tgz",
+			expectedGets: 1,
+		},
+		"interrupted download": {
+			uri:          testRepoURI + "/foo-1.2.3.tgz",
+			failures:     []s3test.Failure{{Op: "GetObject", Truncate: 30, Times: 2}},
+			expectedGets: 3,
+		},
+		"failed request resuming download": {
+			uri: testRepoURI + "/foo-1.2.3.tgz",
+			failures: []s3test.Failure{
+				{Op: "GetObject", Truncate: 30, Times: 1},
+				// The client retries the request 3 times itself.
+				{Op: "GetObject", StatusCode: http.StatusInternalServerError, Code: "InternalError", Times: 4},
+			},
+			expectedGets: 6,
+		},
+		"download of the rest at once": {
+			uri:          testRepoURI + "/foo-1.2.3.tgz",
+			parts:        true,
+			expectedGets: 2,
+		},
+		"download in parts": {
+			uri:          testRepoURI + "/foo-1.2.3.tgz",
+			parallel:     true,
+			expectedGets: 10,
+		},
+		"interrupted download in parts": {
+			uri:          testRepoURI + "/foo-1.2.3.tgz",
+			failures:     []s3test.Failure{{Op: "GetObject", Truncate: 3, Times: 3}},
+			parallel:     true,
+			expectedGets: 13,
+		},
+		"download interrupted too many times": {
+			uri:         testRepoURI + "/foo-1.2.3.tgz",
+			failures:    []s3test.Failure{{Op: "GetObject", Truncate: 5}},
+			expectedErr: errors.New("read object from s3"),
+		},
+		"object changed while resuming download": {
+			uri: testRepoURI + "/foo-1.2.3.tgz",
+			failures: []s3test.Failure{
+				{Op: "GetObject", Truncate: 30, Times: 1},
+				{Op: "GetObject", StatusCode: http.StatusPreconditionFailed, Code: "PreconditionFailed", Times: 1},
+			},
+			expectedErr: errors.New("fetch object from s3"),
+		},
+		"missing object": {
+			uri:         testRepoURI + "/missing-1.0.0.tgz",
+			expectedErr: backend.ErrObjectNotFound,
+		},
+		"missing bucket": {
+			uri:         "s3://missing-bucket/charts/foo-1.2.3.tgz",
+			expectedErr: backend.ErrBucketNotFound,
+		},
+	}
+
+	backoff := downloadRetryBackoff
+	downloadRetryBackoff = time.Millisecond
+	t.Cleanup(func() { downloadRetryBackoff = backoff })
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			storage, server := setupStorage(t)
+			server.PutObject(testBucket, "charts/foo-1.2.3.tgz", body, nil)
+			if tc.parts {
+				storage.downloadPartSize = 10
+			}
+			if tc.parallel {
+				storage.downloadPartSize = 10
+				storage.downloadConcurrency = 3
+				storage.parallelDownloadThreshold = 50
+			}
+			for _, failure := range tc.failures {
+				server.InjectFailure(failure)
+			}
+
+			var buf bytes.Buffer
+			err := storage.Download(context.Background(), tc.uri, &buf)
+			switch {
+			case tc.expectedErr == nil:
+				require.NoError(t, err)
+				require.Equal(t, body, buf.Bytes())
+				require.Equal(t, tc.expectedGets, server.Calls("GetObject"))
+				if tc.failures == nil {
+					// No byte is sent twice.
+					require.Equal(t, int64(len(body)), server.Sent())
+				}
+			case tc.failures != nil:
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectedErr.Error())
+			default:
+				require.Equal(t, tc.expectedErr, err)
+				require.Empty(t, buf.Bytes())
+			}
+		})
+	}
+}
+
+func TestStorage_Download_Empty(t *testing.T) {
+	storage, server := setupStorage(t)
+	server.PutObject(testBucket, "charts/empty.tgz", nil, nil)
+
+	var buf bytes.Buffer
+	require.NoError(t, storage.Download(context.Background(), testRepoURI+"/empty.tgz", &buf))
+	require.Empty(t, buf.Bytes())
+
+	// No range of an empty object is satisfiable, so it is requested whole.
+	require.Equal(t, 2, server.Calls("GetObject"))
+}
+
+func TestStorage_DownloadIfNoneMatch(t *testing.T) {
+	ctx := context.Background()
+	storage, server := setupStorage(t)
+	server.PutObject(testBucket, "charts/foo-1.2.3.tgz", []byte("chart"), nil)
+	obj, _ := server.Object(testBucket, "charts/foo-1.2.3.tgz")
+
+	var buf bytes.Buffer
+	etag, err := storage.DownloadIfNoneMatch(ctx, testRepoURI+"/foo-1.2.3.tgz", "", &buf)
+	require.NoError(t, err)
+	require.Equal(t, obj.ETag, etag)
+	require.Equal(t, "chart", buf.String())
+
+	buf.Reset()
+	_, err = storage.DownloadIfNoneMatch(ctx, testRepoURI+"/foo-1.2.3.tgz", obj.ETag, &buf)
+	require.Equal(t, backend.ErrNotModified, err)
+	require.Empty(t, buf.Bytes())
+
+	_, err = storage.DownloadIfNoneMatch(ctx, testRepoURI+"/foo-1.2.3.tgz", `"outdated"`, &buf)
+	require.NoError(t, err)
+	require.Equal(t, "chart", buf.String())
+}
+
+func TestStorage_PutRaw(t *testing.T) {
+	testCases := map[string]struct {
+		contentType       string
+		expectContentType string
+	}{
+		"content type": {
+			contentType:       "text/plain",
+			expectContentType: "text/plain",
+		},
+		"no content type": {
+			contentType:       "",
+			expectContentType: "",
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			storage, server := setupStorage(t)
+
+			err := storage.PutRaw(context.Background(), testRepoURI+"/foo-1.2.3.tgz.prov", strings.NewReader("signature"), "", tc.contentType)
+			require.NoError(t, err)
+
+			obj, ok := server.Object(testBucket, "charts/foo-1.2.3.tgz.prov")
+			require.True(t, ok)
+			require.Equal(t, "signature", string(obj.Body))
+			require.Equal(t, tc.expectContentType, obj.ContentType)
+		})
+	}
+}
+
+func TestStorage_SetEncryption(t *testing.T) {
+	testCases := map[string]struct {
+		env            string
+		mode           string
+		kmsKeyID       string
+		expectMode     string
+		expectKMSKeyID string
+	}{
+		"no encryption": {},
+		"aes256": {
+			mode:       "AES256",
+			expectMode: "AES256",
+		},
+		"kms": {
+			mode:           "aws:kms",
+			kmsKeyID:       "alias/charts",
+			expectMode:     "aws:kms",
+			expectKMSKeyID: "alias/charts",
+		},
+		"kms key without kms": {
+			mode:       "AES256",
+			kmsKeyID:   "alias/charts",
+			expectMode: "AES256",
+		},
+		"environment overrides mode": {
+			env:        "AES256",
+			mode:       "aws:kms",
+			kmsKeyID:   "alias/charts",
+			expectMode: "AES256",
+		},
+		"environment only": {
+			env:        "AES256",
+			expectMode: "AES256",
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			setenv(t, awsS3encryption, tc.env)
+			storage, server := setupStorage(t)
+			storage.SetEncryption(tc.mode, tc.kmsKeyID)
+
+			err := storage.PutRaw(context.Background(), testRepoURI+"/foo-1.2.3.tgz.prov", strings.NewReader("signature"), "", "")
+			require.NoError(t, err)
+
+			obj, ok := server.Object(testBucket, "charts/foo-1.2.3.tgz.prov")
+			require.True(t, ok)
+			require.Equal(t, tc.expectMode, obj.ServerSideEncryption)
+			require.Equal(t, tc.expectKMSKeyID, obj.SSEKMSKeyID)
+		})
+	}
+}
+
+func TestStorage_PutIndexIfMatch(t *testing.T) {
+	testCases := map[string]struct {
+		modify      func(t *testing.T, server *s3test.Server)
+		expectedErr error
+	}{
+		"unmodified": {
+			modify:      func(t *testing.T, server *s3test.Server) {},
+			expectedErr: nil,
+		},
+		"modified": {
+			modify: func(t *testing.T, server *s3test.Server) {
+				server.PutObject(testBucket, "charts/index.yaml", []byte("apiVersion: v1\nentries: {}\n"), nil)
+			},
+			expectedErr: backend.ErrIndexModified,
+		},
+		"deleted": {
+			modify: func(t *testing.T, server *s3test.Server) {
+				require.NoError(t, New(server.Session()).Delete(context.Background(), testRepoURI+"/index.yaml"))
+			},
+			expectedErr: backend.ErrIndexModified,
+		},
+		"upload rejected": {
+			modify: func(t *testing.T, server *s3test.Server) {
+				server.InjectFailure(s3test.Failure{
+					Op:         "PutObject",
+					Key:        "charts/index.yaml",
+					StatusCode: http.StatusPreconditionFailed,
+					Code:       "PreconditionFailed",
+					Times:      1,
+				})
+			},
+			expectedErr: backend.ErrIndexModified,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			storage, server := setupStorage(t)
+			require.NoError(t, storage.PutIndex(context.Background(), testRepoURI, "", strings.NewReader("apiVersion: v1\n")))
+
+			_, etag, err := storage.FetchIndex(context.Background(), testRepoURI+"/index.yaml")
+			require.NoError(t, err)
+			require.NotEmpty(t, etag)
+
+			tc.modify(t, server)
+
+			err = storage.PutIndexIfMatch(context.Background(), testRepoURI, "", etag, strings.NewReader("apiVersion: v1\nentries: null\n"))
+			require.Equal(t, tc.expectedErr, err)
+		})
+	}
+}
+
+func TestStorage_PutIndexIfMatch_Large(t *testing.T) {
+	storage, server := setupStorage(t)
+	ctx := context.Background()
+	require.NoError(t, storage.PutIndex(ctx, testRepoURI, "", strings.NewReader("apiVersion: v1\n")))
+	_, etag, err := storage.FetchIndex(ctx, testRepoURI+"/index.yaml")
+	require.NoError(t, err)
+
+	// Indexes larger than a multipart upload part are still uploaded by a
+	// single conditional request.
+	large := bytes.Repeat([]byte("#\n"), 3<<20)
+	require.NoError(t, storage.PutIndexIfMatch(ctx, testRepoURI, "", etag, bytes.NewReader(large)))
+	require.Equal(t, 2, server.KeyCalls("PutObject", "charts/index.yaml"))
+	require.Zero(t, server.Calls("CreateMultipartUpload"))
+
+	err = storage.PutIndexIfMatch(ctx, testRepoURI, "", etag, bytes.NewReader(large))
+	require.Equal(t, backend.ErrIndexModified, err)
+}
+
+func TestStorage_AcquireLock(t *testing.T) {
+	storage, server := setupStorage(t)
+	ctx := context.Background()
+
+	lock, err := storage.AcquireLock(ctx, testRepoURI, time.Minute)
+	require.NoError(t, err)
+
+	// The lock is held until released.
+	_, err = storage.AcquireLock(ctx, testRepoURI, time.Minute)
+	require.Equal(t, backend.ErrLocked, errors.Cause(err))
+
+	info, err := storage.FetchLock(ctx, testRepoURI)
+	require.NoError(t, err)
+	require.Equal(t, lock.Info().Owner, info.Owner)
+
+	require.NoError(t, lock.Release(ctx))
+	_, ok := server.Object(testBucket, "charts/"+lockFilename)
+	require.False(t, ok)
+
+	info, err = storage.FetchLock(ctx, testRepoURI)
+	require.NoError(t, err)
+	require.Nil(t, info)
+
+	// Releasing a released lock is a no-op.
+	require.NoError(t, lock.Release(ctx))
+}
+
+func TestStorage_AcquireLock_Contention(t *testing.T) {
+	storage, _ := setupStorage(t)
+	ctx := context.Background()
+
+	const contenders = 10
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		owners []string
+		errs   []error
+	)
+	for i := 0; i < contenders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			lock, err := storage.AcquireLock(ctx, testRepoURI, time.Minute)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, errors.Cause(err))
+				return
+			}
+			owners = append(owners, lock.Info().Owner)
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, owners, 1)
+	for _, err := range errs {
+		require.Equal(t, backend.ErrLocked, err)
+	}
+	info, err := storage.FetchLock(ctx, testRepoURI)
+	require.NoError(t, err)
+	require.Equal(t, owners[0], info.Owner)
+}
+
+func TestStorage_AcquireLock_Stale(t *testing.T) {
+	storage, server := setupStorage(t)
+	ctx := context.Background()
+
+	stale, err := storage.AcquireLock(ctx, testRepoURI, -time.Minute)
+	require.NoError(t, err)
+
+	// Expired locks are taken over.
+	lock, err := storage.AcquireLock(ctx, testRepoURI, time.Minute)
+	require.NoError(t, err)
+	require.NotEqual(t, stale.Info().Owner, lock.Info().Owner)
+
+	// The previous holder can neither renew nor release the new lock.
+	require.Equal(t, backend.ErrLocked, stale.Renew(ctx, time.Minute))
+	require.NoError(t, stale.Release(ctx))
+	info, err := storage.FetchLock(ctx, testRepoURI)
+	require.NoError(t, err)
+	require.Equal(t, lock.Info().Owner, info.Owner)
+
+	require.NoError(t, storage.BreakLock(ctx, testRepoURI))
+	_, ok := server.Object(testBucket, "charts/"+lockFilename)
+	require.False(t, ok)
+
+	// A broken lock cannot be renewed.
+	require.Equal(t, backend.ErrLocked, lock.Renew(ctx, time.Minute))
+}
+
+func TestStorage_AcquireLock_Renew(t *testing.T) {
+	storage, _ := setupStorage(t)
+	ctx := context.Background()
+
+	lock, err := storage.AcquireLock(ctx, testRepoURI, time.Second)
+	require.NoError(t, err)
+	expires := lock.Info().Expires
+
+	require.NoError(t, lock.Renew(ctx, time.Hour))
+	require.True(t, lock.Info().Expires.After(expires.Add(time.Minute)))
+
+	info, err := storage.FetchLock(ctx, testRepoURI)
+	require.NoError(t, err)
+	require.Equal(t, lock.Info().Owner, info.Owner)
+	require.True(t, info.Expires.Equal(lock.Info().Expires))
+
+	// The lock can be renewed again, and released afterwards.
+	require.NoError(t, lock.Renew(ctx, time.Hour))
+	require.NoError(t, lock.Release(ctx))
+	info, err = storage.FetchLock(ctx, testRepoURI)
+	require.NoError(t, err)
+	require.Nil(t, info)
+}
+
+func TestLock_Release_TakenOver(t *testing.T) {
+	storage, server := setupStorage(t)
+	ctx := context.Background()
+	key := "charts/" + lockFilename
+
+	lock, err := storage.AcquireLock(ctx, testRepoURI, time.Minute)
+	require.NoError(t, err)
+
+	// The lock is taken over after it is read for the release, but before
+	// it is deleted.
+	server.InjectFailure(s3test.Failure{Op: "DeleteObject", Key: key, Delay: time.Second, Times: 1})
+	released := make(chan error, 1)
+	go func() { released <- lock.Release(ctx) }()
+	require.Eventually(t, func() bool {
+		return server.KeyCalls("DeleteObject", key) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	server.PutObject(testBucket, key, []byte(`{"owner":"someone-else"}`), nil)
+
+	require.NoError(t, <-released)
+	info, err := storage.FetchLock(ctx, testRepoURI)
+	require.NoError(t, err)
+	require.Equal(t, "someone-else", info.Owner)
+}
+
+func TestStorage_Copy(t *testing.T) {
+	testCases := map[string]struct {
+		src         string
+		dst         string
+		expectedErr error
+	}{
+		"same bucket": {
+			src: testRepoURI + "/foo-1.2.3.tgz",
+			dst: testRepoURI + "/.trash/foo-1.2.3.tgz",
+		},
+		"missing object": {
+			src:         testRepoURI + "/missing-1.0.0.tgz",
+			dst:         testRepoURI + "/.trash/missing-1.0.0.tgz",
+			expectedErr: backend.ErrObjectNotFound,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			storage, server := setupStorage(t)
+			server.PutObject(testBucket, "charts/foo-1.2.3.tgz", []byte("chart"), map[string]string{
+				"chart-digest": "sha256:1",
+			})
+
+			err := storage.Copy(context.Background(), tc.src, tc.dst, "")
+			if tc.expectedErr != nil {
+				require.Equal(t, tc.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+
+			obj, ok := server.Object(testBucket, "charts/.trash/foo-1.2.3.tgz")
+			require.True(t, ok)
+			require.Equal(t, "chart", string(obj.Body))
+			require.Equal(t, "sha256:1", obj.Metadata["Chart-Digest"])
+
+			_, ok = server.Object(testBucket, "charts/foo-1.2.3.tgz")
+			require.True(t, ok)
+			require.Equal(t, 1, server.Calls("CopyObject"))
+		})
+	}
+}
+
+func TestStorage_Versions(t *testing.T) {
+	testCases := map[string]struct {
+		versioning bool
+		expectIDs  []string
+	}{
+		"versioning enabled": {
+			versioning: true,
+			expectIDs:  []string{"v00000002", "v00000001"},
+		},
+		"versioning disabled": {
+			versioning: false,
+			expectIDs:  []string{"null"},
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			storage, server := setupStorage(t)
+			// Keys sharing the prefix are not versions of the object.
+			server.PutObject(testBucket, "charts/index.yaml.bak", []byte("backup"), nil)
+			if tc.versioning {
+				server.EnableVersioning(testBucket)
+			}
+
+			for _, body := range []string{"first", "second"} {
+				err := storage.PutRaw(context.Background(), testRepoURI+"/index.yaml", strings.NewReader(body), "", "")
+				require.NoError(t, err)
+			}
+
+			versions, err := storage.Versions(context.Background(), testRepoURI+"/index.yaml")
+			require.NoError(t, err)
+
+			var ids []string
+			for _, v := range versions {
+				ids = append(ids, v.ID)
+			}
+			require.Equal(t, tc.expectIDs, ids)
+			require.True(t, versions[0].Latest)
+
+			if !tc.versioning {
+				return
+			}
+			require.False(t, versions[1].Latest)
+
+			b, err := storage.FetchVersion(context.Background(), testRepoURI+"/index.yaml", versions[1].ID)
+			require.NoError(t, err)
+			require.Equal(t, "first", string(b))
+
+			_, err = storage.FetchVersion(context.Background(), testRepoURI+"/index.yaml", "missing")
+			require.Equal(t, backend.ErrObjectNotFound, err)
+		})
+	}
+}
+
+func TestStorage_DeleteBatch(t *testing.T) {
+	testCases := map[string]struct {
+		keys          int
+		failKey       string
+		expectError   bool
+		expectBatches int
+	}{
+		"single batch": {
+			keys:          3,
+			expectBatches: 1,
+		},
+		"multiple batches": {
+			keys:          deleteObjectsMaxKeys + 1,
+			expectBatches: 2,
+		},
+		"only missing objects": {
+			keys:          0,
+			expectBatches: 1,
+		},
+		"object failure": {
+			keys:          3,
+			failKey:       "charts/foo-1.0.1.tgz",
+			expectError:   true,
+			expectBatches: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			storage, server := setupStorage(t)
+
+			var uris []string
+			for i := 0; i < tc.keys; i++ {
+				key := fmt.Sprintf("charts/foo-1.0.%d.tgz", i)
+				server.PutObject(testBucket, key, []byte("chart"), nil)
+				uris = append(uris, "s3://"+testBucket+"/"+key)
+			}
+			// Missing objects are not an error.
+			uris = append(uris, testRepoURI+"/missing-1.0.0.tgz")
+
+			if tc.failKey != "" {
+				server.InjectFailure(s3test.Failure{Op: "DeleteObject", Key: tc.failKey, StatusCode: http.StatusForbidden, Code: "AccessDenied"})
+			}
+
+			err := storage.DeleteBatch(context.Background(), uris)
+			if tc.expectError {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.failKey)
+			} else {
+				require.NoError(t, err)
+				require.Empty(t, server.Keys(testBucket))
+			}
+
+			require.Equal(t, tc.expectBatches, server.Calls("DeleteObjects"))
+			require.Zero(t, server.Calls("DeleteObject"))
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"time"
+)
+
+// Lock is an advisory lock held on a repository.
+type Lock interface {
+	// Info returns information about the lock.
+	Info() LockInfo
+
+	// Renew extends the lock to expire ttl from now, so that long operations
+	// keep holding it. It returns ErrLocked if the lock has expired and has
+	// been taken over by someone else, or if it has been broken.
+	Renew(ctx context.Context, ttl time.Duration) error
+
+	// Release releases the lock if it is still held by us.
+	Release(ctx context.Context) error
+}
+
+// LockInfo describes the holder of a repository lock.
+type LockInfo struct {
+	Owner    string    `json:"owner"`
+	Hostname string    `json:"hostname"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Expired returns true if the lock is stale and can be taken over.
+func (li LockInfo) Expired() bool {
+	return time.Now().After(li.Expires)
+}
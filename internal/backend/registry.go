@@ -0,0 +1,64 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Factory returns a new Storage serving the repository by URI.
+type Factory func(uri string) (Storage, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a storage backend available for URIs with the given scheme.
+// It is intended to be called from the init function of backend packages.
+// It panics if the backend for the scheme is already registered.
+func Register(scheme string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("backend: register factory is nil")
+	}
+	if _, exists := registry[scheme]; exists {
+		panic("backend: register called twice for scheme " + scheme)
+	}
+	registry[scheme] = factory
+}
+
+// New returns a new Storage for the URI using the backend registered for the
+// URI scheme.
+func New(uri string) (Storage, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse uri %s", uri)
+	}
+
+	registryMu.RLock()
+	factory, ok := registry[u.Scheme]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("no storage backend registered for uri %s", uri)
+	}
+
+	return factory(uri)
+}
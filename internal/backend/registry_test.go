@@ -0,0 +1,71 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	var requestedURI string
+	Register("test", func(uri string) (Storage, error) {
+		requestedURI = uri
+		return nil, nil
+	})
+
+	testCases := map[string]struct {
+		uri         string
+		expectError bool
+	}{
+		"registered scheme": {
+			uri:         "test://bucket/charts",
+			expectError: false,
+		},
+		"unregistered scheme": {
+			uri:         "gs://bucket/charts",
+			expectError: true,
+		},
+		"no scheme": {
+			uri:         "bucket/charts",
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			requestedURI = ""
+
+			_, err := New(tc.uri)
+			if tc.expectError {
+				require.Error(t, err)
+				require.Empty(t, requestedURI)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.uri, requestedURI)
+			}
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register("twice", func(uri string) (Storage, error) { return nil, nil })
+
+	require.Panics(t, func() {
+		Register("twice", func(uri string) (Storage, error) { return nil, nil })
+	})
+}
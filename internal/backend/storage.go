@@ -0,0 +1,194 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backend defines the storage interface of chart repositories and
+// the registry of its implementations keyed by URI scheme.
+package backend
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+var (
+	// ErrBucketNotFound signals that a bucket was not found.
+	ErrBucketNotFound = errors.New("bucket not found")
+
+	// ErrObjectNotFound signals that an object was not found.
+	ErrObjectNotFound = errors.New("object not found")
+
+	// ErrIndexModified signals that the index was modified since it was
+	// fetched, so the conditional index upload was rejected.
+	ErrIndexModified = errors.New("index was modified concurrently")
+
+	// ErrLocked signals that the repository is locked by someone else.
+	ErrLocked = errors.New("repository is locked")
+
+	// ErrNotModified signals that an object has not changed since it was
+	// last downloaded.
+	ErrNotModified = errors.New("object not modified")
+)
+
+// Storage provides an interface to work with chart repository objects.
+//
+// All URIs are absolute and include the scheme of the backend, for example
+// s3://bucket-name/key[...].
+type Storage interface {
+	// Traverse traverses all charts in the repository. Charts are returned
+	// in a deterministic order regardless of the options.
+	// It always closes both channels when done.
+	Traverse(ctx context.Context, repoURI string, opts TraverseOptions) (<-chan ChartInfo, <-chan error)
+
+	// FetchRaw downloads the object from URI and returns it in the form of
+	// byte slice.
+	FetchRaw(ctx context.Context, uri string) ([]byte, error)
+
+	// Download streams the object from URI to w, without holding the whole
+	// object in memory. It returns ErrObjectNotFound or ErrBucketNotFound
+	// before writing anything if the object or the bucket is missing.
+	Download(ctx context.Context, uri string, w io.Writer) error
+
+	// FetchIndex downloads the index file from URI and returns it in the
+	// form of byte slice along with its version tag.
+	FetchIndex(ctx context.Context, uri string) ([]byte, string, error)
+
+	// Exists returns true if an object exists in the storage.
+	Exists(ctx context.Context, uri string) (bool, error)
+
+	// PutChart puts the chart file to the storage and returns its location.
+	PutChart(
+		ctx context.Context,
+		uri string,
+		r io.Reader,
+		chartMeta string,
+		acl string,
+		chartDigest string,
+		contentType string,
+	) (string, error)
+
+	// PutRaw puts the object to the storage as is. It is used for auxiliary
+	// files, like provenance files of charts.
+	PutRaw(ctx context.Context, uri string, r io.Reader, acl, contentType string) error
+
+	// PutIndex puts the index file to the repository.
+	PutIndex(ctx context.Context, repoURI, acl string, r io.Reader) error
+
+	// PutIndexIfMatch puts the index file to the repository only if the
+	// current index has the given version tag, as returned by FetchIndex.
+	// Otherwise it returns ErrIndexModified.
+	PutIndexIfMatch(ctx context.Context, repoURI, acl, etag string, r io.Reader) error
+
+	// Copy copies the object with its metadata from one URI to another
+	// within the storage. It returns ErrObjectNotFound if the source object
+	// does not exist.
+	Copy(ctx context.Context, srcURI, dstURI, acl string) error
+
+	// Delete deletes the object by URI.
+	Delete(ctx context.Context, uri string) error
+
+	// DeleteBatch deletes the objects by URIs in as few requests as the
+	// storage allows. Missing objects are not an error.
+	DeleteBatch(ctx context.Context, uris []string) error
+
+	// AcquireLock acquires the advisory lock on the repository for the given
+	// duration. If the repository is already locked by someone else, it
+	// returns ErrLocked. Locks that have expired are taken over.
+	AcquireLock(ctx context.Context, repoURI string, ttl time.Duration) (Lock, error)
+
+	// FetchLock returns information about the current repository lock or
+	// nil if the repository is not locked.
+	FetchLock(ctx context.Context, repoURI string) (*LockInfo, error)
+
+	// BreakLock unconditionally removes the repository lock, regardless of
+	// who is holding it.
+	BreakLock(ctx context.Context, repoURI string) error
+}
+
+// Encrypter is implemented by storages that encrypt the objects they put on
+// the server side.
+type Encrypter interface {
+	// SetEncryption sets the server-side encryption mode and the KMS key
+	// used for the objects put to the storage. Empty values keep the
+	// defaults of the storage.
+	SetEncryption(mode, kmsKeyID string)
+}
+
+// Versioner is implemented by storages that keep the previous versions of
+// overwritten objects, like S3 buckets with versioning enabled.
+type Versioner interface {
+	// Versions returns the versions of the object by URI, the newest first.
+	Versions(ctx context.Context, uri string) ([]ObjectVersion, error)
+
+	// FetchVersion downloads the version of the object by URI. It returns
+	// ErrObjectNotFound if there is no such version.
+	FetchVersion(ctx context.Context, uri, versionID string) ([]byte, error)
+}
+
+// ConditionalDownloader is implemented by storages that download objects only
+// if they have changed, as told by their version tags.
+type ConditionalDownloader interface {
+	// DownloadIfNoneMatch streams the object from URI to w like
+	// Storage.Download, unless the version tag of the object is etag, in
+	// which case it returns ErrNotModified without writing anything. It
+	// returns the version tag of the downloaded object.
+	DownloadIfNoneMatch(ctx context.Context, uri, etag string, w io.Writer) (string, error)
+}
+
+// ObjectVersion describes a version of an object.
+type ObjectVersion struct {
+	ID       string
+	Modified time.Time
+
+	// Latest is true for the current version of the object.
+	Latest bool
+}
+
+// TraverseOptions are options of Storage.Traverse.
+type TraverseOptions struct {
+	// Concurrency is the number of charts processed in parallel.
+	Concurrency int
+
+	// NotModified reports whether the chart file has not been modified since
+	// it was indexed, given its name and the time it was last modified as
+	// listed. Such charts are reported unchanged without any further request.
+	// If nil, every chart is requested.
+	NotModified func(filename string, modified time.Time) bool
+
+	// Unchanged reports whether the chart file has not changed since it was
+	// indexed, given its name and the chart digest recorded in its metadata.
+	// The chart metadata of unchanged charts is not loaded. Charts without a
+	// recorded digest are always loaded. If nil, every chart is loaded.
+	Unchanged func(filename, digest string) bool
+}
+
+// ChartInfo contains info about particular chart.
+type ChartInfo struct {
+	Meta     helmutil.ChartMetadata
+	Filename string
+	Hash     string
+
+	// Modified is the time the chart file was last modified.
+	Modified time.Time
+
+	// Unchanged is true if the chart file was reported unchanged by
+	// TraverseOptions.NotModified or TraverseOptions.Unchanged, in which case
+	// Meta is not set. Hash is not set either if it was reported by
+	// NotModified.
+	Unchanged bool
+}
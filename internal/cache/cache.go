@@ -0,0 +1,344 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache implements the on-disk cache of the objects downloaded from
+// chart repositories, so that unchanged charts are not downloaded again.
+//
+// Every object is cached in a file named after the version tag of the object,
+// in a directory named after the hash of its URI, so that a cached copy and
+// its version tag are always replaced together. The least recently used
+// copies are evicted once the cache grows larger than its maximum size.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotCached signals that an object is not in the cache.
+var ErrNotCached = errors.New("object not cached")
+
+// tempPattern is the pattern of the names of the copies being written.
+const tempPattern = ".download-*"
+
+// staleTempAge is the time after which copies still not written are taken
+// for leftovers of interrupted downloads. Copies being written are modified
+// continuously.
+var staleTempAge = time.Hour
+
+// Cache is an on-disk cache of objects keyed by their URIs and version tags.
+// It is safe to use the same cache directory from multiple processes.
+type Cache struct {
+	dir     string
+	maxSize int64
+}
+
+// New returns the cache in the directory holding up to maxSize bytes.
+func New(dir string, maxSize int64) *Cache {
+	return &Cache{dir: dir, maxSize: maxSize}
+}
+
+// Dir returns the directory of the cache.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// MaxSize returns the maximum size of the cache in bytes.
+func (c *Cache) MaxSize() int64 {
+	return c.maxSize
+}
+
+// Open opens the cached copy of the object by URI and returns it along with
+// the version tag of the object. It returns ErrNotCached if the object is not
+// cached. Opening a copy marks it as recently used.
+func (c *Cache) Open(uri string) (*os.File, string, error) {
+	dir := c.objectDir(uri)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, "", ErrNotCached
+		}
+		return nil, "", errors.Wrap(err, "read cache directory")
+	}
+
+	// There is a single copy unless another process is just replacing it,
+	// in which case the newer copy wins.
+	var (
+		name     string
+		modified time.Time
+	)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if name == "" || info.ModTime().After(modified) {
+			name, modified = entry.Name(), info.ModTime()
+		}
+	}
+	etag, err := hex.DecodeString(name)
+	if name == "" || err != nil {
+		return nil, "", ErrNotCached
+	}
+
+	fpath := filepath.Join(dir, name)
+	f, err := os.Open(fpath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, "", ErrNotCached
+		}
+		return nil, "", errors.Wrap(err, "open cache file")
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(fpath, now, now); err != nil {
+		f.Close()
+		return nil, "", errors.Wrap(err, "touch cache file")
+	}
+
+	return f, string(etag), nil
+}
+
+// Create returns a Writer writing a new copy of the object by URI to the
+// cache.
+func (c *Cache) Create(uri string) (*Writer, error) {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create cache directory")
+	}
+
+	f, err := os.CreateTemp(c.dir, tempPattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "create cache file")
+	}
+
+	return &Writer{cache: c, uri: uri, f: f}, nil
+}
+
+// Stats describes the contents of the cache.
+type Stats struct {
+	// Objects is the number of cached objects.
+	Objects int
+
+	// Size is the total size of the cached objects in bytes.
+	Size int64
+}
+
+// Stats returns the statistics of the cache.
+func (c *Cache) Stats() (Stats, error) {
+	files, err := c.files()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	var stats Stats
+	for _, f := range files {
+		stats.Objects++
+		stats.Size += f.size
+	}
+	return stats, nil
+}
+
+// Clean removes every cached copy.
+func (c *Cache) Clean() error {
+	return errors.Wrap(os.RemoveAll(c.dir), "remove cache directory")
+}
+
+// evict removes the leftovers of interrupted downloads and the least recently
+// used copies until the cache fits its maximum size. Copies being written
+// count toward the size of the cache.
+func (c *Cache) evict() error {
+	size, err := c.sweepTemp()
+	if err != nil {
+		return err
+	}
+
+	files, err := c.files()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		size += f.size
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].used.Before(files[j].used)
+	})
+	for _, f := range files {
+		if size <= c.maxSize {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return errors.Wrap(err, "remove cache file")
+		}
+		size -= f.size
+
+		// The directory of the object is removed only if it is empty.
+		_ = os.Remove(filepath.Dir(f.path))
+	}
+
+	return nil
+}
+
+// sweepTemp removes the stale copies left by interrupted downloads and
+// returns the size of the copies still being written.
+func (c *Cache) sweepTemp() (int64, error) {
+	matches, err := filepath.Glob(filepath.Join(c.dir, tempPattern))
+	if err != nil {
+		return 0, errors.Wrap(err, "list cache files being written")
+	}
+
+	var size int64
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			// The copy was committed or removed by another process.
+			continue
+		}
+		if time.Since(info.ModTime()) <= staleTempAge {
+			size += info.Size()
+			continue
+		}
+		if err := os.Remove(match); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return 0, errors.Wrap(err, "remove stale cache file")
+		}
+	}
+
+	return size, nil
+}
+
+// cachedFile is a cached copy of an object.
+type cachedFile struct {
+	path string
+	size int64
+	used time.Time
+}
+
+// files returns the cached copies, skipping the ones being written.
+func (c *Cache) files() ([]cachedFile, error) {
+	dirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "read cache directory")
+	}
+
+	var files []cachedFile
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		entries, err := os.ReadDir(filepath.Join(c.dir, dir.Name()))
+		if err != nil {
+			// The directory was evicted by another process.
+			continue
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			files = append(files, cachedFile{
+				path: filepath.Join(c.dir, dir.Name(), entry.Name()),
+				size: info.Size(),
+				used: info.ModTime(),
+			})
+		}
+	}
+
+	return files, nil
+}
+
+// objectDir returns the directory of the cached copy of the object by URI.
+func (c *Cache) objectDir(uri string) string {
+	sum := sha256.Sum256([]byte(uri))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// Writer writes a new copy of an object to the cache. Writes never fail, so
+// that caching never interrupts the download the copy is written from, the
+// first error is returned by Commit instead.
+type Writer struct {
+	cache *Cache
+	uri   string
+	f     *os.File
+	size  int64
+	err   error
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err == nil {
+		var n int
+		n, w.err = w.f.Write(p)
+		w.size += int64(n)
+	}
+	return len(p), nil
+}
+
+// Commit makes the copy the cached copy of the object with the version tag,
+// replacing the previous one, and evicts the least recently used copies if
+// the cache is full. Objects larger than the whole cache are not cached.
+func (w *Writer) Commit(etag string) error {
+	if err := w.f.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		os.Remove(w.f.Name())
+		return errors.Wrap(w.err, "write cache file")
+	}
+	if etag == "" || w.size > w.cache.maxSize {
+		return errors.Wrap(os.Remove(w.f.Name()), "remove cache file")
+	}
+
+	dir := w.cache.objectDir(w.uri)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		os.Remove(w.f.Name())
+		return errors.Wrap(err, "create cache directory")
+	}
+
+	name := hex.EncodeToString([]byte(etag))
+	if err := os.Rename(w.f.Name(), filepath.Join(dir, name)); err != nil {
+		os.Remove(w.f.Name())
+		return errors.Wrap(err, "rename cache file")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "read cache directory")
+	}
+	for _, entry := range entries {
+		if entry.Name() != name {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return errors.Wrap(err, "remove previous cache file")
+			}
+		}
+	}
+
+	return w.cache.evict()
+}
+
+// Abort discards the copy.
+func (w *Writer) Abort() error {
+	w.f.Close()
+	return errors.Wrap(os.Remove(w.f.Name()), "remove cache file")
+}
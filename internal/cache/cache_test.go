@@ -0,0 +1,157 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// put caches the object with the version tag.
+func put(t *testing.T, c *Cache, uri, etag, body string) {
+	t.Helper()
+
+	w, err := c.Create(uri)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, body)
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(etag))
+}
+
+// get returns the cached copy of the object and its version tag.
+func get(t *testing.T, c *Cache, uri string) (string, string) {
+	t.Helper()
+
+	f, etag, err := c.Open(uri)
+	require.NoError(t, err)
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	require.NoError(t, err)
+	return string(b), etag
+}
+
+// setUsed sets the time the cached copy of the object was last used.
+func setUsed(t *testing.T, c *Cache, uri string, used time.Time) {
+	t.Helper()
+
+	entries, err := os.ReadDir(c.objectDir(uri))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.NoError(t, os.Chtimes(filepath.Join(c.objectDir(uri), entries[0].Name()), used, used))
+}
+
+func TestCache(t *testing.T) {
+	c := New(t.TempDir(), 1024)
+	const uri = "s3://test-bucket/charts/foo-1.2.3.tgz"
+
+	_, _, err := c.Open(uri)
+	require.Equal(t, ErrNotCached, err)
+
+	put(t, c, uri, `"v1"`, "first")
+	body, etag := get(t, c, uri)
+	require.Equal(t, "first", body)
+	require.Equal(t, `"v1"`, etag)
+
+	// A new version replaces the previous one.
+	put(t, c, uri, `"v2"`, "second")
+	body, etag = get(t, c, uri)
+	require.Equal(t, "second", body)
+	require.Equal(t, `"v2"`, etag)
+
+	// Aborted copies are discarded.
+	w, err := c.Create(uri)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "aborted")
+	require.NoError(t, err)
+	require.NoError(t, w.Abort())
+	body, _ = get(t, c, uri)
+	require.Equal(t, "second", body)
+
+	stats, err := c.Stats()
+	require.NoError(t, err)
+	require.Equal(t, Stats{Objects: 1, Size: 6}, stats)
+
+	require.NoError(t, c.Clean())
+	_, _, err = c.Open(uri)
+	require.Equal(t, ErrNotCached, err)
+	stats, err = c.Stats()
+	require.NoError(t, err)
+	require.Equal(t, Stats{}, stats)
+}
+
+func TestCache_Evict(t *testing.T) {
+	c := New(t.TempDir(), 10)
+
+	put(t, c, "s3://test-bucket/charts/a.tgz", `"a"`, "aaaa")
+	put(t, c, "s3://test-bucket/charts/b.tgz", `"b"`, "bbbb")
+
+	// Opening a copy makes it the most recently used one.
+	setUsed(t, c, "s3://test-bucket/charts/a.tgz", time.Now().Add(-2*time.Hour))
+	setUsed(t, c, "s3://test-bucket/charts/b.tgz", time.Now().Add(-time.Hour))
+	get(t, c, "s3://test-bucket/charts/a.tgz")
+
+	put(t, c, "s3://test-bucket/charts/c.tgz", `"c"`, "cccc")
+
+	_, _, err := c.Open("s3://test-bucket/charts/b.tgz")
+	require.Equal(t, ErrNotCached, err)
+	require.NoDirExists(t, c.objectDir("s3://test-bucket/charts/b.tgz"))
+	body, _ := get(t, c, "s3://test-bucket/charts/a.tgz")
+	require.Equal(t, "aaaa", body)
+	body, _ = get(t, c, "s3://test-bucket/charts/c.tgz")
+	require.Equal(t, "cccc", body)
+
+	// Objects larger than the cache are not cached.
+	put(t, c, "s3://test-bucket/charts/d.tgz", `"d"`, "ddddddddddd")
+	_, _, err = c.Open("s3://test-bucket/charts/d.tgz")
+	require.Equal(t, ErrNotCached, err)
+
+	stats, err := c.Stats()
+	require.NoError(t, err)
+	require.Equal(t, Stats{Objects: 2, Size: 8}, stats)
+}
+
+func TestCache_EvictStaleTemp(t *testing.T) {
+	dir := t.TempDir()
+	c := New(dir, 10)
+
+	// An interrupted download left its copy behind, while another one is
+	// still being written.
+	stale := filepath.Join(dir, ".download-1")
+	require.NoError(t, os.WriteFile(stale, []byte("ssssssssss"), 0644))
+	old := time.Now().Add(-2 * staleTempAge)
+	require.NoError(t, os.Chtimes(stale, old, old))
+	w, err := c.Create("s3://test-bucket/charts/b.tgz")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "bbbb")
+	require.NoError(t, err)
+
+	put(t, c, "s3://test-bucket/charts/a.tgz", `"a"`, "aaaa")
+	require.NoFileExists(t, stale)
+
+	// The copy being written counts toward the size of the cache.
+	put(t, c, "s3://test-bucket/charts/c.tgz", `"c"`, "cccc")
+	_, _, err = c.Open("s3://test-bucket/charts/a.tgz")
+	require.Equal(t, ErrNotCached, err)
+
+	require.NoError(t, w.Commit(`"b"`))
+	body, _ := get(t, c, "s3://test-bucket/charts/b.tgz")
+	require.Equal(t, "bbbb", body)
+}
@@ -26,6 +26,19 @@ func LoadChart(fpath string) (Chart, error) {
 	return loadChartV2(fpath)
 }
 
+// PackageChart loads the unpackaged chart from the directory and packages it
+// into a chart archive, optionally overriding the chart version and app
+// version. It returns the chart along with the archive contents.
+//
+// Note: the archive is written to a temporary directory that is removed
+// before returning.
+func PackageChart(dir, version, appVersion string) (Chart, []byte, error) {
+	if IsHelm3() {
+		return packageChartV3(dir, version, appVersion)
+	}
+	return packageChartV2(dir, version, appVersion)
+}
+
 // LoadArchive returns chart loaded from the archive file reader.
 func LoadArchive(r io.Reader) (Chart, error) {
 	if IsHelm3() {
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"os"
 
 	"k8s.io/helm/pkg/chartutil"
 	"k8s.io/helm/pkg/proto/hapi/chart"
@@ -42,6 +43,38 @@ func loadArchiveV2(r io.Reader) (ChartV2, error) {
 	return ChartV2{chart: ch}, nil
 }
 
+func packageChartV2(dir, version, appVersion string) (ChartV2, []byte, error) {
+	ch, err := chartutil.LoadDir(dir)
+	if err != nil {
+		return ChartV2{}, nil, fmt.Errorf("failed to load chart directory: %s", err.Error())
+	}
+
+	if version != "" {
+		ch.Metadata.Version = version
+	}
+	if appVersion != "" {
+		ch.Metadata.AppVersion = appVersion
+	}
+
+	tmp, err := os.MkdirTemp("", "helm-s3-package-")
+	if err != nil {
+		return ChartV2{}, nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	fpath, err := chartutil.Save(ch, tmp)
+	if err != nil {
+		return ChartV2{}, nil, fmt.Errorf("failed to package chart: %s", err.Error())
+	}
+
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		return ChartV2{}, nil, err
+	}
+
+	return ChartV2{chart: ch}, b, nil
+}
+
 type chartMetadataV2 struct {
 	meta *chart.Metadata
 }
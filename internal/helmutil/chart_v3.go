@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"os"
 
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
 )
 
 // ChartV3 implements Chart in Helm v3.
@@ -45,6 +47,38 @@ func loadArchiveV3(r io.Reader) (ChartV3, error) {
 	return ChartV3{chart: ch}, nil
 }
 
+func packageChartV3(dir, version, appVersion string) (ChartV3, []byte, error) {
+	ch, err := loader.LoadDir(dir)
+	if err != nil {
+		return ChartV3{}, nil, fmt.Errorf("failed to load chart directory: %s", err.Error())
+	}
+
+	if version != "" {
+		ch.Metadata.Version = version
+	}
+	if appVersion != "" {
+		ch.Metadata.AppVersion = appVersion
+	}
+
+	tmp, err := os.MkdirTemp("", "helm-s3-package-")
+	if err != nil {
+		return ChartV3{}, nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	fpath, err := chartutil.Save(ch, tmp)
+	if err != nil {
+		return ChartV3{}, nil, fmt.Errorf("failed to package chart: %s", err.Error())
+	}
+
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		return ChartV3{}, nil, err
+	}
+
+	return ChartV3{chart: ch}, b, nil
+}
+
 type chartMetadataV3 struct {
 	meta *chart.Metadata
 }
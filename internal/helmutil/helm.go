@@ -20,3 +20,14 @@ func indexFile(repoURL string) string {
 func repoCacheFileName(name string) string {
 	return fmt.Sprintf("%s-index.yaml", name)
 }
+
+// CacheDir returns the directory Helm caches the repository indexes in.
+// Examples:
+// - /Users/foo/Library/Caches/helm/repository (on macOS)
+// - /home/foo/.cache/helm/repository (on Linux).
+func CacheDir() string {
+	if IsHelm3() {
+		return cacheDirPathV3()
+	}
+	return cacheDirPathV2()
+}
@@ -3,8 +3,21 @@ package helmutil
 import (
 	"io"
 	"io/fs"
+	"time"
 )
 
+// IndexEntry describes a single chart version in the index.
+type IndexEntry struct {
+	Name        string    `json:"name"`
+	Version     string    `json:"version"`
+	AppVersion  string    `json:"appVersion,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Deprecated  bool      `json:"deprecated,omitempty"`
+	Digest      string    `json:"digest"`
+	URLs        []string  `json:"urls"`
+	Created     time.Time `json:"created"`
+}
+
 // Index describes helm chart repo index.
 type Index interface {
 	// Add adds chart version to the index.
@@ -26,6 +39,19 @@ type Index interface {
 	// Has returns true if the index has an entry for a chart with the given name and exact version.
 	Has(name, version string) bool
 
+	// MarshalEntry encodes the entry of the chart version including all of its chart metadata,
+	// so that it can be restored later by RestoreEntry.
+	MarshalEntry(name, version string) ([]byte, error)
+
+	// RestoreEntry adds the entry encoded by MarshalEntry back to the index as is.
+	//
+	// Note: this can leave the index in an unsorted state.
+	RestoreEntry(b []byte) error
+
+	// Entries returns all chart versions in the index ordered by chart name,
+	// keeping the order of versions of each chart.
+	Entries() []IndexEntry
+
 	// SortEntries sorts the entries by version in descending order.
 	SortEntries()
 
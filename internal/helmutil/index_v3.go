@@ -2,10 +2,12 @@ package helmutil
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"emperror.dev/errors"
@@ -119,6 +121,58 @@ func (idx *IndexV3) Has(name, version string) bool {
 	return idx.index.Has(name, version)
 }
 
+func (idx *IndexV3) MarshalEntry(name, version string) ([]byte, error) {
+	for _, cv := range idx.index.Entries[name] {
+		if cv != nil && cv.Version == version {
+			return json.Marshal(cv)
+		}
+	}
+
+	return nil, fmt.Errorf("chart %s version %s not found in index", name, version)
+}
+
+func (idx *IndexV3) RestoreEntry(b []byte) error {
+	cv := &repo.ChartVersion{}
+	if err := json.Unmarshal(b, cv); err != nil {
+		return errors.Wrap(err, "unmarshal index entry")
+	}
+	if cv.Metadata == nil || cv.Name == "" {
+		return errors.New("index entry has no chart metadata")
+	}
+
+	idx.index.Entries[cv.Name] = append(idx.index.Entries[cv.Name], cv)
+	return nil
+}
+
+func (idx *IndexV3) Entries() []IndexEntry {
+	names := make([]string, 0, len(idx.index.Entries))
+	for name := range idx.index.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var entries []IndexEntry
+	for _, name := range names {
+		for _, cv := range idx.index.Entries[name] {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			entries = append(entries, IndexEntry{
+				Name:        cv.Name,
+				Version:     cv.Version,
+				AppVersion:  cv.AppVersion,
+				Description: cv.Description,
+				Deprecated:  cv.Deprecated,
+				Digest:      cv.Digest,
+				URLs:        cv.URLs,
+				Created:     cv.Created,
+			})
+		}
+	}
+
+	return entries
+}
+
 func (idx *IndexV3) SortEntries() {
 	idx.index.SortEntries()
 }
@@ -126,6 +126,65 @@ func TestIndexV3_AddOrReplace(t *testing.T) {
 	})
 }
 
+func TestIndexV3_Entries(t *testing.T) {
+	i := newIndexV3()
+	for _, md := range []*chart.Metadata{
+		{Name: "foo", Version: "0.1.0"},
+		{Name: "bar", Version: "1.0.0", AppVersion: "2.0"},
+		{Name: "foo", Version: "0.2.0"},
+	} {
+		require.NoError(t, i.AddOrReplace(md, md.Name+"-"+md.Version+".tgz", "", "sha256:"+md.Version))
+	}
+	i.SortEntries()
+
+	entries := i.Entries()
+	require.Len(t, entries, 3)
+
+	var versions []string
+	for _, e := range entries {
+		versions = append(versions, e.Name+"-"+e.Version)
+	}
+	require.Equal(t, []string{"bar-1.0.0", "foo-0.2.0", "foo-0.1.0"}, versions)
+
+	require.Equal(t, "2.0", entries[0].AppVersion)
+	require.Equal(t, "sha256:1.0.0", entries[0].Digest)
+	require.Equal(t, []string{"bar-1.0.0.tgz"}, entries[0].URLs)
+	require.False(t, entries[0].Created.IsZero())
+}
+
+func TestIndexV3_MarshalEntry(t *testing.T) {
+	i := newIndexV3()
+	md := &chart.Metadata{
+		Name:        "foo",
+		Version:     "0.1.0",
+		Description: "Foo chart",
+		Maintainers: []*chart.Maintainer{{Name: "John Smith"}},
+	}
+	require.NoError(t, i.AddOrReplace(md, "foo-0.1.0.tgz", "s3://bucket/charts", "sha256:1"))
+
+	_, err := i.MarshalEntry("foo", "0.2.0")
+	require.Error(t, err)
+
+	b, err := i.MarshalEntry("foo", "0.1.0")
+	require.NoError(t, err)
+	expected, err := i.index.Get("foo", "0.1.0")
+	require.NoError(t, err)
+
+	_, err = i.Delete("foo", "0.1.0")
+	require.NoError(t, err)
+	require.False(t, i.Has("foo", "0.1.0"))
+
+	require.NoError(t, i.RestoreEntry(b))
+	restored, err := i.index.Get("foo", "0.1.0")
+	require.NoError(t, err)
+	require.Equal(t, expected.Metadata, restored.Metadata)
+	require.Equal(t, expected.URLs, restored.URLs)
+	require.Equal(t, expected.Digest, restored.Digest)
+	require.True(t, expected.Created.Equal(restored.Created))
+
+	require.Error(t, i.RestoreEntry([]byte(`{"urls": ["foo-0.1.0.tgz"]}`)))
+}
+
 func TestIndexV3WriteFile(t *testing.T) { // nolint:funlen // Note: table test.
 	t.Parallel()
 
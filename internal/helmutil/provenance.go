@@ -1,7 +1,10 @@
 package helmutil
 
 import (
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 )
 
 // Digest hashes a reader and returns a SHA256 digest.
@@ -19,3 +22,68 @@ func DigestFile(filename string) (string, error) {
 	}
 	return digestFileV2(filename)
 }
+
+// SignChart signs the chart archive with the key from the keyring and returns
+// the contents of its provenance file. The filename is the name of the chart
+// archive recorded in the provenance file. If the key is protected by a
+// passphrase, it is read from the HELM_KEY_PASSPHRASE environment variable.
+func SignChart(filename string, archive []byte, keyring, key string) ([]byte, error) {
+	fpath, cleanup, err := writeTempArchive(filename, archive)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	if IsHelm3() {
+		return signChartV3(fpath, keyring, key)
+	}
+	return signChartV2(fpath, keyring, key)
+}
+
+// VerifyChart verifies the chart archive against its provenance file using
+// the public keys from the keyring. The filename is the name of the chart
+// archive recorded in the provenance file.
+func VerifyChart(filename string, archive, prov []byte, keyring string) error {
+	fpath, cleanup, err := writeTempArchive(filename, archive)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := os.WriteFile(fpath+".prov", prov, 0600); err != nil {
+		return err
+	}
+
+	if IsHelm3() {
+		return verifyChartV3(fpath, keyring)
+	}
+	return verifyChartV2(fpath, keyring)
+}
+
+// keyPassphrase returns the passphrase of the signing key.
+func keyPassphrase(name string) ([]byte, error) {
+	passphrase, ok := os.LookupEnv("HELM_KEY_PASSPHRASE")
+	if !ok {
+		return nil, fmt.Errorf("key %s is protected by a passphrase, set it in the HELM_KEY_PASSPHRASE environment variable", name)
+	}
+	return []byte(passphrase), nil
+}
+
+// writeTempArchive writes the chart archive to a temporary directory under the
+// given file name, because Helm signs and verifies chart archives by path. The
+// returned function removes the temporary directory.
+func writeTempArchive(filename string, archive []byte) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "helm-s3-chart-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	fpath := filepath.Join(dir, filepath.Base(filename))
+	if err := os.WriteFile(fpath, archive, 0600); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return fpath, cleanup, nil
+}
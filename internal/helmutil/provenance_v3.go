@@ -1,6 +1,7 @@
 package helmutil
 
 import (
+	"fmt"
 	"io"
 
 	"helm.sh/helm/v3/pkg/provenance"
@@ -13,3 +14,35 @@ func digestV3(in io.Reader) (string, error) {
 func digestFileV3(filename string) (string, error) {
 	return provenance.DigestFile(filename)
 }
+
+func signChartV3(fpath, keyring, key string) ([]byte, error) {
+	signer, err := provenance.NewFromKeyring(keyring, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing key: %s", err.Error())
+	}
+	if signer.Entity == nil || signer.Entity.PrivateKey == nil {
+		return nil, fmt.Errorf("private key %s not found in keyring %s", key, keyring)
+	}
+	if signer.Entity.PrivateKey.Encrypted {
+		if err := signer.DecryptKey(keyPassphrase); err != nil {
+			return nil, fmt.Errorf("failed to decrypt signing key: %s", err.Error())
+		}
+	}
+
+	sig, err := signer.ClearSign(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign chart: %s", err.Error())
+	}
+	return []byte(sig), nil
+}
+
+func verifyChartV3(fpath, keyring string) error {
+	sig, err := provenance.NewFromKeyring(keyring, "")
+	if err != nil {
+		return fmt.Errorf("failed to load keyring: %s", err.Error())
+	}
+	if _, err := sig.Verify(fpath, fpath+".prov"); err != nil {
+		return fmt.Errorf("failed to verify chart: %s", err.Error())
+	}
+	return nil
+}
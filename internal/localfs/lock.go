@@ -0,0 +1,222 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+)
+
+// lockFilename is the name of the lock file in the repository.
+const lockFilename = ".helm-s3.lock"
+
+// Lock is an advisory lock held on a repository.
+// It implements backend.Lock.
+type Lock struct {
+	fpath string
+	info  backend.LockInfo
+}
+
+// Info returns information about the lock.
+func (l *Lock) Info() backend.LockInfo {
+	return l.info
+}
+
+// Renew extends the lock to expire ttl from now. The lock file is replaced
+// by a plain write once it is checked to be still held by us.
+func (l *Lock) Renew(ctx context.Context, ttl time.Duration) error {
+	current, err := readLock(l.fpath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return backend.ErrLocked
+		}
+		return err
+	}
+	if current.Owner != l.info.Owner {
+		return lockedError(current)
+	}
+
+	info := l.info
+	info.Expires = time.Now().UTC().Add(ttl)
+	b, err := json.Marshal(info)
+	if err != nil {
+		return errors.Wrap(err, "marshal lock info")
+	}
+	if err := writeFile(l.fpath, bytes.NewReader(b)); err != nil {
+		return errors.WithMessage(err, "renew lock")
+	}
+
+	l.info = info
+	return nil
+}
+
+// Release releases the lock if it is still held by us.
+func (l *Lock) Release(ctx context.Context) error {
+	current, err := readLock(l.fpath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// Somebody has broken the lock, nothing to release.
+			return nil
+		}
+		return err
+	}
+	if current.Owner != l.info.Owner {
+		// The lock expired and was taken over by somebody else.
+		return nil
+	}
+
+	return errors.Wrap(os.Remove(l.fpath), "remove lock file")
+}
+
+// AcquireLock acquires the advisory lock on the repository for the given
+// duration. If the repository is already locked by someone else, it returns
+// backend.ErrLocked. Locks that have expired are taken over.
+// RepoURI must be in the form of file protocol: file:///path/to/repo.
+func (s *Storage) AcquireLock(ctx context.Context, repoURI string, ttl time.Duration) (backend.Lock, error) {
+	dir, err := parseURI(repoURI)
+	if err != nil {
+		return nil, err
+	}
+	fpath := filepath.Join(dir, lockFilename)
+
+	hostname, _ := os.Hostname()
+	now := time.Now().UTC()
+	info := backend.LockInfo{
+		Owner:    uuid.New().String(),
+		Hostname: hostname,
+		Acquired: now,
+		Expires:  now.Add(ttl),
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal lock info")
+	}
+
+	current, err := readLock(fpath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// Exclusive creation guarantees that only one of the concurrent
+		// processes acquires the lock.
+		f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				return nil, backend.ErrLocked
+			}
+			return nil, errors.Wrap(err, "create lock file")
+		}
+		if _, err := f.Write(b); err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "write lock file")
+		}
+		if err := f.Close(); err != nil {
+			return nil, errors.Wrap(err, "close lock file")
+		}
+
+	case err != nil:
+		return nil, err
+
+	case !current.Expired():
+		return nil, lockedError(current)
+
+	default:
+		if err := writeFile(fpath, bytes.NewReader(b)); err != nil {
+			return nil, errors.WithMessage(err, "take over stale lock")
+		}
+	}
+
+	// Stale locks are taken over by a plain write, so make sure that we are
+	// the one who won the race.
+	current, err = readLock(fpath)
+	if err != nil {
+		return nil, errors.WithMessage(err, "verify lock")
+	}
+	if current.Owner != info.Owner {
+		return nil, lockedError(current)
+	}
+
+	return &Lock{fpath: fpath, info: info}, nil
+}
+
+// FetchLock returns information about the current repository lock or nil
+// if the repository is not locked.
+// RepoURI must be in the form of file protocol: file:///path/to/repo.
+func (s *Storage) FetchLock(ctx context.Context, repoURI string) (*backend.LockInfo, error) {
+	dir, err := parseURI(repoURI)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := readLock(filepath.Join(dir, lockFilename))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// BreakLock unconditionally removes the repository lock, regardless of who
+// is holding it.
+// RepoURI must be in the form of file protocol: file:///path/to/repo.
+func (s *Storage) BreakLock(ctx context.Context, repoURI string) error {
+	dir, err := parseURI(repoURI)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filepath.Join(dir, lockFilename))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return errors.Wrap(err, "remove lock file")
+	}
+
+	return nil
+}
+
+// readLock reads the lock info from the lock file.
+func readLock(fpath string) (backend.LockInfo, error) {
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		return backend.LockInfo{}, err
+	}
+
+	var info backend.LockInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return backend.LockInfo{}, errors.Wrap(err, "unmarshal lock info")
+	}
+
+	return info, nil
+}
+
+// lockedError returns backend.ErrLocked annotated with the current lock holder.
+func lockedError(info backend.LockInfo) error {
+	return errors.Wrapf(
+		backend.ErrLocked,
+		"held by %s on host %s until %s",
+		info.Owner, info.Hostname, info.Expires.Format(time.RFC3339),
+	)
+}
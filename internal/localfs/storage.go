@@ -0,0 +1,488 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package localfs implements the storage backend serving chart repositories
+// from the local file system by file:///path/to/repo URIs.
+package localfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+	"github.com/banzaicloud/helm-s3/internal/helmutil"
+)
+
+const (
+	// metaFileSuffix is the suffix of the sidecar file keeping the chart
+	// metadata that S3 keeps in the object metadata.
+	metaFileSuffix = ".meta.json"
+
+	// MetaChartMetadata is a sidecar file key that represents chart metadata.
+	metaChartMetadata = "chart-metadata"
+
+	// MetaChartDigest is a sidecar file key that represents chart digest.
+	metaChartDigest = "chart-digest"
+)
+
+func init() {
+	backend.Register("file", func(uri string) (backend.Storage, error) {
+		return New(), nil
+	})
+}
+
+// New returns a new Storage.
+func New() *Storage {
+	return &Storage{}
+}
+
+// Storage provides an interface to work with chart repositories on the local
+// file system by file protocol. It implements backend.Storage.
+//
+// Charts are kept as plain files, and the metadata that is kept in object
+// metadata on S3 is kept in a sidecar JSON file next to the chart.
+type Storage struct{}
+
+// Traverse traverses all charts in the repository in the file name order.
+// Local files are cheap to read, so opts.Concurrency is ignored.
+func (s *Storage) Traverse(ctx context.Context, repoURI string, opts backend.TraverseOptions) (<-chan backend.ChartInfo, <-chan error) {
+	charts := make(chan backend.ChartInfo, 1)
+	errs := make(chan error, 1)
+	go s.traverse(ctx, repoURI, opts, charts, errs)
+	return charts, errs
+}
+
+// traverse traverses all charts in the repository.
+// It writes an info item about every chart to items, and errors to errs.
+// It always closes both channels when returns.
+func (s *Storage) traverse(
+	ctx context.Context,
+	repoURI string,
+	opts backend.TraverseOptions,
+	items chan<- backend.ChartInfo,
+	errs chan<- error,
+) {
+	defer close(items)
+	defer close(errs)
+
+	dir, err := parseURI(repoURI)
+	if err != nil {
+		errs <- err
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		errs <- errors.Wrap(err, "list repository directory")
+		return
+	}
+
+	for _, entry := range entries {
+		// Subdirectories are ignored, because chart repository is flat and
+		// cannot contain nested directories.
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".tgz") {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			errs <- err
+			return
+		}
+
+		fpath := filepath.Join(dir, entry.Name())
+		fi, err := entry.Info()
+		if err != nil {
+			errs <- errors.Wrapf(err, "stat chart file %s", fpath)
+			return
+		}
+
+		item := backend.ChartInfo{Filename: entry.Name(), Unchanged: true}
+		if opts.NotModified == nil || !opts.NotModified(entry.Name(), fi.ModTime()) {
+			item, err = chartInfo(fpath, opts.Unchanged)
+			if err != nil {
+				errs <- errors.WithMessagef(err, "process chart file %s", fpath)
+				return
+			}
+		}
+		item.Modified = fi.ModTime()
+
+		select {
+		case items <- item:
+		case <-ctx.Done():
+			errs <- ctx.Err()
+			return
+		}
+	}
+}
+
+// chartInfo returns chart info from the sidecar metadata file, or from the
+// chart file itself if the sidecar file is missing. The chart is reported
+// unchanged without loading its metadata if unchanged reports so for the
+// digest in the sidecar file.
+func chartInfo(fpath string, unchanged func(filename, digest string) bool) (backend.ChartInfo, error) {
+	item := backend.ChartInfo{Filename: filepath.Base(fpath)}
+
+	meta, err := readMetaFile(fpath)
+	if err == nil && meta[metaChartDigest] != "" && unchanged != nil && unchanged(item.Filename, meta[metaChartDigest]) {
+		item.Hash = meta[metaChartDigest]
+		item.Unchanged = true
+		return item, nil
+	}
+	if err == nil && meta[metaChartMetadata] != "" && meta[metaChartDigest] != "" {
+		chartMeta := helmutil.NewChartMetadata()
+		if err := chartMeta.UnmarshalJSON([]byte(meta[metaChartMetadata])); err != nil {
+			return backend.ChartInfo{}, errors.Wrap(err, "unserialize chart meta")
+		}
+
+		item.Meta = chartMeta
+		item.Hash = meta[metaChartDigest]
+		return item, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return backend.ChartInfo{}, err
+	}
+
+	// The chart was put to the repository by other means than
+	// 'helm s3 push', so we have to load the chart file itself.
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		return backend.ChartInfo{}, errors.Wrap(err, "read chart file")
+	}
+
+	ch, err := helmutil.LoadArchive(bytes.NewReader(b))
+	if err != nil {
+		return backend.ChartInfo{}, errors.Wrap(err, "load archive from chart file")
+	}
+
+	digest, err := helmutil.Digest(bytes.NewReader(b))
+	if err != nil {
+		return backend.ChartInfo{}, errors.WithMessage(err, "get chart hash")
+	}
+
+	item.Meta = ch.Metadata()
+	item.Hash = digest
+	return item, nil
+}
+
+// FetchRaw reads the file from URI and returns it in the form of byte slice.
+// Uri must be in the form of file protocol: file:///path/to/file.
+func (s *Storage) FetchRaw(ctx context.Context, uri string) ([]byte, error) {
+	fpath, err := parseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, backend.ErrObjectNotFound
+		}
+		return nil, errors.Wrap(err, "read file")
+	}
+
+	return b, nil
+}
+
+// Download copies the file from URI to w.
+// Uri must be in the form of file protocol: file:///path/to/file.
+func (s *Storage) Download(ctx context.Context, uri string, w io.Writer) error {
+	fpath, err := parseURI(uri)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fpath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return backend.ErrObjectNotFound
+		}
+		return errors.Wrap(err, "open file")
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return errors.Wrap(err, "copy file")
+	}
+
+	return nil
+}
+
+// FetchIndex reads the index file from URI and returns it in the form of
+// byte slice along with its content digest used as the version tag.
+// Uri must be in the form of file protocol: file:///path/to/file.
+func (s *Storage) FetchIndex(ctx context.Context, uri string) ([]byte, string, error) {
+	b, err := s.FetchRaw(ctx, uri)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return b, contentTag(b), nil
+}
+
+// Exists returns true if a file exists in the storage.
+func (s *Storage) Exists(ctx context.Context, uri string) (bool, error) {
+	fpath, err := parseURI(uri)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(fpath); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "stat file")
+	}
+
+	return true, nil
+}
+
+// PutChart puts the chart file to the storage along with its sidecar
+// metadata file. ACL and content type are not applicable to local files and
+// are ignored.
+// Uri must be in the form of file protocol: file:///path/to/file.
+func (s *Storage) PutChart(
+	ctx context.Context,
+	uri string,
+	r io.Reader,
+	chartMeta string,
+	acl string,
+	chartDigest string,
+	contentType string,
+) (string, error) {
+	fpath, err := parseURI(uri)
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeFile(fpath, r); err != nil {
+		return "", errors.WithMessage(err, "write chart file")
+	}
+
+	meta, err := json.Marshal(map[string]string{
+		metaChartMetadata: chartMeta,
+		metaChartDigest:   chartDigest,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "marshal chart metadata")
+	}
+	if err := writeFile(fpath+metaFileSuffix, bytes.NewReader(meta)); err != nil {
+		return "", errors.WithMessage(err, "write chart metadata file")
+	}
+
+	return uri, nil
+}
+
+// PutRaw puts the file to the storage as is. ACL and content type are not
+// applicable to local files and are ignored.
+// Uri must be in the form of file protocol: file:///path/to/file.
+func (s *Storage) PutRaw(ctx context.Context, uri string, r io.Reader, acl, contentType string) error {
+	fpath, err := parseURI(uri)
+	if err != nil {
+		return err
+	}
+
+	return errors.WithMessage(writeFile(fpath, r), "write file")
+}
+
+// PutIndex puts the index file to the repository.
+// Uri must be in the form of file protocol: file:///path/to/repo.
+func (s *Storage) PutIndex(ctx context.Context, uri, acl string, r io.Reader) error {
+	return s.PutIndexIfMatch(ctx, uri, acl, "", r)
+}
+
+// PutIndexIfMatch puts the index file to the repository only if the content
+// digest of the current index matches the given one, as returned by
+// FetchIndex. Otherwise it returns backend.ErrIndexModified. An empty digest
+// makes the upload unconditional.
+//
+// Note: the check and the write are not atomic, use the repository lock to
+// serialize concurrent writers.
+// Uri must be in the form of file protocol: file:///path/to/repo.
+func (s *Storage) PutIndexIfMatch(ctx context.Context, uri, acl, etag string, r io.Reader) error {
+	dir, err := parseURI(uri)
+	if err != nil {
+		return err
+	}
+	fpath := filepath.Join(dir, "index.yaml")
+
+	if etag != "" {
+		b, err := s.FetchRaw(ctx, fileURI(fpath))
+		if err != nil {
+			if err == backend.ErrObjectNotFound {
+				return backend.ErrIndexModified
+			}
+			return err
+		}
+		if etag != contentTag(b) {
+			return backend.ErrIndexModified
+		}
+	}
+
+	if err := writeFile(fpath, r); err != nil {
+		return errors.WithMessage(err, "write index file")
+	}
+
+	return nil
+}
+
+// Copy copies the file along with its sidecar metadata file. ACL is not
+// applicable to local files and is ignored.
+// Uris must be in the form of file protocol: file:///path/to/file.
+func (s *Storage) Copy(ctx context.Context, srcURI, dstURI, acl string) error {
+	src, err := parseURI(srcURI)
+	if err != nil {
+		return err
+	}
+	dst, err := parseURI(dstURI)
+	if err != nil {
+		return err
+	}
+
+	for _, suffix := range []string{"", metaFileSuffix} {
+		f, err := os.Open(src + suffix)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				if suffix == "" {
+					return backend.ErrObjectNotFound
+				}
+				// Files put as is have no metadata.
+				continue
+			}
+			return errors.Wrap(err, "open file")
+		}
+
+		err = writeFile(dst+suffix, f)
+		f.Close()
+		if err != nil {
+			return errors.WithMessage(err, "write file")
+		}
+	}
+
+	return nil
+}
+
+// Delete deletes the file by uri along with its sidecar metadata file.
+// Deleting a missing file is not an error.
+// Uri must be in the form of file protocol: file:///path/to/file.
+func (s *Storage) Delete(ctx context.Context, uri string) error {
+	fpath, err := parseURI(uri)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range []string{fpath, fpath + metaFileSuffix} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return errors.Wrap(err, "delete file")
+		}
+	}
+
+	return nil
+}
+
+// DeleteBatch deletes the files by uris along with their sidecar metadata
+// files.
+func (s *Storage) DeleteBatch(ctx context.Context, uris []string) error {
+	for _, uri := range uris {
+		if err := s.Delete(ctx, uri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMetaFile reads the sidecar metadata file of the chart.
+func readMetaFile(fpath string) (map[string]string, error) {
+	b, err := os.ReadFile(fpath + metaFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := map[string]string{}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, errors.Wrap(err, "unmarshal chart metadata file")
+	}
+
+	return meta, nil
+}
+
+// writeFile atomically writes the content of the reader to the file by
+// writing a temporary file first and renaming it afterwards, so that readers
+// never see partially written files.
+func writeFile(fpath string, r io.Reader) error {
+	dir := filepath.Dir(fpath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "create directory")
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(fpath)+".*")
+	if err != nil {
+		return errors.Wrap(err, "create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "write temporary file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "close temporary file")
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return errors.Wrap(err, "chmod temporary file")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), fpath), "rename temporary file")
+}
+
+// contentTag returns the version tag of the content.
+func contentTag(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseURI returns the file system path from URIs like:
+// - file:///path/to/dir
+// - file:///path/to/dir/file.ext.
+func parseURI(uri string) (string, error) {
+	if !strings.HasPrefix(uri, "file://") {
+		return "", fmt.Errorf("uri %s protocol is not file", uri)
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse uri %s", uri)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("uri %s must not have a host other than localhost", uri)
+	}
+
+	return filepath.FromSlash(u.Path), nil
+}
+
+// fileURI returns the file protocol URI of the path.
+func fileURI(fpath string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(fpath)}).String()
+}
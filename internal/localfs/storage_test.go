@@ -0,0 +1,242 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localfs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/helm-s3/internal/backend"
+)
+
+func TestParseURI(t *testing.T) {
+	testCases := map[string]struct {
+		uri          string
+		expectedPath string
+		expectError  bool
+	}{
+		"absolute path": {
+			uri:          "file:///srv/charts",
+			expectedPath: "/srv/charts",
+		},
+		"localhost": {
+			uri:          "file://localhost/srv/charts/index.yaml",
+			expectedPath: "/srv/charts/index.yaml",
+		},
+		"other host": {
+			uri:         "file://example.com/srv/charts",
+			expectError: true,
+		},
+		"other protocol": {
+			uri:         "s3://bucket/charts",
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			fpath, err := parseURI(tc.uri)
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, filepath.FromSlash(tc.expectedPath), fpath)
+		})
+	}
+}
+
+func TestBackendNew(t *testing.T) {
+	ctx := context.Background()
+	repoURI := fileURI(t.TempDir())
+
+	s, err := backend.New(repoURI)
+	require.NoError(t, err)
+	require.IsType(t, &Storage{}, s)
+
+	require.NoError(t, s.PutIndex(ctx, repoURI, "", strings.NewReader("index")))
+	b, err := s.FetchRaw(ctx, repoURI+"/index.yaml")
+	require.NoError(t, err)
+	require.Equal(t, "index", string(b))
+}
+
+func TestStorage_PutIndexIfMatch(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repoURI := fileURI(dir)
+	s := New()
+
+	require.NoError(t, s.PutIndex(ctx, repoURI, "", strings.NewReader("first")))
+
+	b, etag, err := s.FetchIndex(ctx, repoURI+"/index.yaml")
+	require.NoError(t, err)
+	require.Equal(t, "first", string(b))
+
+	require.NoError(t, s.PutIndexIfMatch(ctx, repoURI, "", etag, strings.NewReader("second")))
+
+	// The index has changed since it was fetched.
+	err = s.PutIndexIfMatch(ctx, repoURI, "", etag, strings.NewReader("third"))
+	require.Equal(t, backend.ErrIndexModified, err)
+
+	b, err = s.FetchRaw(ctx, repoURI+"/index.yaml")
+	require.NoError(t, err)
+	require.Equal(t, "second", string(b))
+}
+
+func TestStorage_Delete(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	uri := fileURI(filepath.Join(dir, "foo-1.2.3.tgz"))
+	s := New()
+
+	_, err := s.PutChart(ctx, uri, strings.NewReader("chart"), "{}", "", "sha256:1", "")
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(dir, "foo-1.2.3.tgz"+metaFileSuffix))
+
+	require.NoError(t, s.Delete(ctx, uri))
+
+	exists, err := s.Exists(ctx, uri)
+	require.NoError(t, err)
+	require.False(t, exists)
+	require.NoFileExists(t, filepath.Join(dir, "foo-1.2.3.tgz"+metaFileSuffix))
+
+	// Deleting a missing file is not an error.
+	require.NoError(t, s.Delete(ctx, uri))
+
+	_, err = s.FetchRaw(ctx, uri)
+	require.Equal(t, backend.ErrObjectNotFound, err)
+}
+
+func TestStorage_Download(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	uri := fileURI(filepath.Join(dir, "foo-1.2.3.tgz"))
+	s := New()
+
+	_, err := s.PutChart(ctx, uri, strings.NewReader("chart"), "{}", "", "sha256:1", "")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, s.Download(ctx, uri, &buf))
+	require.Equal(t, "chart", buf.String())
+
+	buf.Reset()
+	err = s.Download(ctx, fileURI(filepath.Join(dir, "missing-1.0.0.tgz")), &buf)
+	require.Equal(t, backend.ErrObjectNotFound, err)
+	require.Empty(t, buf.Bytes())
+}
+
+func TestStorage_Copy(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	src := fileURI(filepath.Join(dir, "foo-1.2.3.tgz"))
+	dst := fileURI(filepath.Join(dir, ".trash", "foo-1.2.3.tgz"))
+	s := New()
+
+	_, err := s.PutChart(ctx, src, strings.NewReader("chart"), "{}", "", "sha256:1", "")
+	require.NoError(t, err)
+
+	require.NoError(t, s.Copy(ctx, src, dst, ""))
+
+	b, err := s.FetchRaw(ctx, dst)
+	require.NoError(t, err)
+	require.Equal(t, "chart", string(b))
+	require.FileExists(t, filepath.Join(dir, ".trash", "foo-1.2.3.tgz"+metaFileSuffix))
+
+	// The source is kept.
+	exists, err := s.Exists(ctx, src)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	err = s.Copy(ctx, fileURI(filepath.Join(dir, "missing-1.0.0.tgz")), dst, "")
+	require.Equal(t, backend.ErrObjectNotFound, err)
+}
+
+func TestStorage_AcquireLock(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repoURI := fileURI(dir)
+	s := New()
+
+	lock, err := s.AcquireLock(ctx, repoURI, time.Minute)
+	require.NoError(t, err)
+
+	_, err = s.AcquireLock(ctx, repoURI, time.Minute)
+	require.Equal(t, backend.ErrLocked, errors.Cause(err))
+
+	info, err := s.FetchLock(ctx, repoURI)
+	require.NoError(t, err)
+	require.Equal(t, lock.Info().Owner, info.Owner)
+
+	require.NoError(t, lock.Release(ctx))
+
+	info, err = s.FetchLock(ctx, repoURI)
+	require.NoError(t, err)
+	require.Nil(t, info)
+}
+
+func TestStorage_AcquireLock_Renew(t *testing.T) {
+	ctx := context.Background()
+	repoURI := fileURI(t.TempDir())
+	s := New()
+
+	lock, err := s.AcquireLock(ctx, repoURI, time.Second)
+	require.NoError(t, err)
+	expires := lock.Info().Expires
+
+	require.NoError(t, lock.Renew(ctx, time.Hour))
+	require.True(t, lock.Info().Expires.After(expires.Add(time.Minute)))
+
+	info, err := s.FetchLock(ctx, repoURI)
+	require.NoError(t, err)
+	require.Equal(t, lock.Info().Owner, info.Owner)
+	require.True(t, info.Expires.Equal(lock.Info().Expires))
+
+	// A broken lock cannot be renewed.
+	require.NoError(t, s.BreakLock(ctx, repoURI))
+	require.Equal(t, backend.ErrLocked, lock.Renew(ctx, time.Minute))
+}
+
+func TestStorage_AcquireLock_Stale(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repoURI := fileURI(dir)
+	s := New()
+
+	stale, err := s.AcquireLock(ctx, repoURI, -time.Minute)
+	require.NoError(t, err)
+
+	lock, err := s.AcquireLock(ctx, repoURI, time.Minute)
+	require.NoError(t, err)
+	require.NotEqual(t, stale.Info().Owner, lock.Info().Owner)
+
+	// The previous holder can neither renew nor release the new lock.
+	require.Equal(t, backend.ErrLocked, errors.Cause(stale.Renew(ctx, time.Minute)))
+	require.NoError(t, stale.Release(ctx))
+	require.FileExists(t, filepath.Join(dir, lockFilename))
+
+	require.NoError(t, s.BreakLock(ctx, repoURI))
+	_, err = os.Stat(filepath.Join(dir, lockFilename))
+	require.True(t, os.IsNotExist(err))
+}
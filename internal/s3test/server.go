@@ -0,0 +1,994 @@
+// Copyright © 2021 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package s3test provides an in-memory fake of the AWS S3 API for tests.
+//
+// The fake is an HTTP server speaking the subset of the S3 REST protocol used
+// by the plugin, so the code under test goes through the real AWS SDK
+// including request signing, retries and error unmarshalling. It models
+// object metadata and its 2 KB limit, pagination of ListObjectsV2, NotFound
+// errors, conditional requests, bucket versioning and injectable failures.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	// MetadataLimitBytes is the maximum size of user-defined object metadata
+	// that S3 accepts.
+	MetadataLimitBytes = 2048
+
+	// defaultMaxKeys is the maximum number of keys S3 returns in a single
+	// ListObjectsV2 page.
+	defaultMaxKeys = 1000
+
+	// Region is the region reported by the server.
+	Region = "us-east-1"
+
+	metaHeaderPrefix = "X-Amz-Meta-"
+)
+
+// Object is an object stored in the fake.
+type Object struct {
+	Body         []byte
+	ContentType  string
+	Metadata     map[string]string
+	ETag         string
+	LastModified time.Time
+
+	// VersionID is the version of the object in a bucket with versioning
+	// enabled, empty otherwise.
+	VersionID string
+
+	// ServerSideEncryption and SSEKMSKeyID are the server-side encryption
+	// settings the object was put with.
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+}
+
+// Failure describes a failure injected into the server.
+type Failure struct {
+	// Op is the name of the S3 operation to fail, e.g. "PutObject".
+	Op string
+
+	// Key is the object key to fail the operation for. Empty matches any key.
+	Key string
+
+	// StatusCode is the HTTP status code of the error response. Zero makes
+	// the request succeed after Delay.
+	StatusCode int
+
+	// Code is the S3 error code of the error response, e.g. "InternalError".
+	Code string
+
+	// Delay delays the response, to simulate slow requests.
+	Delay time.Duration
+
+	// Times is the number of requests to fail. Zero fails every request.
+	Times int
+
+	// Truncate makes the server drop the connection after sending the
+	// number of bytes of the object, to simulate interrupted downloads. It
+	// applies to GetObject requests succeeding otherwise.
+	Truncate int
+}
+
+// Server is an in-memory fake of the AWS S3 API.
+type Server struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]*Object
+	failures []*Failure
+	calls    map[string]int
+	maxKeys  int
+
+	// sent is the number of object bytes sent in GetObject responses.
+	sent int64
+
+	// versions holds every version of the objects in the buckets with
+	// versioning enabled by bucket and key, the oldest first.
+	versions map[string]map[string][]*Object
+	nextID   int
+}
+
+// NewServer starts a new fake S3 server. The caller should call Close when
+// finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		buckets:  map[string]map[string]*Object{},
+		calls:    map[string]int{},
+		versions: map[string]map[string][]*Object{},
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// URL returns the endpoint URL of the server.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Session returns an AWS session configured to talk to the server.
+func (s *Server) Session() *session.Session {
+	return session.Must(session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("test", "test", ""),
+		HTTPClient:       s.srv.Client(),
+		Endpoint:         aws.String(s.srv.URL),
+		Region:           aws.String(Region),
+		S3ForcePathStyle: aws.Bool(true),
+		DisableSSL:       aws.Bool(true),
+	}))
+}
+
+// Setenv sets the environment variables that make sessions created by
+// awsutil.Session talk to the server for the duration of the test. The
+// requests the default HTTP client sends to AWS S3, like the HEAD bucket
+// request detecting the bucket region, are sent to the server too.
+func (s *Server) Setenv(t *testing.T) {
+	t.Helper()
+
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = &awsTransport{server: s.srv.URL, base: s.srv.Client().Transport}
+	t.Cleanup(func() { http.DefaultClient.Transport = transport })
+
+	setenv(t, "AWS_ENDPOINT", s.srv.URL)
+	setenv(t, "AWS_DISABLE_SSL", "true")
+	setenv(t, "AWS_ACCESS_KEY_ID", "test")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "test")
+	setenv(t, "AWS_SESSION_TOKEN", "")
+	setenv(t, "AWS_PROFILE", "")
+	setenv(t, "AWS_CONFIG_FILE", "/dev/null")
+	setenv(t, "AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+	setenv(t, "AWS_EC2_METADATA_DISABLED", "true")
+	setenv(t, "AWS_CA_BUNDLE", "")
+	setenv(t, "HELM_S3_REGION", Region)
+}
+
+// awsS3Host is the host of the default AWS S3 endpoint.
+const awsS3Host = "s3.amazonaws.com"
+
+// awsTransport sends the requests for AWS S3 to the server, turning virtual
+// hosted-style requests into path-style ones.
+type awsTransport struct {
+	server string
+	base   http.RoundTripper
+}
+
+func (t *awsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	host := r.URL.Hostname()
+	if host != awsS3Host && !strings.HasSuffix(host, "."+awsS3Host) {
+		return t.base.RoundTrip(r)
+	}
+
+	u, err := url.Parse(t.server)
+	if err != nil {
+		return nil, err
+	}
+	if bucket := strings.TrimSuffix(host, "."+awsS3Host); bucket != host {
+		u.Path = "/" + bucket + r.URL.Path
+	} else {
+		u.Path = r.URL.Path
+	}
+	u.RawQuery = r.URL.RawQuery
+
+	r = r.Clone(r.Context())
+	r.URL = u
+	r.Host = u.Host
+	return t.base.RoundTrip(r)
+}
+
+// setenv sets the environment variable for the duration of the test.
+func setenv(t *testing.T, name, value string) {
+	t.Helper()
+
+	old, ok := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// CreateBucket creates an empty bucket.
+func (s *Server) CreateBucket(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = map[string]*Object{}
+	}
+}
+
+// PutObject puts the object to the bucket bypassing the API, creating the
+// bucket if necessary. Metadata keys are case-insensitive.
+func (s *Server) PutObject(bucket, key string, body []byte, metadata map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = map[string]*Object{}
+	}
+
+	meta := map[string]string{}
+	for k, v := range metadata {
+		meta[http.CanonicalHeaderKey(k)] = v
+	}
+	s.store(bucket, key, newObject(body, "", meta))
+}
+
+// EnableVersioning enables versioning of the bucket, creating the bucket if
+// necessary. Objects put afterwards keep their previous versions. Deleting
+// objects does not create delete markers.
+func (s *Server) EnableVersioning(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = map[string]*Object{}
+	}
+	if _, ok := s.versions[bucket]; !ok {
+		s.versions[bucket] = map[string][]*Object{}
+	}
+}
+
+// Versions returns copies of all versions of the object, the oldest first.
+func (s *Server) Versions(bucket, key string) []Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var versions []Object
+	for _, obj := range s.versions[bucket][key] {
+		versions = append(versions, *obj)
+	}
+	return versions
+}
+
+// store makes the object the current version of the key, keeping its
+// previous version if the bucket has versioning enabled.
+func (s *Server) store(bucket, key string, obj *Object) {
+	if versions, ok := s.versions[bucket]; ok {
+		s.nextID++
+		obj.VersionID = fmt.Sprintf("v%08d", s.nextID)
+		versions[key] = append(versions[key], obj)
+	}
+	s.buckets[bucket][key] = obj
+}
+
+// version returns the version of the object or nil if there is none.
+func (s *Server) version(bucket, key, versionID string) *Object {
+	for _, obj := range s.versions[bucket][key] {
+		if obj.VersionID == versionID {
+			return obj
+		}
+	}
+	return nil
+}
+
+// Object returns a copy of the object from the bucket.
+func (s *Server) Object(bucket, key string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.buckets[bucket][key]
+	if !ok {
+		return Object{}, false
+	}
+	return *obj, true
+}
+
+// SetLastModified sets the time the object was last modified, to simulate
+// objects modified at another time than they were put.
+func (s *Server) SetLastModified(bucket, key string, modified time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if obj, ok := s.buckets[bucket][key]; ok {
+		obj.LastModified = modified.UTC().Truncate(time.Second)
+	}
+}
+
+// Keys returns the sorted keys of all objects in the bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return sortedKeys(s.buckets[bucket])
+}
+
+// SetMaxKeys sets the maximum number of keys returned in a single
+// ListObjectsV2 page, to exercise pagination with a few objects.
+func (s *Server) SetMaxKeys(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxKeys = n
+}
+
+// InjectFailure makes the server fail requests matching the failure.
+func (s *Server) InjectFailure(f Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = append(s.failures, &f)
+}
+
+// Calls returns the number of requests received for the S3 operation.
+func (s *Server) Calls(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[op]
+}
+
+// Sent returns the number of object bytes sent in GetObject responses.
+func (s *Server) Sent() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sent
+}
+
+// KeyCalls returns the number of requests received for the S3 operation on
+// the object key.
+func (s *Server) KeyCalls(op, key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[op+" "+key]
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key := splitPath(r.URL.Path)
+	op := operation(r, key)
+
+	s.mu.Lock()
+	s.calls[op]++
+	if key != "" {
+		s.calls[op+" "+key]++
+	}
+	w.Header().Set("X-Amz-Request-Id", strconv.Itoa(s.calls[op]))
+	f := s.failure(op, key)
+	s.mu.Unlock()
+
+	if f != nil && f.Delay > 0 {
+		select {
+		case <-time.After(f.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f != nil && f.StatusCode != 0 {
+		writeError(w, r, f.StatusCode, f.Code)
+		return
+	}
+
+	objects, ok := s.buckets[bucket]
+	if !ok && op != "CreateBucket" {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch op {
+	case "CreateBucket":
+		if !ok {
+			s.buckets[bucket] = map[string]*Object{}
+		}
+	case "HeadBucket":
+		w.Header().Set("X-Amz-Bucket-Region", Region)
+	case "ListObjectsV2":
+		s.listObjects(w, r, objects)
+	case "ListObjectVersions":
+		s.listObjectVersions(w, r, bucket)
+	case "GetObject", "HeadObject":
+		if f != nil && f.Truncate > 0 {
+			w = &truncatedWriter{ResponseWriter: w, n: f.Truncate}
+		}
+		obj := objects[key]
+		if v := r.URL.Query().Get("versionId"); v != "" {
+			if obj = s.version(bucket, key, v); obj == nil {
+				writeError(w, r, http.StatusNotFound, "NoSuchVersion")
+				return
+			}
+		}
+		s.getObject(w, r, obj)
+	case "PutObject":
+		s.putObject(w, r, bucket, key)
+	case "CopyObject":
+		s.copyObject(w, r, bucket, key)
+	case "DeleteObject":
+		if v := r.Header.Get("If-Match"); v != "" {
+			if objects[key] == nil {
+				writeError(w, r, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			if v != objects[key].ETag {
+				writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed")
+				return
+			}
+		}
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case "DeleteObjects":
+		s.deleteObjects(w, r, objects)
+	default:
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// truncatedWriter writes only the first n bytes of the response body. As the
+// response is shorter than its Content-Length, the server drops the
+// connection once the handler returns.
+type truncatedWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (w *truncatedWriter) Write(b []byte) (int, error) {
+	if len(b) > w.n {
+		b = b[:w.n]
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.n -= n
+	if err == nil && w.n == 0 {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// failure returns the injected failure matching the request, if any.
+func (s *Server) failure(op, key string) *Failure {
+	for i, f := range s.failures {
+		if f.Op != op || (f.Key != "" && f.Key != key) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	KeyCount              int            `xml:"KeyCount"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	Contents              []listContents `xml:"Contents"`
+	CommonPrefixes        []listPrefix   `xml:"CommonPrefixes"`
+}
+
+type listContents struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type listPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request, objects map[string]*Object) {
+	q := r.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+
+	maxKeys := defaultMaxKeys
+	if v, err := strconv.Atoi(q.Get("max-keys")); err == nil && v < maxKeys {
+		maxKeys = v
+	}
+	if s.maxKeys > 0 && s.maxKeys < maxKeys {
+		maxKeys = s.maxKeys
+	}
+
+	// The continuation token is the last key or common prefix returned on
+	// the previous page.
+	marker := q.Get("start-after")
+	if token := q.Get("continuation-token"); token != "" {
+		marker = token
+	}
+
+	res := listBucketResult{
+		Name:              strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0],
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		ContinuationToken: q.Get("continuation-token"),
+	}
+
+	last := ""
+	for _, key := range sortedKeys(objects) {
+		if !strings.HasPrefix(key, prefix) || key <= marker {
+			continue
+		}
+		if delimiter != "" && strings.HasSuffix(marker, delimiter) && strings.HasPrefix(key, marker) {
+			// The common prefix has been returned already.
+			continue
+		}
+
+		item := key
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			item = key[:len(prefix)+i+len(delimiter)]
+		}
+		if item == last {
+			continue
+		}
+
+		if res.KeyCount == maxKeys {
+			res.IsTruncated = true
+			res.NextContinuationToken = last
+			break
+		}
+
+		if item != key {
+			res.CommonPrefixes = append(res.CommonPrefixes, listPrefix{Prefix: item})
+		} else {
+			obj := objects[key]
+			res.Contents = append(res.Contents, listContents{
+				Key:          key,
+				LastModified: obj.LastModified.Format("2006-01-02T15:04:05.000Z"),
+				ETag:         obj.ETag,
+				Size:         len(obj.Body),
+				StorageClass: "STANDARD",
+			})
+		}
+		res.KeyCount++
+		last = item
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+type listVersionsResult struct {
+	XMLName     xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListVersionsResult"`
+	Name        string        `xml:"Name"`
+	Prefix      string        `xml:"Prefix"`
+	MaxKeys     int           `xml:"MaxKeys"`
+	IsTruncated bool          `xml:"IsTruncated"`
+	Versions    []listVersion `xml:"Version"`
+}
+
+type listVersion struct {
+	Key          string `xml:"Key"`
+	VersionID    string `xml:"VersionId"`
+	IsLatest     bool   `xml:"IsLatest"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// listObjectVersions lists the versions of the objects matching the prefix,
+// by key and the newest first, in a single page. Objects in buckets without
+// versioning have the single version "null".
+func (s *Server) listObjectVersions(w http.ResponseWriter, r *http.Request, bucket string) {
+	prefix := r.URL.Query().Get("prefix")
+	objects := s.buckets[bucket]
+
+	res := listVersionsResult{
+		Name:    bucket,
+		Prefix:  prefix,
+		MaxKeys: defaultMaxKeys,
+	}
+
+	add := func(key string, obj *Object, versionID string) {
+		res.Versions = append(res.Versions, listVersion{
+			Key:          key,
+			VersionID:    versionID,
+			IsLatest:     objects[key] == obj,
+			LastModified: obj.LastModified.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         obj.ETag,
+			Size:         len(obj.Body),
+			StorageClass: "STANDARD",
+		})
+	}
+
+	versions, versioned := s.versions[bucket]
+	if !versioned {
+		for _, key := range sortedKeys(objects) {
+			if strings.HasPrefix(key, prefix) {
+				add(key, objects[key], "null")
+			}
+		}
+	} else {
+		keys := make([]string, 0, len(versions))
+		for key := range versions {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			for i := len(versions[key]) - 1; i >= 0; i-- {
+				add(key, versions[key][i], versions[key][i].VersionID)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, obj *Object) {
+	if obj == nil {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	if v := r.Header.Get("If-Match"); v != "" && v != obj.ETag {
+		writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+
+	h := w.Header()
+	h.Set("ETag", obj.ETag)
+	if obj.VersionID != "" {
+		h.Set("X-Amz-Version-Id", obj.VersionID)
+	}
+	h.Set("Last-Modified", obj.LastModified.Format(http.TimeFormat))
+	h.Set("Accept-Ranges", "bytes")
+	if obj.ContentType != "" {
+		h.Set("Content-Type", obj.ContentType)
+	}
+	for k, v := range obj.Metadata {
+		h.Set(metaHeaderPrefix+k, v)
+	}
+
+	if v := r.Header.Get("If-None-Match"); v != "" && v == obj.ETag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body, status := obj.Body, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		// Like S3, no range of an empty object is satisfiable.
+		start, end, ok := parseRange(rng, len(obj.Body))
+		if !ok || len(obj.Body) == 0 {
+			writeError(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		body, status = obj.Body[start:end+1], http.StatusPartialContent
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(obj.Body)))
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		n, _ := w.Write(body)
+		s.sent += int64(n)
+	}
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	meta := map[string]string{}
+	size := 0
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, metaHeaderPrefix) {
+			name := strings.TrimPrefix(k, metaHeaderPrefix)
+			meta[name] = v[0]
+			size += len(name) + len(v[0])
+		}
+	}
+	if size > MetadataLimitBytes {
+		writeError(w, r, http.StatusBadRequest, "MetadataTooLarge")
+		return
+	}
+
+	current := s.buckets[bucket][key]
+	if v := r.Header.Get("If-None-Match"); v == "*" && current != nil {
+		writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	if v := r.Header.Get("If-Match"); v != "" {
+		if current == nil {
+			writeError(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if v != current.ETag {
+			writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+	}
+
+	obj := newObject(body, r.Header.Get("Content-Type"), meta)
+	obj.ServerSideEncryption = r.Header.Get("X-Amz-Server-Side-Encryption")
+	obj.SSEKMSKeyID = r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id")
+	s.store(bucket, key, obj)
+
+	w.Header().Set("ETag", obj.ETag)
+	if obj.VersionID != "" {
+		w.Header().Set("X-Amz-Version-Id", obj.VersionID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+}
+
+// copyObject copies the source object along with its content type and
+// metadata.
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+
+	srcBucket, srcKey := splitPath(source)
+	src, ok := s.buckets[srcBucket][srcKey]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	meta := make(map[string]string, len(src.Metadata))
+	for k, v := range src.Metadata {
+		meta[k] = v
+	}
+
+	obj := newObject(src.Body, src.ContentType, meta)
+	obj.ServerSideEncryption = r.Header.Get("X-Amz-Server-Side-Encryption")
+	obj.SSEKMSKeyID = r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id")
+	s.store(bucket, key, obj)
+
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(copyObjectResult{
+		ETag:         obj.ETag,
+		LastModified: obj.LastModified.Format(time.RFC3339),
+	})
+}
+
+type deleteRequest struct {
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+	Quiet bool `xml:"Quiet"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+type deletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// deleteObjects deletes the objects listed in the request body. Failures
+// injected into DeleteObject of the listed keys are reported per key.
+func (s *Server) deleteObjects(w http.ResponseWriter, r *http.Request, objects map[string]*Object) {
+	var req deleteRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	var res deleteResult
+	for _, obj := range req.Objects {
+		s.calls["DeleteObject "+obj.Key]++
+		if f := s.failure("DeleteObject", obj.Key); f != nil && f.StatusCode != 0 {
+			res.Errors = append(res.Errors, deleteError{Key: obj.Key, Code: f.Code, Message: f.Code})
+			continue
+		}
+
+		delete(objects, obj.Key)
+		if !req.Quiet {
+			res.Deleted = append(res.Deleted, deletedObject{Key: obj.Key})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// writeError writes the S3 error response. Responses to HEAD requests have no
+// body, so the SDK derives the error code from the status code.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	_ = xml.NewEncoder(&buf).Encode(errorResponse{Code: code, Message: code})
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// operation returns the name of the S3 operation requested.
+func operation(r *http.Request, key string) string {
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		switch {
+		case key == "" && q.Get("list-type") == "2":
+			return "ListObjectsV2"
+		case key == "":
+			if _, ok := q["versions"]; ok {
+				return "ListObjectVersions"
+			}
+		case key != "":
+			return "GetObject"
+		}
+	case http.MethodHead:
+		if key == "" {
+			return "HeadBucket"
+		}
+		return "HeadObject"
+	case http.MethodPut:
+		switch {
+		case key == "":
+			return "CreateBucket"
+		case r.Header.Get("X-Amz-Copy-Source") != "":
+			return "CopyObject"
+		}
+		return "PutObject"
+	case http.MethodDelete:
+		if key != "" {
+			return "DeleteObject"
+		}
+	case http.MethodPost:
+		if _, ok := q["delete"]; ok && key == "" {
+			return "DeleteObjects"
+		}
+		if _, ok := q["uploads"]; ok && key != "" {
+			return "CreateMultipartUpload"
+		}
+	}
+	return r.Method + " " + r.URL.Path
+}
+
+// splitPath returns the bucket and the key from the path-style request path.
+func splitPath(p string) (bucket, key string) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+// parseRange parses a single "bytes=start-end" range against the size and
+// returns inclusive offsets.
+func parseRange(rng string, size int) (start, end int, ok bool) {
+	spec := strings.TrimPrefix(rng, "bytes=")
+	parts := strings.SplitN(spec, "-", 2)
+	if spec == rng || len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	var err error
+	switch {
+	case parts[0] == "":
+		// Suffix range: the last N bytes.
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	default:
+		if start, err = strconv.Atoi(parts[0]); err != nil || start >= size {
+			return 0, 0, false
+		}
+		end = size - 1
+		if parts[1] != "" {
+			if end, err = strconv.Atoi(parts[1]); err != nil || end < start {
+				return 0, 0, false
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+		return start, end, true
+	}
+}
+
+func newObject(body []byte, contentType string, meta map[string]string) *Object {
+	sum := md5.Sum(body)
+	return &Object{
+		Body:         body,
+		ContentType:  contentType,
+		Metadata:     meta,
+		ETag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		LastModified: time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+func sortedKeys(objects map[string]*Object) []string {
+	keys := make([]string, 0, len(objects))
+	for k := range objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}